@@ -0,0 +1,343 @@
+package caf
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+var errIncompatibleAppend = errors.New("appended audio differs in channel count or layout from the caf")
+
+// ChunkFree pads a CAF, its contents are ignored
+var ChunkFree = NewFourByteStr("free")
+
+// AppendRestoreError is returned when appending failed and the CAF could not
+// be put back as it was either, which leaves it damaged. It unwraps to the
+// error that stopped the append.
+type AppendRestoreError struct {
+	Err        error
+	RestoreErr error
+}
+
+func (e *AppendRestoreError) Error() string {
+	return fmt.Sprintf("%v, and restoring the caf failed, leaving it damaged: %v", e.Err, e.RestoreErr)
+}
+
+func (e *AppendRestoreError) Unwrap() error {
+	return e.Err
+}
+
+// audioDescriptionFramesPerPacketOffset is where FramesPerPacket sits in the
+// contents of the desc chunk
+const audioDescriptionFramesPerPacketOffset = 20
+
+// AppendCafToCaf appends the audio of the Opus CAF sourceFile to the end of
+// the Opus CAF cafFile, in place. See AppendOpusToCaf.
+func AppendCafToCaf(cafFile string, sourceFile string) error {
+	inFile, err := os.Open(sourceFile)
+	if err != nil {
+		return err
+	}
+	defer inFile.Close()
+
+	stat, err := inFile.Stat()
+	if err != nil {
+		return err
+	}
+	source, err := NewCAFReader(inFile, stat.Size())
+	if err != nil {
+		return err
+	}
+	header, audio, err := source.opusAudio()
+	if err != nil {
+		return err
+	}
+	return appendToCafFile(cafFile, header, audio)
+}
+
+// AppendOpusToCaf appends the audio of the Ogg Opus file opusFile to the end
+// of the Opus CAF cafFile, in place. The packets are added to the data chunk
+// and the packet table grows to match: the remainder frames of the CAF and
+// the pre-skip of the addition become valid frames, and the end trimming of
+// the addition becomes the new remainder. Audio with another channel count,
+// mapping or layout is refused. Chunks that follow the data chunk are moved
+// to after the new audio, the rest of the file is left where it is. An error
+// leaves the CAF as it was, unless it is an AppendRestoreError.
+func AppendOpusToCaf(cafFile string, opusFile string, options ConvertOptions) (*ConversionReport, error) {
+	inFile, err := os.Open(opusFile)
+	if err != nil {
+		return nil, err
+	}
+	defer inFile.Close()
+
+	ogg, header, err := NewWithOptions(bufio.NewReaderSize(inFile, 32*1024), options.readerOptions())
+	if err != nil {
+		return nil, err
+	}
+	cafHeader, warnings, err := cafOpusHeader(header, options)
+	if err != nil {
+		return newConversionReport(ogg, warnings), err
+	}
+	if _, err := readOpusTags(ogg, options); err != nil {
+		return newConversionReport(ogg, warnings), err
+	}
+	err = appendToCafFile(cafFile, cafHeader, linkAudio(ogg, header))
+	return newConversionReport(ogg, warnings), err
+}
+
+func appendToCafFile(cafFile string, header *OggHeader, source audioSource) error {
+	f, err := os.OpenFile(cafFile, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := appendToCaf(f, header, source); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// appendToCaf adds the packets of source to the end of the data chunk of the
+// CAF in f. The packets are staged in a temporary file first, so that an
+// error in the source leaves the CAF as it was. The chunks after the data
+// chunk are read into memory and written back after the new audio, followed
+// by the new packet table. A packet table ahead of the data chunk is turned
+// into a free chunk. Should writing fail part way, the CAF is put back, and
+// an AppendRestoreError tells when it could not be.
+func appendToCaf(f *os.File, header *OggHeader, source audioSource) error {
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	cf, err := NewCAFReader(f, stat.Size())
+	if err != nil {
+		return err
+	}
+	target, err := cf.appendTarget(header)
+	if err != nil {
+		return err
+	}
+
+	staged, err := os.CreateTemp("", "caf-append-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(staged.Name())
+	defer staged.Close()
+	stagedWriter := bufio.NewWriterSize(staged, 32*1024)
+
+	appended := int64(0)
+	sizes := target.pakt.Entry
+	frames := target.frames
+	audio, err := source(func(packet []byte, packetFrames uint32) error {
+		appended += int64(len(packet))
+		sizes = append(sizes, uint64(len(packet)))
+		frames = append(frames, uint64(packetFrames))
+		_, err := stagedWriter.Write(packet)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := stagedWriter.Flush(); err != nil {
+		return err
+	}
+	if _, err := staged.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	// Everything that is overwritten is kept to put it back on failure:
+	// the chunks ahead of the audio, whose headers are patched, and the
+	// chunks that follow it
+	dataEnd := target.data.Offset + target.data.Size
+	head := make([]byte, target.data.Offset)
+	if _, err := f.ReadAt(head, 0); err != nil {
+		return err
+	}
+	tail := make([]byte, stat.Size()-dataEnd)
+	if _, err := f.ReadAt(tail, dataEnd); err != nil {
+		return err
+	}
+
+	packetTable := target.pakt.Header
+	packetTable.NumberPackets += audio.packetTable.NumberPackets
+	packetTable.NumberValidFrames += int64(packetTable.RemainderFrames) + int64(audio.packetTable.PrimingFrames) + audio.packetTable.NumberValidFrames
+	packetTable.RemainderFrames = audio.packetTable.RemainderFrames
+
+	err = writeAppended(f, cf, target, staged, appended, sizes, frames, packetTable)
+	if err != nil {
+		if restoreErr := restoreCaf(f, head, tail, dataEnd, stat.Size()); restoreErr != nil {
+			return &AppendRestoreError{Err: err, RestoreErr: restoreErr}
+		}
+	}
+	return err
+}
+
+// restoreCaf puts back the bytes ahead of the audio and after it, and the
+// size of a CAF whose append failed
+func restoreCaf(f *os.File, head []byte, tail []byte, dataEnd int64, size int64) error {
+	if _, err := f.WriteAt(head, 0); err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(tail, dataEnd); err != nil {
+		return err
+	}
+	return f.Truncate(size)
+}
+
+// writeAppended writes the staged packets after the audio of the CAF, moves
+// the chunks that followed the audio behind them, adds the packet table and
+// patches the headers
+func writeAppended(f *os.File, cf *CAFReader, target *cafAppendTarget, staged io.Reader, appended int64, sizes []uint64, frames []uint64, packetTable CAFPacketTableHeader) error {
+	// Keep what follows the audio, the packet table is written anew
+	var trailing [][]byte
+	for _, chunk := range cf.Chunks() {
+		if chunk.Offset <= target.data.Offset || chunk.Header.ChunkType == ChunkPacketTable {
+			continue
+		}
+		raw := make([]byte, cafChunkHeaderSize+chunk.Size)
+		if _, err := f.ReadAt(raw, chunk.Offset-cafChunkHeaderSize); err != nil {
+			return err
+		}
+		trailing = append(trailing, raw)
+	}
+
+	dataEnd := target.data.Offset + target.data.Size
+	if _, err := f.Seek(dataEnd, io.SeekStart); err != nil {
+		return err
+	}
+	bufferedWriter := bufio.NewWriterSize(f, 32*1024)
+	if _, err := io.Copy(bufferedWriter, staged); err != nil {
+		return err
+	}
+	for _, raw := range trailing {
+		if _, err := bufferedWriter.Write(raw); err != nil {
+			return err
+		}
+	}
+	if err := writePacketTableChunk(bufferedWriter, sizes, frames, packetTable); err != nil {
+		return err
+	}
+	if err := bufferedWriter.Flush(); err != nil {
+		return err
+	}
+	end, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(end); err != nil {
+		return err
+	}
+
+	// The data chunk is no longer last, so it needs its size
+	framesPerPacket := uint32(0)
+	if !variableFrameCounts(frames) && len(frames) > 0 {
+		framesPerPacket = uint32(frames[0])
+	}
+	if err := writeAt(f, target.desc.Offset+audioDescriptionFramesPerPacketOffset, framesPerPacket); err != nil {
+		return err
+	}
+	if err := writeAt(f, target.data.Offset-cafChunkHeaderSize+chunkSizeOffset, target.data.Size+appended); err != nil {
+		return err
+	}
+	if paktChunk, ok := cf.FindChunk(ChunkPacketTable); ok && paktChunk.Offset < target.data.Offset {
+		return writeAt(f, paktChunk.Offset-cafChunkHeaderSize, ChunkFree)
+	}
+	return nil
+}
+
+// cafAppendTarget is what appending needs to know about the CAF appended to
+type cafAppendTarget struct {
+	desc   CAFChunkInfo
+	data   CAFChunkInfo
+	pakt   *CAFPacketTable
+	frames []uint64 // Frame count of every packet
+}
+
+// appendTarget checks that audio with the given header can be appended to the CAF
+func (c *CAFReader) appendTarget(header *OggHeader) (*cafAppendTarget, error) {
+	target := &cafAppendTarget{}
+	var ok bool
+	if target.desc, ok = c.FindChunk(ChunkeAudioDescription); !ok {
+		return nil, errMissingDescChunk
+	}
+	if target.data, ok = c.FindChunk(ChunkAudioData); !ok {
+		return nil, errMissingDataChunk
+	}
+	desc, err := c.AudioDescription()
+	if err != nil {
+		return nil, err
+	}
+	if desc.FormatID != NewFourByteStr("opus") {
+		return nil, errNotOpusCaf
+	}
+	if target.pakt, err = c.PacketTable(); err == errChunkNotFound {
+		return nil, errMissingPacketTable
+	} else if err != nil {
+		return nil, err
+	}
+
+	cafHeader, err := c.opusHeader(desc, target.pakt)
+	if err != nil {
+		return nil, err
+	}
+	if !cafHeader.sameChannels(header) {
+		return nil, errIncompatibleAppend
+	}
+	layout, err := c.ChannelLayout()
+	if err == nil {
+		sourceLayout := GetChannelLayoutForOpusHeader(header)
+		labels, err := layout.ChannelLabels()
+		if err != nil {
+			return nil, err
+		}
+		sourceLabels, err := sourceLayout.ChannelLabels()
+		if err != nil {
+			return nil, err
+		}
+		if fmt.Sprint(labels) != fmt.Sprint(sourceLabels) {
+			return nil, errIncompatibleAppend
+		}
+	} else if err != errChunkNotFound {
+		return nil, err
+	}
+
+	switch {
+	case target.pakt.Frames != nil:
+		target.frames = append([]uint64(nil), target.pakt.Frames...)
+	case desc.FramesPerPacket > 0:
+		target.frames = make([]uint64, len(target.pakt.Entry))
+		for i := range target.frames {
+			target.frames[i] = uint64(desc.FramesPerPacket)
+		}
+	default:
+		packets, err := c.Packets()
+		if err != nil {
+			return nil, err
+		}
+		for {
+			packet, err := packets.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			target.frames = append(target.frames, uint64(packet.Frames))
+		}
+	}
+	target.pakt.Entry = append([]uint64(nil), target.pakt.Entry...)
+	return target, nil
+}
+
+// writeAt writes the big endian encoding of value at offset
+func writeAt(f *os.File, offset int64, value any) error {
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	return binary.Write(f, binary.BigEndian, value)
+}
@@ -2,14 +2,22 @@ package caf
 
 import (
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
 )
 
-const (
-	kCAFChannelLayoutTag_Mono   = 100<<16 | 1
-	kCAFChannelLayoutTag_Stereo = 101<<16 | 2
+var (
+	errUnknownChannelLayoutTag   = errors.New("channel layout tag has no known channel order")
+	errNoMatchingChannelLayout   = errors.New("no channel layout tag has this channel order")
+	errNotChannelBitmap          = errors.New("channels cannot be described by a channel bitmap")
+	errChannelDescriptionCount   = errors.New("channel description count does not match the descriptions")
+	errChannelLayoutChannelCount = errors.New("channel layout does not match the channel count")
 )
 
+// channelDescriptionSize is the encoded size of a CAFChannelDescription
+const channelDescriptionSize = 20
+
 type CAFChannelLayout struct {
 	ChannelLayoutTag          uint32
 	ChannelBitmap             uint32
@@ -61,6 +69,194 @@ func (c *CAFChannelLayout) encode(w io.Writer) error {
 	return nil
 }
 
+// size returns the size of the encoded channel layout, for the chunk header
+func (c *CAFChannelLayout) size() int64 {
+	return 12 + channelDescriptionSize*int64(len(c.Channels))
+}
+
+// NewChannelLayoutChunk returns a chan chunk holding the layout
+func NewChannelLayoutChunk(layout CAFChannelLayout) CAFChunk {
+	return CAFChunk{
+		Header:   CAFChunkHeader{ChunkType: ChunkChannelLayout, ChunkSize: layout.size()},
+		Contents: &layout,
+	}
+}
+
+// NewChannelLayoutForLabels returns the most compact layout for channels
+// with the given labels: a layout tag when one has this order, otherwise a
+// channel bitmap, otherwise a description per channel
+func NewChannelLayoutForLabels(labels []uint32) CAFChannelLayout {
+	if tags, ok := layoutTagsByLabels[fmt.Sprint(labels)]; ok {
+		return CAFChannelLayout{ChannelLayoutTag: tags[0]}
+	}
+	if bitmap, ok := channelBitmapForLabels(labels); ok {
+		return CAFChannelLayout{ChannelLayoutTag: kCAFChannelLayoutTag_UseChannelBitmap, ChannelBitmap: bitmap}
+	}
+	layout := CAFChannelLayout{ChannelLayoutTag: kCAFChannelLayoutTag_UseChannelDescriptions}
+	for _, label := range labels {
+		layout.Channels = append(layout.Channels, CAFChannelDescription{ChannelLabel: label})
+	}
+	layout.NumberChannelDescriptions = uint32(len(layout.Channels))
+	return layout
+}
+
+// ChannelCount returns the number of channels the layout describes
+func (c *CAFChannelLayout) ChannelCount() int {
+	switch c.ChannelLayoutTag {
+	case kCAFChannelLayoutTag_UseChannelDescriptions:
+		return len(c.Channels)
+	case kCAFChannelLayoutTag_UseChannelBitmap:
+		count := 0
+		for _, channel := range channelBits {
+			if c.ChannelBitmap&channel.bit != 0 {
+				count++
+			}
+		}
+		return count
+	}
+	return int(c.ChannelLayoutTag & 0xFFFF)
+}
+
+// ChannelLabels returns the speaker position of each channel, in channel
+// order. Use ChannelLabelName to name them.
+func (c *CAFChannelLayout) ChannelLabels() ([]uint32, error) {
+	count := c.ChannelLayoutTag & 0xFFFF
+	var first uint32
+	switch c.ChannelLayoutTag &^ 0xFFFF {
+	case kCAFChannelLayoutTag_UseChannelDescriptions:
+		if c.ChannelLayoutTag != kCAFChannelLayoutTag_UseChannelDescriptions {
+			return nil, errUnknownChannelLayoutTag
+		}
+		labels := make([]uint32, 0, len(c.Channels))
+		for _, channel := range c.Channels {
+			labels = append(labels, channel.ChannelLabel)
+		}
+		return labels, nil
+	case kCAFChannelLayoutTag_UseChannelBitmap:
+		if c.ChannelLayoutTag != kCAFChannelLayoutTag_UseChannelBitmap {
+			return nil, errUnknownChannelLayoutTag
+		}
+		var labels []uint32
+		for _, channel := range channelBits {
+			if c.ChannelBitmap&channel.bit != 0 {
+				labels = append(labels, channel.label)
+			}
+		}
+		return labels, nil
+	case kCAFChannelLayoutTag_DiscreteInOrder:
+		first = kCAFChannelLabel_Discrete_0
+	case kCAFChannelLayoutTag_HOA_ACN_SN3D:
+		first = kCAFChannelLabel_HOA_ACN_0
+	case kCAFChannelLayoutTag_HOA_ACN_N3D:
+		first = kCAFChannelLabel_HOA_N3D_0
+	case kCAFChannelLayoutTag_Unknown:
+		first = kCAFChannelLabel_Unknown
+	default:
+		labels, ok := channelLayoutTagLabels[c.ChannelLayoutTag]
+		if !ok {
+			return nil, errUnknownChannelLayoutTag
+		}
+		return append([]uint32(nil), labels...), nil
+	}
+
+	labels := make([]uint32, count)
+	for i := range labels {
+		labels[i] = first
+		if first != kCAFChannelLabel_Unknown {
+			labels[i] |= uint32(i)
+		}
+	}
+	return labels, nil
+}
+
+// WithDescriptions returns the layout with a description per channel.
+// Descriptions of a layout that already has them are kept as they are,
+// coordinates included.
+func (c *CAFChannelLayout) WithDescriptions() (CAFChannelLayout, error) {
+	if c.ChannelLayoutTag == kCAFChannelLayoutTag_UseChannelDescriptions {
+		layout := CAFChannelLayout{ChannelLayoutTag: kCAFChannelLayoutTag_UseChannelDescriptions}
+		layout.Channels = append(layout.Channels, c.Channels...)
+		layout.NumberChannelDescriptions = uint32(len(layout.Channels))
+		return layout, nil
+	}
+	labels, err := c.ChannelLabels()
+	if err != nil {
+		return CAFChannelLayout{}, err
+	}
+	layout := CAFChannelLayout{ChannelLayoutTag: kCAFChannelLayoutTag_UseChannelDescriptions}
+	for _, label := range labels {
+		layout.Channels = append(layout.Channels, CAFChannelDescription{ChannelLabel: label})
+	}
+	layout.NumberChannelDescriptions = uint32(len(layout.Channels))
+	return layout, nil
+}
+
+// WithBitmap returns the layout as a channel bitmap, which only works when
+// every channel has a bitmap flag and the channels are in bit order
+func (c *CAFChannelLayout) WithBitmap() (CAFChannelLayout, error) {
+	labels, err := c.ChannelLabels()
+	if err != nil {
+		return CAFChannelLayout{}, err
+	}
+	bitmap, ok := channelBitmapForLabels(labels)
+	if !ok {
+		return CAFChannelLayout{}, errNotChannelBitmap
+	}
+	return CAFChannelLayout{ChannelLayoutTag: kCAFChannelLayoutTag_UseChannelBitmap, ChannelBitmap: bitmap}, nil
+}
+
+// WithTag returns the layout as a layout tag with the same channel order.
+// When several tags have that order the lowest one is used.
+func (c *CAFChannelLayout) WithTag() (CAFChannelLayout, error) {
+	labels, err := c.ChannelLabels()
+	if err != nil {
+		return CAFChannelLayout{}, err
+	}
+	tags, ok := layoutTagsByLabels[fmt.Sprint(labels)]
+	if !ok {
+		return CAFChannelLayout{}, errNoMatchingChannelLayout
+	}
+	return CAFChannelLayout{ChannelLayoutTag: tags[0]}, nil
+}
+
+// Validate checks that the layout is well formed and describes the given
+// number of channels
+func (c *CAFChannelLayout) Validate(channels uint32) error {
+	if c.NumberChannelDescriptions != uint32(len(c.Channels)) {
+		return errChannelDescriptionCount
+	}
+	if _, err := c.ChannelLabels(); err != nil {
+		return err
+	}
+	if c.ChannelCount() != int(channels) {
+		return errChannelLayoutChannelCount
+	}
+	return nil
+}
+
+// channelBitmapForLabels returns the bitmap for channels that are all
+// bitmap channels, each at most once and in bit order
+func channelBitmapForLabels(labels []uint32) (uint32, bool) {
+	bitmap := uint32(0)
+	next := 0
+	for _, label := range labels {
+		found := false
+		for next < len(channelBits) {
+			channel := channelBits[next]
+			next++
+			if channel.label == label {
+				bitmap |= channel.bit
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, false
+		}
+	}
+	return bitmap, len(labels) > 0
+}
+
 func GetChannelLayoutForChannels(channels uint32) uint32 {
 	switch channels {
 	case 1:
@@ -72,3 +268,60 @@ func GetChannelLayoutForChannels(channels uint32) uint32 {
 		return 0 // Unknown layout
 	}
 }
+
+// GetChannelLayoutForOpusHeader returns the layout of the output channels of
+// an Opus stream. Mapping families 0 and 1 use the Vorbis channel order,
+// families 2 and 3 are ambisonics in ACN order with SN3D normalization, and
+// other families have no defined positions so their channels are discrete.
+func GetChannelLayoutForOpusHeader(header *OggHeader) CAFChannelLayout {
+	tag := uint32(kCAFChannelLayoutTag_DiscreteInOrder | uint32(header.Channels))
+	switch header.ChannelMap {
+	case 2, 3:
+		if order, nonDiegetic, ok := AmbisonicOrder(header.Channels); ok {
+			return getAmbisonicChannelLayout(order, nonDiegetic)
+		}
+	case 0:
+		tag = GetChannelLayoutForChannels(uint32(header.Channels))
+	case 1:
+		switch header.Channels {
+		case 1:
+			tag = kCAFChannelLayoutTag_Mono
+		case 2:
+			tag = kCAFChannelLayoutTag_Stereo
+		case 3:
+			tag = kCAFChannelLayoutTag_Ogg_3_0
+		case 4:
+			tag = kCAFChannelLayoutTag_Ogg_4_0
+		case 5:
+			tag = kCAFChannelLayoutTag_Ogg_5_0
+		case 6:
+			tag = kCAFChannelLayoutTag_Ogg_5_1
+		case 7:
+			tag = kCAFChannelLayoutTag_Ogg_6_1
+		case 8:
+			tag = kCAFChannelLayoutTag_Ogg_7_1
+		}
+	}
+	return CAFChannelLayout{ChannelLayoutTag: tag}
+}
+
+// getAmbisonicChannelLayout returns the HOA layout tag for plain ambisonics.
+// The tag cannot describe the trailing non-diegetic stereo pair, so such
+// streams list every channel instead.
+func getAmbisonicChannelLayout(order int, nonDiegetic bool) CAFChannelLayout {
+	ambisonicChannels := (order + 1) * (order + 1)
+	if !nonDiegetic {
+		return CAFChannelLayout{ChannelLayoutTag: kCAFChannelLayoutTag_HOA_ACN_SN3D | uint32(ambisonicChannels)}
+	}
+
+	layout := CAFChannelLayout{ChannelLayoutTag: kCAFChannelLayoutTag_UseChannelDescriptions}
+	for acn := 0; acn < ambisonicChannels; acn++ {
+		layout.Channels = append(layout.Channels, CAFChannelDescription{ChannelLabel: kCAFChannelLabel_HOA_ACN_0 | uint32(acn)})
+	}
+	layout.Channels = append(layout.Channels,
+		CAFChannelDescription{ChannelLabel: kCAFChannelLabel_Left},
+		CAFChannelDescription{ChannelLabel: kCAFChannelLabel_Right},
+	)
+	layout.NumberChannelDescriptions = uint32(len(layout.Channels))
+	return layout
+}
@@ -0,0 +1,574 @@
+package caf
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Channel layout tags, as in Core Audio's CoreAudioBaseTypes.h. The low 16
+// bits of a tag hold its channel count.
+const (
+	kCAFChannelLayoutTag_UseChannelDescriptions = 0 << 16
+	kCAFChannelLayoutTag_UseChannelBitmap       = 1 << 16
+
+	kCAFChannelLayoutTag_Mono                = 100<<16 | 1
+	kCAFChannelLayoutTag_Stereo              = 101<<16 | 2
+	kCAFChannelLayoutTag_StereoHeadphones    = 102<<16 | 2
+	kCAFChannelLayoutTag_MatrixStereo        = 103<<16 | 2
+	kCAFChannelLayoutTag_MidSide             = 104<<16 | 2
+	kCAFChannelLayoutTag_XY                  = 105<<16 | 2
+	kCAFChannelLayoutTag_Binaural            = 106<<16 | 2
+	kCAFChannelLayoutTag_Ambisonic_B_Format  = 107<<16 | 4
+	kCAFChannelLayoutTag_Quadraphonic        = 108<<16 | 4
+	kCAFChannelLayoutTag_Pentagonal          = 109<<16 | 5
+	kCAFChannelLayoutTag_Hexagonal           = 110<<16 | 6
+	kCAFChannelLayoutTag_Octagonal           = 111<<16 | 8
+	kCAFChannelLayoutTag_Cube                = 112<<16 | 8
+	kCAFChannelLayoutTag_MPEG_3_0_A          = 113<<16 | 3
+	kCAFChannelLayoutTag_MPEG_3_0_B          = 114<<16 | 3
+	kCAFChannelLayoutTag_MPEG_4_0_A          = 115<<16 | 4
+	kCAFChannelLayoutTag_MPEG_4_0_B          = 116<<16 | 4
+	kCAFChannelLayoutTag_MPEG_5_0_A          = 117<<16 | 5
+	kCAFChannelLayoutTag_MPEG_5_0_B          = 118<<16 | 5
+	kCAFChannelLayoutTag_MPEG_5_0_C          = 119<<16 | 5
+	kCAFChannelLayoutTag_MPEG_5_0_D          = 120<<16 | 5
+	kCAFChannelLayoutTag_MPEG_5_1_A          = 121<<16 | 6
+	kCAFChannelLayoutTag_MPEG_5_1_B          = 122<<16 | 6
+	kCAFChannelLayoutTag_MPEG_5_1_C          = 123<<16 | 6
+	kCAFChannelLayoutTag_MPEG_5_1_D          = 124<<16 | 6
+	kCAFChannelLayoutTag_MPEG_6_1_A          = 125<<16 | 7
+	kCAFChannelLayoutTag_MPEG_7_1_A          = 126<<16 | 8
+	kCAFChannelLayoutTag_MPEG_7_1_B          = 127<<16 | 8
+	kCAFChannelLayoutTag_MPEG_7_1_C          = 128<<16 | 8
+	kCAFChannelLayoutTag_Emagic_Default_7_1  = 129<<16 | 8
+	kCAFChannelLayoutTag_SMPTE_DTV           = 130<<16 | 8
+	kCAFChannelLayoutTag_ITU_2_1             = 131<<16 | 3
+	kCAFChannelLayoutTag_ITU_2_2             = 132<<16 | 4
+	kCAFChannelLayoutTag_DVD_4               = 133<<16 | 3
+	kCAFChannelLayoutTag_DVD_5               = 134<<16 | 4
+	kCAFChannelLayoutTag_DVD_6               = 135<<16 | 5
+	kCAFChannelLayoutTag_DVD_10              = 136<<16 | 4
+	kCAFChannelLayoutTag_DVD_11              = 137<<16 | 5
+	kCAFChannelLayoutTag_DVD_18              = 138<<16 | 5
+	kCAFChannelLayoutTag_AudioUnit_6_0       = 139<<16 | 6
+	kCAFChannelLayoutTag_AudioUnit_7_0       = 140<<16 | 7
+	kCAFChannelLayoutTag_AAC_6_0             = 141<<16 | 6
+	kCAFChannelLayoutTag_AAC_6_1             = 142<<16 | 7
+	kCAFChannelLayoutTag_AAC_7_0             = 143<<16 | 7
+	kCAFChannelLayoutTag_AAC_Octagonal       = 144<<16 | 8
+	kCAFChannelLayoutTag_TMH_10_2_std        = 145<<16 | 16
+	kCAFChannelLayoutTag_TMH_10_2_full       = 146<<16 | 21
+	kCAFChannelLayoutTag_DiscreteInOrder     = 147 << 16 // Channel count in the low 16 bits
+	kCAFChannelLayoutTag_AudioUnit_7_0_Front = 148<<16 | 7
+	kCAFChannelLayoutTag_AC3_1_0_1           = 149<<16 | 2
+	kCAFChannelLayoutTag_AC3_3_0             = 150<<16 | 3
+	kCAFChannelLayoutTag_AC3_3_1             = 151<<16 | 4
+	kCAFChannelLayoutTag_AC3_3_0_1           = 152<<16 | 4
+	kCAFChannelLayoutTag_AC3_2_1_1           = 153<<16 | 4
+	kCAFChannelLayoutTag_AC3_3_1_1           = 154<<16 | 5
+	kCAFChannelLayoutTag_EAC_6_0_A           = 155<<16 | 6
+	kCAFChannelLayoutTag_EAC_7_0_A           = 156<<16 | 7
+	kCAFChannelLayoutTag_EAC3_6_1_A          = 157<<16 | 7
+	kCAFChannelLayoutTag_EAC3_6_1_B          = 158<<16 | 7
+	kCAFChannelLayoutTag_EAC3_6_1_C          = 159<<16 | 7
+	kCAFChannelLayoutTag_EAC3_7_1_A          = 160<<16 | 8
+	kCAFChannelLayoutTag_EAC3_7_1_B          = 161<<16 | 8
+	kCAFChannelLayoutTag_EAC3_7_1_C          = 162<<16 | 8
+	kCAFChannelLayoutTag_EAC3_7_1_D          = 163<<16 | 8
+	kCAFChannelLayoutTag_EAC3_7_1_E          = 164<<16 | 8
+	kCAFChannelLayoutTag_EAC3_7_1_F          = 165<<16 | 8
+	kCAFChannelLayoutTag_EAC3_7_1_G          = 166<<16 | 8
+	kCAFChannelLayoutTag_EAC3_7_1_H          = 167<<16 | 8
+	kCAFChannelLayoutTag_DTS_3_1             = 168<<16 | 4
+	kCAFChannelLayoutTag_DTS_4_1             = 169<<16 | 5
+	kCAFChannelLayoutTag_DTS_6_0_A           = 170<<16 | 6
+	kCAFChannelLayoutTag_DTS_6_0_B           = 171<<16 | 6
+	kCAFChannelLayoutTag_DTS_6_0_C           = 172<<16 | 6
+	kCAFChannelLayoutTag_DTS_6_1_A           = 173<<16 | 7
+	kCAFChannelLayoutTag_DTS_6_1_B           = 174<<16 | 7
+	kCAFChannelLayoutTag_DTS_6_1_C           = 175<<16 | 7
+	kCAFChannelLayoutTag_DTS_7_0             = 176<<16 | 7
+	kCAFChannelLayoutTag_DTS_7_1             = 177<<16 | 8
+	kCAFChannelLayoutTag_DTS_8_0_A           = 178<<16 | 8
+	kCAFChannelLayoutTag_DTS_8_0_B           = 179<<16 | 8
+	kCAFChannelLayoutTag_DTS_8_1_A           = 180<<16 | 9
+	kCAFChannelLayoutTag_DTS_8_1_B           = 181<<16 | 9
+	kCAFChannelLayoutTag_DTS_6_1_D           = 182<<16 | 7
+	kCAFChannelLayoutTag_AAC_7_1_B           = 183<<16 | 8
+	kCAFChannelLayoutTag_AAC_7_1_C           = 184<<16 | 8
+	kCAFChannelLayoutTag_WAVE_4_0_B          = 185<<16 | 4
+	kCAFChannelLayoutTag_WAVE_5_0_B          = 186<<16 | 5
+	kCAFChannelLayoutTag_WAVE_5_1_B          = 187<<16 | 6
+	kCAFChannelLayoutTag_WAVE_6_1            = 188<<16 | 7
+	kCAFChannelLayoutTag_WAVE_7_1            = 189<<16 | 8
+	kCAFChannelLayoutTag_HOA_ACN_SN3D        = 190 << 16 // Channel count in the low 16 bits
+	kCAFChannelLayoutTag_HOA_ACN_N3D         = 191 << 16 // Channel count in the low 16 bits
+	kCAFChannelLayoutTag_Atmos_7_1_4         = 192<<16 | 12
+	kCAFChannelLayoutTag_Atmos_9_1_6         = 193<<16 | 16
+	kCAFChannelLayoutTag_Atmos_5_1_2         = 194<<16 | 8
+	kCAFChannelLayoutTag_Atmos_5_1_4         = 195<<16 | 10
+	kCAFChannelLayoutTag_Atmos_7_1_2         = 196<<16 | 10
+	kCAFChannelLayoutTag_Logic_4_0_C         = 197<<16 | 4
+	kCAFChannelLayoutTag_Logic_6_0_B         = 198<<16 | 6
+	kCAFChannelLayoutTag_Logic_6_1_B         = 199<<16 | 7
+	kCAFChannelLayoutTag_Logic_6_1_D         = 200<<16 | 7
+	kCAFChannelLayoutTag_Logic_7_1_B         = 201<<16 | 8
+	kCAFChannelLayoutTag_Logic_Atmos_7_1_4_B = 202<<16 | 12
+	kCAFChannelLayoutTag_Logic_Atmos_7_1_6   = 203<<16 | 14
+	kCAFChannelLayoutTag_CICP_13             = 204<<16 | 24
+	kCAFChannelLayoutTag_CICP_14             = 205<<16 | 8
+	kCAFChannelLayoutTag_CICP_15             = 206<<16 | 12
+	kCAFChannelLayoutTag_CICP_16             = 207<<16 | 10
+	kCAFChannelLayoutTag_CICP_17             = 208<<16 | 12
+	kCAFChannelLayoutTag_CICP_18             = 209<<16 | 14
+	kCAFChannelLayoutTag_CICP_19             = 210<<16 | 12
+	kCAFChannelLayoutTag_CICP_20             = 211<<16 | 14
+	kCAFChannelLayoutTag_Ogg_5_0             = 212<<16 | 5 // L C R Ls Rs
+	kCAFChannelLayoutTag_Ogg_5_1             = 213<<16 | 6 // L C R Ls Rs LFE
+	kCAFChannelLayoutTag_Ogg_6_1             = 214<<16 | 7 // L C R Ls Rs Cs LFE
+	kCAFChannelLayoutTag_Ogg_7_1             = 215<<16 | 8 // L C R Ls Rs Rls Rrs LFE
+	kCAFChannelLayoutTag_MPEG_5_0_E          = 216<<16 | 5
+	kCAFChannelLayoutTag_MPEG_5_1_E          = 217<<16 | 6
+	kCAFChannelLayoutTag_MPEG_6_1_B          = 218<<16 | 7
+	kCAFChannelLayoutTag_MPEG_7_1_D          = 219<<16 | 8
+	kCAFChannelLayoutTag_Unknown             = 0xFFFF << 16 // Channel count in the low 16 bits
+
+	// Vorbis channel orders used by Opus channel mapping family 1
+	kCAFChannelLayoutTag_Ogg_3_0 = kCAFChannelLayoutTag_AC3_3_0    // L C R
+	kCAFChannelLayoutTag_Ogg_4_0 = kCAFChannelLayoutTag_WAVE_4_0_B // L R Rls Rrs
+)
+
+// Channel labels, the speaker position of a channel
+const (
+	kCAFChannelLabel_Unknown              = 0xFFFFFFFF
+	kCAFChannelLabel_Unused               = 0
+	kCAFChannelLabel_UseCoordinates       = 100
+	kCAFChannelLabel_Left                 = 1
+	kCAFChannelLabel_Right                = 2
+	kCAFChannelLabel_Center               = 3
+	kCAFChannelLabel_LFEScreen            = 4
+	kCAFChannelLabel_LeftSurround         = 5
+	kCAFChannelLabel_RightSurround        = 6
+	kCAFChannelLabel_LeftCenter           = 7
+	kCAFChannelLabel_RightCenter          = 8
+	kCAFChannelLabel_CenterSurround       = 9
+	kCAFChannelLabel_LeftSurroundDirect   = 10
+	kCAFChannelLabel_RightSurroundDirect  = 11
+	kCAFChannelLabel_TopCenterSurround    = 12
+	kCAFChannelLabel_VerticalHeightLeft   = 13
+	kCAFChannelLabel_VerticalHeightCenter = 14
+	kCAFChannelLabel_VerticalHeightRight  = 15
+	kCAFChannelLabel_TopBackLeft          = 16
+	kCAFChannelLabel_TopBackCenter        = 17
+	kCAFChannelLabel_TopBackRight         = 18
+	kCAFChannelLabel_RearSurroundLeft     = 33
+	kCAFChannelLabel_RearSurroundRight    = 34
+	kCAFChannelLabel_LeftWide             = 35
+	kCAFChannelLabel_RightWide            = 36
+	kCAFChannelLabel_LFE2                 = 37
+	kCAFChannelLabel_LeftTotal            = 38
+	kCAFChannelLabel_RightTotal           = 39
+	kCAFChannelLabel_HearingImpaired      = 40
+	kCAFChannelLabel_Narration            = 41
+	kCAFChannelLabel_Mono                 = 42
+	kCAFChannelLabel_DialogCentricMix     = 43
+	kCAFChannelLabel_CenterSurroundDirect = 44
+	kCAFChannelLabel_Haptic               = 45
+	kCAFChannelLabel_LeftTopMiddle        = 49
+	kCAFChannelLabel_RightTopMiddle       = 51
+	kCAFChannelLabel_LeftTopRear          = 52
+	kCAFChannelLabel_CenterTopRear        = 53
+	kCAFChannelLabel_RightTopRear         = 54
+	kCAFChannelLabel_LeftSideSurround     = 55
+	kCAFChannelLabel_RightSideSurround    = 56
+	kCAFChannelLabel_LeftBottom           = 57
+	kCAFChannelLabel_RightBottom          = 58
+	kCAFChannelLabel_CenterBottom         = 59
+	kCAFChannelLabel_LeftTopSurround      = 60
+	kCAFChannelLabel_RightTopSurround     = 61
+	kCAFChannelLabel_LFE3                 = 62
+	kCAFChannelLabel_LeftBackSurround     = 63
+	kCAFChannelLabel_RightBackSurround    = 64
+	kCAFChannelLabel_LeftEdgeOfScreen     = 65
+	kCAFChannelLabel_RightEdgeOfScreen    = 66
+	kCAFChannelLabel_Ambisonic_W          = 200
+	kCAFChannelLabel_Ambisonic_X          = 201
+	kCAFChannelLabel_Ambisonic_Y          = 202
+	kCAFChannelLabel_Ambisonic_Z          = 203
+	kCAFChannelLabel_MS_Mid               = 204
+	kCAFChannelLabel_MS_Side              = 205
+	kCAFChannelLabel_XY_X                 = 206
+	kCAFChannelLabel_XY_Y                 = 207
+	kCAFChannelLabel_BinauralLeft         = 208
+	kCAFChannelLabel_BinauralRight        = 209
+	kCAFChannelLabel_HeadphonesLeft       = 301
+	kCAFChannelLabel_HeadphonesRight      = 302
+	kCAFChannelLabel_ClickTrack           = 304
+	kCAFChannelLabel_ForeignLanguage      = 305
+	kCAFChannelLabel_Discrete             = 400
+	kCAFChannelLabel_HOA_ACN              = 500
+	kCAFChannelLabel_Discrete_0           = 1 << 16 // Channel index in the low 16 bits
+	kCAFChannelLabel_HOA_ACN_0            = 2 << 16 // ACN channel number in the low 16 bits, SN3D normalized
+	kCAFChannelLabel_HOA_N3D_0            = 3 << 16 // ACN channel number in the low 16 bits, N3D normalized
+
+	// Aliases for the height channels of newer layouts
+	kCAFChannelLabel_LeftTopFront    = kCAFChannelLabel_VerticalHeightLeft
+	kCAFChannelLabel_CenterTopFront  = kCAFChannelLabel_VerticalHeightCenter
+	kCAFChannelLabel_RightTopFront   = kCAFChannelLabel_VerticalHeightRight
+	kCAFChannelLabel_CenterTopMiddle = kCAFChannelLabel_TopCenterSurround
+)
+
+// Channel bitmap flags, for kCAFChannelLayoutTag_UseChannelBitmap. Channels
+// are stored in the order of their bits.
+const (
+	kCAFChannelBit_Left                 = 1 << 0
+	kCAFChannelBit_Right                = 1 << 1
+	kCAFChannelBit_Center               = 1 << 2
+	kCAFChannelBit_LFEScreen            = 1 << 3
+	kCAFChannelBit_LeftSurround         = 1 << 4
+	kCAFChannelBit_RightSurround        = 1 << 5
+	kCAFChannelBit_LeftCenter           = 1 << 6
+	kCAFChannelBit_RightCenter          = 1 << 7
+	kCAFChannelBit_CenterSurround       = 1 << 8
+	kCAFChannelBit_LeftSurroundDirect   = 1 << 9
+	kCAFChannelBit_RightSurroundDirect  = 1 << 10
+	kCAFChannelBit_TopCenterSurround    = 1 << 11
+	kCAFChannelBit_VerticalHeightLeft   = 1 << 12
+	kCAFChannelBit_VerticalHeightCenter = 1 << 13
+	kCAFChannelBit_VerticalHeightRight  = 1 << 14
+	kCAFChannelBit_TopBackLeft          = 1 << 15
+	kCAFChannelBit_TopBackCenter        = 1 << 16
+	kCAFChannelBit_TopBackRight         = 1 << 17
+	kCAFChannelBit_LeftTopMiddle        = 1 << 21
+	kCAFChannelBit_RightTopMiddle       = 1 << 23
+	kCAFChannelBit_LeftTopRear          = 1 << 24
+	kCAFChannelBit_CenterTopRear        = 1 << 25
+	kCAFChannelBit_RightTopRear         = 1 << 26
+)
+
+// Channel description flags, saying how to read the coordinates of a
+// kCAFChannelLabel_UseCoordinates channel
+const (
+	kCAFChannelFlags_RectangularCoordinates = 1 << 0
+	kCAFChannelFlags_SphericalCoordinates   = 1 << 1
+	kCAFChannelFlags_Meters                 = 1 << 2
+)
+
+// channelBits maps each bitmap flag to its channel label, in bit order
+var channelBits = []struct {
+	bit   uint32
+	label uint32
+}{
+	{kCAFChannelBit_Left, kCAFChannelLabel_Left},
+	{kCAFChannelBit_Right, kCAFChannelLabel_Right},
+	{kCAFChannelBit_Center, kCAFChannelLabel_Center},
+	{kCAFChannelBit_LFEScreen, kCAFChannelLabel_LFEScreen},
+	{kCAFChannelBit_LeftSurround, kCAFChannelLabel_LeftSurround},
+	{kCAFChannelBit_RightSurround, kCAFChannelLabel_RightSurround},
+	{kCAFChannelBit_LeftCenter, kCAFChannelLabel_LeftCenter},
+	{kCAFChannelBit_RightCenter, kCAFChannelLabel_RightCenter},
+	{kCAFChannelBit_CenterSurround, kCAFChannelLabel_CenterSurround},
+	{kCAFChannelBit_LeftSurroundDirect, kCAFChannelLabel_LeftSurroundDirect},
+	{kCAFChannelBit_RightSurroundDirect, kCAFChannelLabel_RightSurroundDirect},
+	{kCAFChannelBit_TopCenterSurround, kCAFChannelLabel_TopCenterSurround},
+	{kCAFChannelBit_VerticalHeightLeft, kCAFChannelLabel_VerticalHeightLeft},
+	{kCAFChannelBit_VerticalHeightCenter, kCAFChannelLabel_VerticalHeightCenter},
+	{kCAFChannelBit_VerticalHeightRight, kCAFChannelLabel_VerticalHeightRight},
+	{kCAFChannelBit_TopBackLeft, kCAFChannelLabel_TopBackLeft},
+	{kCAFChannelBit_TopBackCenter, kCAFChannelLabel_TopBackCenter},
+	{kCAFChannelBit_TopBackRight, kCAFChannelLabel_TopBackRight},
+	{kCAFChannelBit_LeftTopMiddle, kCAFChannelLabel_LeftTopMiddle},
+	{kCAFChannelBit_RightTopMiddle, kCAFChannelLabel_RightTopMiddle},
+	{kCAFChannelBit_LeftTopRear, kCAFChannelLabel_LeftTopRear},
+	{kCAFChannelBit_CenterTopRear, kCAFChannelLabel_CenterTopRear},
+	{kCAFChannelBit_RightTopRear, kCAFChannelLabel_RightTopRear},
+}
+
+// channelLabelNames holds the name of every fixed channel label, and the
+// short form the layout table below is written with
+var channelLabelNames = map[uint32][2]string{
+	kCAFChannelLabel_Unknown:              {"Unknown", ""},
+	kCAFChannelLabel_Unused:               {"Unused", ""},
+	kCAFChannelLabel_UseCoordinates:       {"UseCoordinates", ""},
+	kCAFChannelLabel_Left:                 {"Left", "L"},
+	kCAFChannelLabel_Right:                {"Right", "R"},
+	kCAFChannelLabel_Center:               {"Center", "C"},
+	kCAFChannelLabel_LFEScreen:            {"LFEScreen", "LFE"},
+	kCAFChannelLabel_LeftSurround:         {"LeftSurround", "Ls"},
+	kCAFChannelLabel_RightSurround:        {"RightSurround", "Rs"},
+	kCAFChannelLabel_LeftCenter:           {"LeftCenter", "Lc"},
+	kCAFChannelLabel_RightCenter:          {"RightCenter", "Rc"},
+	kCAFChannelLabel_CenterSurround:       {"CenterSurround", "Cs"},
+	kCAFChannelLabel_LeftSurroundDirect:   {"LeftSurroundDirect", "Lsd"},
+	kCAFChannelLabel_RightSurroundDirect:  {"RightSurroundDirect", "Rsd"},
+	kCAFChannelLabel_TopCenterSurround:    {"TopCenterSurround", "Ts"},
+	kCAFChannelLabel_VerticalHeightLeft:   {"VerticalHeightLeft", "Vhl"},
+	kCAFChannelLabel_VerticalHeightCenter: {"VerticalHeightCenter", "Vhc"},
+	kCAFChannelLabel_VerticalHeightRight:  {"VerticalHeightRight", "Vhr"},
+	kCAFChannelLabel_TopBackLeft:          {"TopBackLeft", "Tbl"},
+	kCAFChannelLabel_TopBackCenter:        {"TopBackCenter", "Tbc"},
+	kCAFChannelLabel_TopBackRight:         {"TopBackRight", "Tbr"},
+	kCAFChannelLabel_RearSurroundLeft:     {"RearSurroundLeft", "Rls"},
+	kCAFChannelLabel_RearSurroundRight:    {"RearSurroundRight", "Rrs"},
+	kCAFChannelLabel_LeftWide:             {"LeftWide", "Lw"},
+	kCAFChannelLabel_RightWide:            {"RightWide", "Rw"},
+	kCAFChannelLabel_LFE2:                 {"LFE2", "LFE2"},
+	kCAFChannelLabel_LeftTotal:            {"LeftTotal", "Lt"},
+	kCAFChannelLabel_RightTotal:           {"RightTotal", "Rt"},
+	kCAFChannelLabel_HearingImpaired:      {"HearingImpaired", "HI"},
+	kCAFChannelLabel_Narration:            {"Narration", "VI"},
+	kCAFChannelLabel_Mono:                 {"Mono", "M"},
+	kCAFChannelLabel_DialogCentricMix:     {"DialogCentricMix", "DLG"},
+	kCAFChannelLabel_CenterSurroundDirect: {"CenterSurroundDirect", "Csd"},
+	kCAFChannelLabel_Haptic:               {"Haptic", "Haptic"},
+	kCAFChannelLabel_LeftTopMiddle:        {"LeftTopMiddle", "Ltm"},
+	kCAFChannelLabel_RightTopMiddle:       {"RightTopMiddle", "Rtm"},
+	kCAFChannelLabel_LeftTopRear:          {"LeftTopRear", "Ltr"},
+	kCAFChannelLabel_CenterTopRear:        {"CenterTopRear", "Ctr"},
+	kCAFChannelLabel_RightTopRear:         {"RightTopRear", "Rtr"},
+	kCAFChannelLabel_LeftSideSurround:     {"LeftSideSurround", "Lss"},
+	kCAFChannelLabel_RightSideSurround:    {"RightSideSurround", "Rss"},
+	kCAFChannelLabel_LeftBottom:           {"LeftBottom", "Lb"},
+	kCAFChannelLabel_RightBottom:          {"RightBottom", "Rb"},
+	kCAFChannelLabel_CenterBottom:         {"CenterBottom", "Cb"},
+	kCAFChannelLabel_LeftTopSurround:      {"LeftTopSurround", "Lts"},
+	kCAFChannelLabel_RightTopSurround:     {"RightTopSurround", "Rts"},
+	kCAFChannelLabel_LFE3:                 {"LFE3", "LFE3"},
+	kCAFChannelLabel_LeftBackSurround:     {"LeftBackSurround", "Lbs"},
+	kCAFChannelLabel_RightBackSurround:    {"RightBackSurround", "Rbs"},
+	kCAFChannelLabel_LeftEdgeOfScreen:     {"LeftEdgeOfScreen", "Leos"},
+	kCAFChannelLabel_RightEdgeOfScreen:    {"RightEdgeOfScreen", "Reos"},
+	kCAFChannelLabel_Ambisonic_W:          {"Ambisonic_W", "W"},
+	kCAFChannelLabel_Ambisonic_X:          {"Ambisonic_X", "X"},
+	kCAFChannelLabel_Ambisonic_Y:          {"Ambisonic_Y", "Y"},
+	kCAFChannelLabel_Ambisonic_Z:          {"Ambisonic_Z", "Z"},
+	kCAFChannelLabel_MS_Mid:               {"MS_Mid", "Mid"},
+	kCAFChannelLabel_MS_Side:              {"MS_Side", "Side"},
+	kCAFChannelLabel_XY_X:                 {"XY_X", "XY_X"},
+	kCAFChannelLabel_XY_Y:                 {"XY_Y", "XY_Y"},
+	kCAFChannelLabel_BinauralLeft:         {"BinauralLeft", "BL"},
+	kCAFChannelLabel_BinauralRight:        {"BinauralRight", "BR"},
+	kCAFChannelLabel_HeadphonesLeft:       {"HeadphonesLeft", "HL"},
+	kCAFChannelLabel_HeadphonesRight:      {"HeadphonesRight", "HR"},
+	kCAFChannelLabel_ClickTrack:           {"ClickTrack", ""},
+	kCAFChannelLabel_ForeignLanguage:      {"ForeignLanguage", ""},
+	kCAFChannelLabel_Discrete:             {"Discrete", ""},
+	kCAFChannelLabel_HOA_ACN:              {"HOA_ACN", ""},
+}
+
+// channelLayoutTags lists the name and channel order of every tag with a
+// fixed layout. Tags that are aliases of another tag share its entry.
+var channelLayoutTags = map[uint32]struct {
+	name     string
+	channels string
+}{
+	kCAFChannelLayoutTag_Mono:                {"Mono", "M"},
+	kCAFChannelLayoutTag_Stereo:              {"Stereo", "L R"},
+	kCAFChannelLayoutTag_StereoHeadphones:    {"StereoHeadphones", "HL HR"},
+	kCAFChannelLayoutTag_MatrixStereo:        {"MatrixStereo", "Lt Rt"},
+	kCAFChannelLayoutTag_MidSide:             {"MidSide", "Mid Side"},
+	kCAFChannelLayoutTag_XY:                  {"XY", "XY_X XY_Y"},
+	kCAFChannelLayoutTag_Binaural:            {"Binaural", "BL BR"},
+	kCAFChannelLayoutTag_Ambisonic_B_Format:  {"Ambisonic_B_Format", "W X Y Z"},
+	kCAFChannelLayoutTag_Quadraphonic:        {"Quadraphonic", "L R Ls Rs"},
+	kCAFChannelLayoutTag_Pentagonal:          {"Pentagonal", "L R Ls Rs C"},
+	kCAFChannelLayoutTag_Hexagonal:           {"Hexagonal", "L R Ls Rs C Cs"},
+	kCAFChannelLayoutTag_Octagonal:           {"Octagonal", "L R Ls Rs C Cs Lw Rw"},
+	kCAFChannelLayoutTag_Cube:                {"Cube", "L R Ls Rs Vhl Vhr Tbl Tbr"},
+	kCAFChannelLayoutTag_MPEG_3_0_A:          {"MPEG_3_0_A", "L R C"},
+	kCAFChannelLayoutTag_MPEG_3_0_B:          {"MPEG_3_0_B", "C L R"},
+	kCAFChannelLayoutTag_MPEG_4_0_A:          {"MPEG_4_0_A", "L R C Cs"},
+	kCAFChannelLayoutTag_MPEG_4_0_B:          {"MPEG_4_0_B", "C L R Cs"},
+	kCAFChannelLayoutTag_MPEG_5_0_A:          {"MPEG_5_0_A", "L R C Ls Rs"},
+	kCAFChannelLayoutTag_MPEG_5_0_B:          {"MPEG_5_0_B", "L R Ls Rs C"},
+	kCAFChannelLayoutTag_MPEG_5_0_C:          {"MPEG_5_0_C", "L C R Ls Rs"},
+	kCAFChannelLayoutTag_MPEG_5_0_D:          {"MPEG_5_0_D", "C L R Ls Rs"},
+	kCAFChannelLayoutTag_MPEG_5_1_A:          {"MPEG_5_1_A", "L R C LFE Ls Rs"},
+	kCAFChannelLayoutTag_MPEG_5_1_B:          {"MPEG_5_1_B", "L R Ls Rs C LFE"},
+	kCAFChannelLayoutTag_MPEG_5_1_C:          {"MPEG_5_1_C", "L C R Ls Rs LFE"},
+	kCAFChannelLayoutTag_MPEG_5_1_D:          {"MPEG_5_1_D", "C L R Ls Rs LFE"},
+	kCAFChannelLayoutTag_MPEG_6_1_A:          {"MPEG_6_1_A", "L R C LFE Ls Rs Cs"},
+	kCAFChannelLayoutTag_MPEG_7_1_A:          {"MPEG_7_1_A", "L R C LFE Ls Rs Lc Rc"},
+	kCAFChannelLayoutTag_MPEG_7_1_B:          {"MPEG_7_1_B", "C Lc Rc L R Ls Rs LFE"},
+	kCAFChannelLayoutTag_MPEG_7_1_C:          {"MPEG_7_1_C", "L R C LFE Ls Rs Rls Rrs"},
+	kCAFChannelLayoutTag_Emagic_Default_7_1:  {"Emagic_Default_7_1", "L R Ls Rs C LFE Lc Rc"},
+	kCAFChannelLayoutTag_SMPTE_DTV:           {"SMPTE_DTV", "L R C LFE Ls Rs Lt Rt"},
+	kCAFChannelLayoutTag_ITU_2_1:             {"ITU_2_1", "L R Cs"},
+	kCAFChannelLayoutTag_ITU_2_2:             {"ITU_2_2", "L R Ls Rs"},
+	kCAFChannelLayoutTag_DVD_4:               {"DVD_4", "L R LFE"},
+	kCAFChannelLayoutTag_DVD_5:               {"DVD_5", "L R LFE Cs"},
+	kCAFChannelLayoutTag_DVD_6:               {"DVD_6", "L R LFE Ls Rs"},
+	kCAFChannelLayoutTag_DVD_10:              {"DVD_10", "L R C LFE"},
+	kCAFChannelLayoutTag_DVD_11:              {"DVD_11", "L R C LFE Cs"},
+	kCAFChannelLayoutTag_DVD_18:              {"DVD_18", "L R Ls Rs LFE"},
+	kCAFChannelLayoutTag_AudioUnit_6_0:       {"AudioUnit_6_0", "L R Ls Rs C Cs"},
+	kCAFChannelLayoutTag_AudioUnit_7_0:       {"AudioUnit_7_0", "L R Ls Rs C Rls Rrs"},
+	kCAFChannelLayoutTag_AAC_6_0:             {"AAC_6_0", "C L R Ls Rs Cs"},
+	kCAFChannelLayoutTag_AAC_6_1:             {"AAC_6_1", "C L R Ls Rs Cs LFE"},
+	kCAFChannelLayoutTag_AAC_7_0:             {"AAC_7_0", "C L R Ls Rs Rls Rrs"},
+	kCAFChannelLayoutTag_AAC_Octagonal:       {"AAC_Octagonal", "C L R Ls Rs Rls Rrs Cs"},
+	kCAFChannelLayoutTag_TMH_10_2_std:        {"TMH_10_2_std", "L R C Vhc Lsd Rsd Ls Rs Vhl Vhr Lw Rw Csd Cs LFE LFE2"},
+	kCAFChannelLayoutTag_TMH_10_2_full:       {"TMH_10_2_full", "L R C Vhc Lsd Rsd Ls Rs Vhl Vhr Lw Rw Csd Cs LFE LFE2 Lc Rc HI VI Haptic"},
+	kCAFChannelLayoutTag_AudioUnit_7_0_Front: {"AudioUnit_7_0_Front", "L R Ls Rs C Lc Rc"},
+	kCAFChannelLayoutTag_AC3_1_0_1:           {"AC3_1_0_1", "C LFE"},
+	kCAFChannelLayoutTag_AC3_3_0:             {"AC3_3_0", "L C R"},
+	kCAFChannelLayoutTag_AC3_3_1:             {"AC3_3_1", "L C R Cs"},
+	kCAFChannelLayoutTag_AC3_3_0_1:           {"AC3_3_0_1", "L C R LFE"},
+	kCAFChannelLayoutTag_AC3_2_1_1:           {"AC3_2_1_1", "L R Cs LFE"},
+	kCAFChannelLayoutTag_AC3_3_1_1:           {"AC3_3_1_1", "L C R Cs LFE"},
+	kCAFChannelLayoutTag_EAC_6_0_A:           {"EAC_6_0_A", "L C R Ls Rs Cs"},
+	kCAFChannelLayoutTag_EAC_7_0_A:           {"EAC_7_0_A", "L C R Ls Rs Rls Rrs"},
+	kCAFChannelLayoutTag_EAC3_6_1_A:          {"EAC3_6_1_A", "L C R Ls Rs LFE Cs"},
+	kCAFChannelLayoutTag_EAC3_6_1_B:          {"EAC3_6_1_B", "L C R Ls Rs LFE Ts"},
+	kCAFChannelLayoutTag_EAC3_6_1_C:          {"EAC3_6_1_C", "L C R Ls Rs LFE Vhc"},
+	kCAFChannelLayoutTag_EAC3_7_1_A:          {"EAC3_7_1_A", "L C R Ls Rs LFE Rls Rrs"},
+	kCAFChannelLayoutTag_EAC3_7_1_B:          {"EAC3_7_1_B", "L C R Ls Rs LFE Lc Rc"},
+	kCAFChannelLayoutTag_EAC3_7_1_C:          {"EAC3_7_1_C", "L C R Ls Rs LFE Lsd Rsd"},
+	kCAFChannelLayoutTag_EAC3_7_1_D:          {"EAC3_7_1_D", "L C R Ls Rs LFE Lw Rw"},
+	kCAFChannelLayoutTag_EAC3_7_1_E:          {"EAC3_7_1_E", "L C R Ls Rs LFE Vhl Vhr"},
+	kCAFChannelLayoutTag_EAC3_7_1_F:          {"EAC3_7_1_F", "L C R Ls Rs LFE Cs Ts"},
+	kCAFChannelLayoutTag_EAC3_7_1_G:          {"EAC3_7_1_G", "L C R Ls Rs LFE Cs Vhc"},
+	kCAFChannelLayoutTag_EAC3_7_1_H:          {"EAC3_7_1_H", "L C R Ls Rs LFE Ts Vhc"},
+	kCAFChannelLayoutTag_DTS_3_1:             {"DTS_3_1", "C L R LFE"},
+	kCAFChannelLayoutTag_DTS_4_1:             {"DTS_4_1", "C L R Cs LFE"},
+	kCAFChannelLayoutTag_DTS_6_0_A:           {"DTS_6_0_A", "Lc Rc L R Ls Rs"},
+	kCAFChannelLayoutTag_DTS_6_0_B:           {"DTS_6_0_B", "C L R Rls Rrs Ts"},
+	kCAFChannelLayoutTag_DTS_6_0_C:           {"DTS_6_0_C", "C Cs L R Rls Rrs"},
+	kCAFChannelLayoutTag_DTS_6_1_A:           {"DTS_6_1_A", "Lc Rc L R Ls Rs LFE"},
+	kCAFChannelLayoutTag_DTS_6_1_B:           {"DTS_6_1_B", "C L R Rls Rrs Ts LFE"},
+	kCAFChannelLayoutTag_DTS_6_1_C:           {"DTS_6_1_C", "C Cs L R Rls Rrs LFE"},
+	kCAFChannelLayoutTag_DTS_7_0:             {"DTS_7_0", "Lc C Rc L R Ls Rs"},
+	kCAFChannelLayoutTag_DTS_7_1:             {"DTS_7_1", "Lc C Rc L R Ls Rs LFE"},
+	kCAFChannelLayoutTag_DTS_8_0_A:           {"DTS_8_0_A", "Lc Rc L R Ls Rs Rls Rrs"},
+	kCAFChannelLayoutTag_DTS_8_0_B:           {"DTS_8_0_B", "Lc C Rc L R Ls Cs Rs"},
+	kCAFChannelLayoutTag_DTS_8_1_A:           {"DTS_8_1_A", "Lc Rc L R Ls Rs Rls Rrs LFE"},
+	kCAFChannelLayoutTag_DTS_8_1_B:           {"DTS_8_1_B", "Lc C Rc L R Ls Cs Rs LFE"},
+	kCAFChannelLayoutTag_DTS_6_1_D:           {"DTS_6_1_D", "C L R Ls Rs LFE Cs"},
+	kCAFChannelLayoutTag_AAC_7_1_B:           {"AAC_7_1_B", "C L R Ls Rs Rls Rrs LFE"},
+	kCAFChannelLayoutTag_AAC_7_1_C:           {"AAC_7_1_C", "C L R Ls Rs LFE Vhl Vhr"},
+	kCAFChannelLayoutTag_WAVE_4_0_B:          {"WAVE_4_0_B", "L R Rls Rrs"},
+	kCAFChannelLayoutTag_WAVE_5_0_B:          {"WAVE_5_0_B", "L R C Rls Rrs"},
+	kCAFChannelLayoutTag_WAVE_5_1_B:          {"WAVE_5_1_B", "L R C LFE Rls Rrs"},
+	kCAFChannelLayoutTag_WAVE_6_1:            {"WAVE_6_1", "L R C LFE Cs Ls Rs"},
+	kCAFChannelLayoutTag_WAVE_7_1:            {"WAVE_7_1", "L R C LFE Rls Rrs Ls Rs"},
+	kCAFChannelLayoutTag_Atmos_7_1_4:         {"Atmos_7_1_4", "L R C LFE Ls Rs Rls Rrs Vhl Vhr Ltr Rtr"},
+	kCAFChannelLayoutTag_Atmos_9_1_6:         {"Atmos_9_1_6", "L R C LFE Ls Rs Rls Rrs Lw Rw Vhl Vhr Ltm Rtm Ltr Rtr"},
+	kCAFChannelLayoutTag_Atmos_5_1_2:         {"Atmos_5_1_2", "L R C LFE Ls Rs Ltm Rtm"},
+	kCAFChannelLayoutTag_Atmos_5_1_4:         {"Atmos_5_1_4", "L R C LFE Ls Rs Vhl Vhr Ltr Rtr"},
+	kCAFChannelLayoutTag_Atmos_7_1_2:         {"Atmos_7_1_2", "L R C LFE Ls Rs Rls Rrs Ltm Rtm"},
+	kCAFChannelLayoutTag_Logic_4_0_C:         {"Logic_4_0_C", "L R Cs C"},
+	kCAFChannelLayoutTag_Logic_6_0_B:         {"Logic_6_0_B", "L R Ls Rs Cs C"},
+	kCAFChannelLayoutTag_Logic_6_1_B:         {"Logic_6_1_B", "L R Ls Rs Cs C LFE"},
+	kCAFChannelLayoutTag_Logic_6_1_D:         {"Logic_6_1_D", "L C R Ls Cs Rs LFE"},
+	kCAFChannelLayoutTag_Logic_7_1_B:         {"Logic_7_1_B", "L R Ls Rs Rls Rrs C LFE"},
+	kCAFChannelLayoutTag_Logic_Atmos_7_1_4_B: {"Logic_Atmos_7_1_4_B", "L R Rls Rrs Ls Rs C LFE Vhl Vhr Ltr Rtr"},
+	kCAFChannelLayoutTag_Logic_Atmos_7_1_6:   {"Logic_Atmos_7_1_6", "L R Rls Rrs Ls Rs C LFE Vhl Vhr Ltm Rtm Ltr Rtr"},
+	kCAFChannelLayoutTag_CICP_13:             {"CICP_13", "Lc Rc C LFE2 Rls Rrs L R Cs LFE3 Lss Rss Vhl Vhr Vhc Ts Ltr Rtr Ltm Rtm Ctr Cb Lb Rb"},
+	kCAFChannelLayoutTag_CICP_14:             {"CICP_14", "L R C LFE Ls Rs Vhl Vhr"},
+	kCAFChannelLayoutTag_CICP_15:             {"CICP_15", "L R C LFE2 Rls Rrs LFE3 Lss Rss Vhl Vhr Ctr"},
+	kCAFChannelLayoutTag_CICP_16:             {"CICP_16", "L R C LFE Ls Rs Vhl Vhr Lts Rts"},
+	kCAFChannelLayoutTag_CICP_17:             {"CICP_17", "L R C LFE Ls Rs Vhl Vhr Vhc Lts Rts Ts"},
+	kCAFChannelLayoutTag_CICP_18:             {"CICP_18", "L R C LFE Ls Rs Lbs Rbs Vhl Vhr Vhc Lts Rts Ts"},
+	kCAFChannelLayoutTag_CICP_19:             {"CICP_19", "L R C LFE Rls Rrs Lss Rss Vhl Vhr Ltr Rtr"},
+	kCAFChannelLayoutTag_CICP_20:             {"CICP_20", "L R C LFE Rls Rrs Lss Rss Vhl Vhr Ltr Rtr Leos Reos"},
+	kCAFChannelLayoutTag_Ogg_5_0:             {"Ogg_5_0", "L C R Ls Rs"},
+	kCAFChannelLayoutTag_Ogg_5_1:             {"Ogg_5_1", "L C R Ls Rs LFE"},
+	kCAFChannelLayoutTag_Ogg_6_1:             {"Ogg_6_1", "L C R Ls Rs Cs LFE"},
+	kCAFChannelLayoutTag_Ogg_7_1:             {"Ogg_7_1", "L C R Ls Rs Rls Rrs LFE"},
+	kCAFChannelLayoutTag_MPEG_5_0_E:          {"MPEG_5_0_E", "L R Rls Rrs C"},
+	kCAFChannelLayoutTag_MPEG_5_1_E:          {"MPEG_5_1_E", "L R Rls Rrs C LFE"},
+	kCAFChannelLayoutTag_MPEG_6_1_B:          {"MPEG_6_1_B", "L R Ls Rs C Cs LFE"},
+	kCAFChannelLayoutTag_MPEG_7_1_D:          {"MPEG_7_1_D", "L R Rls Rrs Ls Rs C LFE"},
+}
+
+// channelLabelsByShortName finds a channel label from the short name used
+// in channelLayoutTags
+var channelLabelsByShortName = func() map[string]uint32 {
+	labels := map[string]uint32{}
+	for label, names := range channelLabelNames {
+		if names[1] != "" {
+			labels[names[1]] = label
+		}
+	}
+	return labels
+}()
+
+// channelLayoutTagLabels holds the channel labels of every fixed layout tag,
+// and layoutTagsByLabels the tags for each channel order, lowest tag first.
+// A table entry that does not parse is left out, the tests check for them.
+var channelLayoutTagLabels, layoutTagsByLabels = func() (map[uint32][]uint32, map[string][]uint32) {
+	tagLabels := map[uint32][]uint32{}
+	tagsByLabels := map[string][]uint32{}
+	for tag := range channelLayoutTags {
+		labels, err := parseChannelLayoutTag(tag)
+		if err != nil {
+			continue
+		}
+		tagLabels[tag] = labels
+		key := fmt.Sprint(labels)
+		tagsByLabels[key] = append(tagsByLabels[key], tag)
+	}
+	for _, tags := range tagsByLabels {
+		sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+	}
+	return tagLabels, tagsByLabels
+}()
+
+// parseChannelLayoutTag returns the channel labels of a fixed layout tag
+// from its channel order in channelLayoutTags
+func parseChannelLayoutTag(tag uint32) ([]uint32, error) {
+	layout := channelLayoutTags[tag]
+	var labels []uint32
+	for _, name := range strings.Fields(layout.channels) {
+		label, ok := channelLabelsByShortName[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown channel %s in layout %s", name, layout.name)
+		}
+		labels = append(labels, label)
+	}
+	if len(labels) != int(tag&0xFFFF) {
+		return nil, fmt.Errorf("layout %s lists %d channels, its tag says %d", layout.name, len(labels), tag&0xFFFF)
+	}
+	return labels, nil
+}
+
+// ChannelLayoutTagName returns the Core Audio name of a layout tag, such as
+// "MPEG_5_1_A". Tags with a variable channel count get the count appended.
+func ChannelLayoutTagName(tag uint32) string {
+	if layout, ok := channelLayoutTags[tag]; ok {
+		return layout.name
+	}
+	switch tag &^ 0xFFFF {
+	case kCAFChannelLayoutTag_UseChannelDescriptions:
+		return "UseChannelDescriptions"
+	case kCAFChannelLayoutTag_UseChannelBitmap:
+		return "UseChannelBitmap"
+	case kCAFChannelLayoutTag_DiscreteInOrder:
+		return fmt.Sprintf("DiscreteInOrder(%d)", tag&0xFFFF)
+	case kCAFChannelLayoutTag_HOA_ACN_SN3D:
+		return fmt.Sprintf("HOA_ACN_SN3D(%d)", tag&0xFFFF)
+	case kCAFChannelLayoutTag_HOA_ACN_N3D:
+		return fmt.Sprintf("HOA_ACN_N3D(%d)", tag&0xFFFF)
+	case kCAFChannelLayoutTag_Unknown:
+		return fmt.Sprintf("Unknown(%d)", tag&0xFFFF)
+	}
+	return fmt.Sprintf("0x%08x", tag)
+}
+
+// ChannelLabelName returns the Core Audio name of a channel label, such as
+// "LeftSurround". Numbered labels get their number appended.
+func ChannelLabelName(label uint32) string {
+	if names, ok := channelLabelNames[label]; ok {
+		return names[0]
+	}
+	switch label &^ 0xFFFF {
+	case kCAFChannelLabel_Discrete_0:
+		return fmt.Sprintf("Discrete_%d", label&0xFFFF)
+	case kCAFChannelLabel_HOA_ACN_0:
+		return fmt.Sprintf("HOA_ACN_%d", label&0xFFFF)
+	case kCAFChannelLabel_HOA_N3D_0:
+		return fmt.Sprintf("HOA_N3D_%d", label&0xFFFF)
+	}
+	return fmt.Sprintf("0x%08x", label)
+}
@@ -24,7 +24,9 @@ type UnknownContents struct {
 
 type Midi = []byte
 
-func (c *CAFChunk) decode(r *bufio.Reader) error {
+// decode reads a chunk. The packet table is read the way the audio
+// description desc calls for, which is needed for pakt chunks only.
+func (c *CAFChunk) decode(r *bufio.Reader, desc *CAFAudioFormat) error {
 	if err := binary.Read(r, binary.BigEndian, &c.Header); err != nil {
 		return err
 	}
@@ -55,7 +57,7 @@ func (c *CAFChunk) decode(r *bufio.Reader) error {
 		c.Contents = &cc
 	case ChunkPacketTable:
 		var cc CAFPacketTable
-		if err := cc.decode(r); err != nil {
+		if err := cc.decode(r, c.Header, desc); err != nil {
 			return err
 		}
 		c.Contents = &cc
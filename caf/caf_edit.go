@@ -0,0 +1,255 @@
+package caf
+
+import (
+	"errors"
+	"io"
+)
+
+var (
+	errEditOutOfRange = errors.New("edit range is outside the audio")
+	errEditRemovesAll = errors.New("edit would remove all of the audio")
+	errEditPaddedEnd  = errors.New("silence cannot follow audio held by a single padded packet")
+)
+
+// opusSilenceFrame is the payload of a CELT frame with the silence flag
+// set, which decodes to digital silence at any frame size
+var opusSilenceFrame = []byte{0xff, 0xfe}
+
+// opusSilenceFrameSizes are the CELT-only fullband frame sizes, longest first
+var opusSilenceFrameSizes = []uint32{960, 480, 240, 120}
+
+// DeleteRange removes the samples from start to end, counted after the
+// priming frames, without decoding. Within the audio only the packets that
+// lie entirely inside the range can go, so up to a packet at either side
+// stays. A range that reaches the start or the end of the audio is cut
+// exactly through the priming or remainder frames, keeping the Opus
+// pre-roll ahead of the new start. It returns the range that was removed,
+// which is empty, starting at start, when no packet fit inside.
+func (cf *CAFFileData) DeleteRange(start int64, end int64) (int64, int64, error) {
+	packets, pakt, err := cf.editPackets()
+	if err != nil {
+		return 0, 0, err
+	}
+	valid := pakt.Header.NumberValidFrames
+	if start < 0 || end > valid || start >= end {
+		return 0, 0, errEditOutOfRange
+	}
+	if start == 0 && end == valid {
+		return 0, 0, errEditRemovesAll
+	}
+
+	preRoll := int64(0)
+	if cf.findChunk(ChunkeAudioDescription).Contents.(*CAFAudioFormat).FormatID == NewFourByteStr("opus") {
+		preRoll = opusPreRoll
+	}
+
+	header := pakt.Header
+	kept := make([]*CAFPacket, 0, len(packets))
+	removed := int64(0)
+	removedStart := int64(-1)
+	for _, packet := range packets {
+		packetEnd := packet.StartFrame + int64(packet.Frames)
+		switch {
+		case start == 0 && packetEnd <= end-preRoll:
+		case end == valid && packet.StartFrame >= start:
+		case start > 0 && end < valid && packet.StartFrame >= start && packetEnd <= end:
+		default:
+			kept = append(kept, packet)
+			continue
+		}
+		if removedStart < 0 {
+			removedStart = packet.StartFrame
+		}
+		removed += int64(packet.Frames)
+	}
+
+	switch {
+	case start == 0:
+		header.PrimingFrames = int32(end - kept[0].StartFrame)
+		header.NumberValidFrames = valid - end
+	case end == valid:
+		last := kept[len(kept)-1]
+		header.RemainderFrames = int32(last.StartFrame + int64(last.Frames) - start)
+		header.NumberValidFrames = start
+	default:
+		header.NumberValidFrames = valid - removed
+		if removed == 0 {
+			removedStart = start
+		}
+		start, end = removedStart, removedStart+removed
+	}
+	return start, end, cf.replaceAudio(kept, header)
+}
+
+// InsertSilence inserts duration samples of Opus silence at the first packet
+// boundary at or after at, counted after the priming frames, and returns
+// where the silence starts. The silence is made of CELT silence packets and
+// rounded up to whole 2.5 ms packets, except at the end of the audio, where
+// the remainder frames cut it to length. When the last packet is padded the
+// silence goes in ahead of it instead, rounded up, so that the padding stays
+// trimmed.
+func (cf *CAFFileData) InsertSilence(at int64, duration int64) (int64, error) {
+	packets, pakt, err := cf.editPackets()
+	if err != nil {
+		return 0, err
+	}
+	if at < 0 || at > pakt.Header.NumberValidFrames || duration <= 0 {
+		return 0, errEditOutOfRange
+	}
+	descChunk := cf.findChunk(ChunkeAudioDescription)
+	if descChunk.Contents.(*CAFAudioFormat).FormatID != NewFourByteStr("opus") {
+		return 0, errNotOpusCaf
+	}
+	silence, err := cf.opusSilence(duration)
+	if err != nil {
+		return 0, err
+	}
+
+	index := len(packets)
+	for i, packet := range packets {
+		if packet.StartFrame >= at {
+			index = i
+			break
+		}
+	}
+
+	header := pakt.Header
+	if index == len(packets) && header.RemainderFrames > 0 {
+		// Silence after the padded packet would make its padding play
+		index--
+		if packets[index].StartFrame < 0 {
+			return 0, errEditPaddedEnd
+		}
+	}
+
+	silenceFrames := int64(0)
+	for _, packet := range silence {
+		silenceFrames += int64(packet.Frames)
+	}
+	position := header.NumberValidFrames
+	if index < len(packets) {
+		position = packets[index].StartFrame
+		header.NumberValidFrames += silenceFrames
+	} else {
+		header.NumberValidFrames = position + duration
+		header.RemainderFrames = int32(silenceFrames - duration)
+	}
+
+	edited := make([]*CAFPacket, 0, len(packets)+len(silence))
+	edited = append(edited, packets[:index]...)
+	edited = append(edited, silence...)
+	edited = append(edited, packets[index:]...)
+	return position, cf.replaceAudio(edited, header)
+}
+
+// editPackets returns the audio packets and packet table of the CAF
+func (cf *CAFFileData) editPackets() ([]*CAFPacket, *CAFPacketTable, error) {
+	paktChunk := cf.findChunk(ChunkPacketTable)
+	if paktChunk == nil {
+		return nil, nil, errMissingPacketTable
+	}
+	iterator, err := cf.Packets()
+	if err != nil {
+		return nil, nil, err
+	}
+	var packets []*CAFPacket
+	for {
+		packet, err := iterator.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		packets = append(packets, packet)
+	}
+	return packets, paktChunk.Contents.(*CAFPacketTable), nil
+}
+
+// opusSilence returns silence packets for at least duration samples. Each
+// stream of multistream Opus gets a silence frame, all but the last one in
+// self-delimiting framing.
+func (cf *CAFFileData) opusSilence(duration int64) ([]*CAFPacket, error) {
+	desc := cf.findChunk(ChunkeAudioDescription).Contents.(*CAFAudioFormat)
+	header := &OggHeader{Channels: uint8(desc.ChannelsPerPacket), StreamCount: 1}
+	if desc.ChannelsPerPacket == 2 {
+		header.CoupledCount = 1
+	}
+	if kukiChunk := cf.findChunk(ChunkMagicCookie); kukiChunk != nil {
+		var err error
+		if header, err = parseOpusHead(kukiChunk.Contents.(*UnknownContents).Data); err != nil {
+			return nil, err
+		}
+	}
+
+	var silence []*CAFPacket
+	for _, frameSize := range opusSilenceFrameSizes {
+		for duration >= int64(frameSize) || (frameSize == 120 && duration > 0) {
+			// CELT-only fullband configurations 28 to 31 hold 2.5 to 20 ms
+			config := byte(31)
+			for size := uint32(960); size > frameSize; size >>= 1 {
+				config--
+			}
+			var data []byte
+			for stream := 0; stream < int(header.StreamCount); stream++ {
+				toc := config << 3
+				if stream < int(header.CoupledCount) {
+					toc |= 0x04
+				}
+				data = append(data, toc)
+				if stream < int(header.StreamCount)-1 {
+					data = append(data, byte(len(opusSilenceFrame)))
+				}
+				data = append(data, opusSilenceFrame...)
+			}
+			silence = append(silence, &CAFPacket{Data: data, Frames: frameSize})
+			duration -= int64(frameSize)
+		}
+	}
+	return silence, nil
+}
+
+// replaceAudio rebuilds the data and pakt chunks from packets and counts the
+// edit. The frames per packet of the desc chunk is updated for the packets.
+func (cf *CAFFileData) replaceAudio(packets []*CAFPacket, header CAFPacketTableHeader) error {
+	descChunk := cf.findChunk(ChunkeAudioDescription)
+	paktChunk := cf.findChunk(ChunkPacketTable)
+	dataChunk := cf.findChunk(ChunkAudioData)
+	if descChunk == nil {
+		return errMissingDescChunk
+	}
+	if dataChunk == nil {
+		return errMissingDataChunk
+	}
+
+	var data []byte
+	sizes := make([]uint64, 0, len(packets))
+	frames := make([]uint64, 0, len(packets))
+	for _, packet := range packets {
+		data = append(data, packet.Data...)
+		sizes = append(sizes, uint64(len(packet.Data)))
+		frames = append(frames, uint64(packet.Frames))
+	}
+
+	desc := descChunk.Contents.(*CAFAudioFormat)
+	pakt := paktChunk.Contents.(*CAFPacketTable)
+	if variableFrameCounts(frames) {
+		desc.FramesPerPacket = 0
+		pakt.Frames = frames
+	} else {
+		desc.FramesPerPacket = uint32(frames[0])
+		pakt.Frames = nil
+	}
+	header.NumberPackets = int64(len(packets))
+	pakt.Header = header
+	pakt.Entry = sizes
+	paktChunk.Header.ChunkSize = int64(calculatePacketTableLength(sizes, pakt.Frames))
+
+	audio := dataChunk.Contents.(*DataX)
+	audio.Bytes = data
+	audio.EditCount++
+	if dataChunk.Header.ChunkSize != -1 {
+		dataChunk.Header.ChunkSize = int64(len(data)) + dataEditCountSize
+	}
+	return nil
+}
@@ -17,13 +17,18 @@ func (cf *CAFFileData) Decode(r io.Reader) error {
 		return err
 	}
 	cf.CAFFileHeader = fileHeader
+	// The desc chunk comes first, the packet table is read as it calls for
+	var desc *CAFAudioFormat
 	for {
 		var c CAFChunk
-		if err := c.decode(bufferedReader); err == io.EOF {
+		if err := c.decode(bufferedReader, desc); err == io.EOF {
 			break
 		} else if err != nil {
 			return err
 		}
+		if c.Header.ChunkType == ChunkeAudioDescription {
+			desc = c.Contents.(*CAFAudioFormat)
+		}
 		cf.Chunks = append(cf.Chunks, c)
 	}
 	return nil
@@ -40,3 +45,13 @@ func (cf *CAFFileData) Encode(w io.Writer) error {
 	}
 	return nil
 }
+
+// findChunk returns the first chunk of the given type, or nil if the file has none
+func (cf *CAFFileData) findChunk(chunkType FourByteString) *CAFChunk {
+	for i := range cf.Chunks {
+		if cf.Chunks[i].Header.ChunkType == chunkType {
+			return &cf.Chunks[i]
+		}
+	}
+	return nil
+}
@@ -2,13 +2,25 @@ package caf
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/binary"
+	"errors"
 	"io"
 )
 
+// cafPacketTableHeaderSize is the size of the header ahead of the entries
+const cafPacketTableHeaderSize = 24
+
+var errBadPacketTableSize = errors.New("packet table chunk is smaller than its header")
+
 type CAFPacketTable struct {
 	Header CAFPacketTableHeader
-	Entry  []uint64
+	// Entry holds the size of every packet when the format has a variable
+	// packet size, and is nil otherwise
+	Entry []uint64
+	// Frames holds the frame count of every packet when the format has a
+	// variable number of frames per packet, and is nil otherwise
+	Frames []uint64
 }
 
 type CAFPacketTableHeader struct {
@@ -18,16 +30,63 @@ type CAFPacketTableHeader struct {
 	RemainderFrames   int32
 }
 
-func (c *CAFPacketTable) decode(r *bufio.Reader) error {
+// decode reads a packet table, whose form follows from the audio description
+// as the CAF specification sets it: every packet has a size when the format
+// has no BytesPerPacket and a frame count when it has no FramesPerPacket, in
+// that order. Formats with a constant size and duration only store their
+// priming and remainder frames. ffmpeg leaves the frame counts out of Opus
+// tables whose desc has no FramesPerPacket, Frames is then nil and the
+// durations are read from the packets.
+func (c *CAFPacketTable) decode(r *bufio.Reader, h CAFChunkHeader, desc *CAFAudioFormat) error {
+	if h.ChunkSize < cafPacketTableHeaderSize {
+		return errBadPacketTableSize
+	}
+	if desc == nil {
+		return errMissingDescChunk
+	}
 	if err := binary.Read(r, binary.BigEndian, &c.Header); err != nil {
 		return err
 	}
-	for i := 0; i < int(c.Header.NumberPackets); i++ {
-		if val, err := decodeInt(r); err != nil {
+	// The entries are read as they come rather than allocated up front, a
+	// damaged chunk size cannot claim more memory than the input holds
+	entriesSize := h.ChunkSize - cafPacketTableHeaderSize
+	entries, err := io.ReadAll(io.LimitReader(r, entriesSize))
+	if err != nil {
+		return err
+	}
+	if int64(len(entries)) < entriesSize {
+		return io.ErrUnexpectedEOF
+	}
+
+	var values []uint64
+	entryReader := bytes.NewReader(entries)
+	for entryReader.Len() > 0 {
+		val, err := decodeInt(entryReader)
+		if err != nil {
 			return err
-		} else {
-			c.Entry = append(c.Entry, val)
 		}
+		values = append(values, val)
+	}
+
+	variableSize := desc.BytesPerPacket == 0
+	variableFrames := desc.FramesPerPacket == 0
+	numberPackets := int64(0)
+	if c.Header.NumberPackets > 0 {
+		numberPackets = c.Header.NumberPackets
+	}
+	switch {
+	case !variableSize && !variableFrames:
+	case variableSize && variableFrames && int64(len(values)) >= 2*numberPackets:
+		for i := int64(0); i < numberPackets; i++ {
+			c.Entry = append(c.Entry, values[2*i])
+			c.Frames = append(c.Frames, values[2*i+1])
+		}
+	case int64(len(values)) >= numberPackets && variableSize:
+		c.Entry = values[:numberPackets]
+	case int64(len(values)) >= numberPackets:
+		c.Frames = values[:numberPackets]
+	default:
+		return io.ErrUnexpectedEOF
 	}
 	return nil
 }
@@ -36,9 +95,21 @@ func (c *CAFPacketTable) encode(w io.Writer) error {
 	if err := binary.Write(w, binary.BigEndian, c.Header); err != nil {
 		return err
 	}
-	for i := 0; i < int(c.Header.NumberPackets); i++ {
-		if err := encodeInt(w, c.Entry[i]); err != nil {
-			return err
+	// A constant size format may list frame counts only
+	packets := len(c.Entry)
+	if packets == 0 {
+		packets = len(c.Frames)
+	}
+	for i := 0; i < packets; i++ {
+		if c.Entry != nil {
+			if err := encodeInt(w, c.Entry[i]); err != nil {
+				return err
+			}
+		}
+		if c.Frames != nil {
+			if err := encodeInt(w, c.Frames[i]); err != nil {
+				return err
+			}
 		}
 	}
 	return nil
@@ -0,0 +1,214 @@
+package caf
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+)
+
+var (
+	errMissingFramesPerPacket = errors.New("caf gives no frame count for its packets")
+	errBadPacketTableFrames   = errors.New("packet table has a frame count for some packets only")
+)
+
+// CAFPacket is an audio packet of a CAF
+type CAFPacket struct {
+	Data []byte
+	// Index is the position of the packet in the file
+	Index int
+	// Offset is where the packet starts in the audio data
+	Offset int64
+	Frames uint32
+	// StartFrame is the time of the first sample of the packet, counted from
+	// the first sample after the priming frames. Packets holding priming
+	// frames start before 0.
+	StartFrame int64
+}
+
+// CAFPacketIterator walks the audio packets of a CAF in order
+type CAFPacketIterator struct {
+	desc    *CAFAudioFormat
+	pakt    *CAFPacketTable
+	section *io.SectionReader
+	audio   *bufio.Reader
+	size    int64
+	count   int
+	index   int
+	offset  int64
+	frame   int64
+}
+
+// NewCAFPacketIterator returns an iterator over the size bytes of audio
+// data in audio. The packet table may be nil for formats with a constant
+// packet size, it is required when desc.BytesPerPacket is 0.
+func NewCAFPacketIterator(desc *CAFAudioFormat, pakt *CAFPacketTable, audio io.ReaderAt, size int64) (*CAFPacketIterator, error) {
+	section := io.NewSectionReader(audio, 0, size)
+	it := &CAFPacketIterator{
+		desc:    desc,
+		pakt:    pakt,
+		section: section,
+		audio:   bufio.NewReaderSize(section, 32*1024),
+		size:    size,
+	}
+
+	// A constant size format may still have a packet table for its priming
+	// and remainder frames
+	if pakt != nil {
+		it.frame = -int64(pakt.Header.PrimingFrames)
+	}
+	switch {
+	case desc.BytesPerPacket > 0:
+		it.count = int(size / int64(desc.BytesPerPacket))
+		if desc.FramesPerPacket == 0 && pakt != nil && pakt.Frames != nil && len(pakt.Frames) < it.count {
+			return nil, errBadPacketTableFrames
+		}
+	case pakt != nil:
+		it.count = len(pakt.Entry)
+		if pakt.Frames != nil && len(pakt.Frames) != len(pakt.Entry) {
+			return nil, errBadPacketTableFrames
+		}
+	default:
+		return nil, errMissingPacketTable
+	}
+	return it, nil
+}
+
+// Packets returns an iterator over the audio packets of the CAF
+func (c *CAFReader) Packets() (*CAFPacketIterator, error) {
+	desc, err := c.AudioDescription()
+	if err == errChunkNotFound {
+		return nil, errMissingDescChunk
+	}
+	if err != nil {
+		return nil, err
+	}
+	pakt, err := c.PacketTable()
+	if err == errChunkNotFound {
+		pakt = nil
+	} else if err != nil {
+		return nil, err
+	}
+	audio, err := c.AudioData()
+	if err == errChunkNotFound {
+		return nil, errMissingDataChunk
+	}
+	if err != nil {
+		return nil, err
+	}
+	return NewCAFPacketIterator(desc, pakt, audio, audio.Size())
+}
+
+// Packets returns an iterator over the audio packets of a decoded CAF
+func (cf *CAFFileData) Packets() (*CAFPacketIterator, error) {
+	descChunk := cf.findChunk(ChunkeAudioDescription)
+	if descChunk == nil {
+		return nil, errMissingDescChunk
+	}
+	dataChunk := cf.findChunk(ChunkAudioData)
+	if dataChunk == nil {
+		return nil, errMissingDataChunk
+	}
+	var pakt *CAFPacketTable
+	if paktChunk := cf.findChunk(ChunkPacketTable); paktChunk != nil {
+		pakt = paktChunk.Contents.(*CAFPacketTable)
+	}
+	data := dataChunk.Contents.(*DataX).Bytes
+	return NewCAFPacketIterator(descChunk.Contents.(*CAFAudioFormat), pakt, bytes.NewReader(data), int64(len(data)))
+}
+
+// Next returns the next packet, or io.EOF after the last one
+func (it *CAFPacketIterator) Next() (*CAFPacket, error) {
+	if it.index >= it.count {
+		return nil, io.EOF
+	}
+
+	size := int64(it.desc.BytesPerPacket)
+	variableSize := size == 0
+	if variableSize {
+		size = int64(it.pakt.Entry[it.index])
+	}
+	if size > it.size-it.offset {
+		return nil, errPacketTableOverflow
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(it.audio, data); err != nil {
+		return nil, err
+	}
+
+	frames := it.desc.FramesPerPacket
+	if frames == 0 && it.pakt != nil && it.pakt.Frames != nil {
+		frames = uint32(it.pakt.Frames[it.index])
+	} else if frames == 0 {
+		if it.desc.FormatID != NewFourByteStr("opus") {
+			return nil, errMissingFramesPerPacket
+		}
+		duration, err := PacketDuration(data)
+		if err != nil {
+			return nil, err
+		}
+		frames = duration
+	}
+
+	packet := &CAFPacket{Data: data, Index: it.index, Offset: it.offset, Frames: frames, StartFrame: it.frame}
+	it.index++
+	it.offset += size
+	it.frame += int64(frames)
+	return packet, nil
+}
+
+// seekTo moves the iterator to the packet of a seek point
+func (it *CAFPacketIterator) seekTo(point CAFSeekPoint) {
+	it.index = point.PacketIndex
+	it.offset = point.DataOffset
+	it.frame = point.StartFrame
+	it.section.Seek(point.DataOffset, io.SeekStart)
+	it.audio.Reset(it.section)
+}
+
+// opusAudio returns the OpusHead of an Opus CAF and its packets as an
+// audioSource, with the packet table header of the file
+func (c *CAFReader) opusAudio() (*OggHeader, audioSource, error) {
+	desc, err := c.AudioDescription()
+	if err == errChunkNotFound {
+		return nil, nil, errMissingDescChunk
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if desc.FormatID != NewFourByteStr("opus") {
+		return nil, nil, errNotOpusCaf
+	}
+	pakt, err := c.PacketTable()
+	if err == errChunkNotFound {
+		return nil, nil, errMissingPacketTable
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	header, err := c.opusHeader(desc, pakt)
+	if err != nil {
+		return nil, nil, err
+	}
+	packets, err := c.Packets()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	source := func(handle func(packet []byte, frames uint32) error) (cafAudio, error) {
+		audio := cafAudio{packetTable: pakt.Header}
+		for {
+			packet, err := packets.Next()
+			if err == io.EOF {
+				return audio, nil
+			}
+			if err != nil {
+				return audio, err
+			}
+			if err := handle(packet.Data, packet.Frames); err != nil {
+				return audio, err
+			}
+		}
+	}
+	return header, source, nil
+}
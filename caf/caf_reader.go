@@ -0,0 +1,200 @@
+package caf
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const (
+	cafFileHeaderSize  = 8
+	cafChunkHeaderSize = 12
+	dataEditCountSize  = 4
+)
+
+var (
+	errChunkNotFound     = errors.New("caf has no chunk of this type")
+	errChunkSizeTooLarge = errors.New("chunk runs past the end of the caf")
+	errUnsizedChunk      = errors.New("only the last chunk may have an unknown size")
+)
+
+// CAFChunkInfo locates a chunk in a CAF
+type CAFChunkInfo struct {
+	Header CAFChunkHeader
+	// Offset is where the chunk contents start, right after the chunk header
+	Offset int64
+	// Size is the size of the contents, which is also known for a data
+	// chunk whose header size is -1
+	Size int64
+}
+
+// CAFReader reads a CAF through an io.ReaderAt. Opening it only reads the
+// chunk headers, chunk contents are decoded when asked for and the audio
+// data is never loaded as a whole.
+type CAFReader struct {
+	r      io.ReaderAt
+	size   int64
+	header CAFFileHeader
+	chunks []CAFChunkInfo
+
+	seekIndex *CAFSeekIndex
+}
+
+// NewCAFReader indexes the chunks of the size bytes CAF in r
+func NewCAFReader(r io.ReaderAt, size int64) (*CAFReader, error) {
+	c := &CAFReader{r: r, size: size}
+	if err := c.header.Decode(io.NewSectionReader(r, 0, cafFileHeaderSize)); err != nil {
+		return nil, err
+	}
+
+	offset := int64(cafFileHeaderSize)
+	for offset < size {
+		var header CAFChunkHeader
+		if err := binary.Read(io.NewSectionReader(r, offset, cafChunkHeaderSize), binary.BigEndian, &header); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		info := CAFChunkInfo{Header: header, Offset: offset + cafChunkHeaderSize, Size: header.ChunkSize}
+		if header.ChunkSize == -1 {
+			if header.ChunkType != ChunkAudioData {
+				return nil, errUnsizedChunk
+			}
+			info.Size = size - info.Offset
+		}
+		if info.Size < 0 || info.Size > size-info.Offset {
+			return nil, errChunkSizeTooLarge
+		}
+		c.chunks = append(c.chunks, info)
+		offset = info.Offset + info.Size
+	}
+	return c, nil
+}
+
+// FileHeader returns the CAF file header
+func (c *CAFReader) FileHeader() CAFFileHeader {
+	return c.header
+}
+
+// Chunks returns the location of every chunk, in file order
+func (c *CAFReader) Chunks() []CAFChunkInfo {
+	return c.chunks
+}
+
+// FindChunk returns the first chunk of the given type
+func (c *CAFReader) FindChunk(chunkType FourByteString) (CAFChunkInfo, bool) {
+	for _, info := range c.chunks {
+		if info.Header.ChunkType == chunkType {
+			return info, true
+		}
+	}
+	return CAFChunkInfo{}, false
+}
+
+// Section returns a reader for the contents of a chunk
+func (c *CAFReader) Section(info CAFChunkInfo) *io.SectionReader {
+	return io.NewSectionReader(c.r, info.Offset, info.Size)
+}
+
+// ReadChunk decodes a chunk the same way CAFFileData.Decode does. Reading a
+// data chunk this way loads the whole audio data, use AudioData instead.
+func (c *CAFReader) ReadChunk(info CAFChunkInfo) (*CAFChunk, error) {
+	var desc *CAFAudioFormat
+	if info.Header.ChunkType == ChunkPacketTable {
+		var err error
+		if desc, err = c.AudioDescription(); err != nil && err != errChunkNotFound {
+			return nil, err
+		}
+	}
+	chunkReader := io.NewSectionReader(c.r, info.Offset-cafChunkHeaderSize, cafChunkHeaderSize+info.Size)
+	var chunk CAFChunk
+	if err := chunk.decode(bufio.NewReader(chunkReader), desc); err != nil {
+		return nil, err
+	}
+	return &chunk, nil
+}
+
+// findContents decodes the first chunk of the given type
+func (c *CAFReader) findContents(chunkType FourByteString) (any, error) {
+	info, ok := c.FindChunk(chunkType)
+	if !ok {
+		return nil, errChunkNotFound
+	}
+	chunk, err := c.ReadChunk(info)
+	if err != nil {
+		return nil, err
+	}
+	return chunk.Contents, nil
+}
+
+// AudioDescription decodes the desc chunk
+func (c *CAFReader) AudioDescription() (*CAFAudioFormat, error) {
+	contents, err := c.findContents(ChunkeAudioDescription)
+	if err != nil {
+		return nil, err
+	}
+	return contents.(*CAFAudioFormat), nil
+}
+
+// ChannelLayout decodes the chan chunk
+func (c *CAFReader) ChannelLayout() (*CAFChannelLayout, error) {
+	contents, err := c.findContents(ChunkChannelLayout)
+	if err != nil {
+		return nil, err
+	}
+	return contents.(*CAFChannelLayout), nil
+}
+
+// Information decodes the info chunk
+func (c *CAFReader) Information() (*CAFStringsChunk, error) {
+	contents, err := c.findContents(ChunkInformation)
+	if err != nil {
+		return nil, err
+	}
+	return contents.(*CAFStringsChunk), nil
+}
+
+// PacketTable decodes the pakt chunk
+func (c *CAFReader) PacketTable() (*CAFPacketTable, error) {
+	contents, err := c.findContents(ChunkPacketTable)
+	if err != nil {
+		return nil, err
+	}
+	return contents.(*CAFPacketTable), nil
+}
+
+// MagicCookie returns the contents of the kuki chunk
+func (c *CAFReader) MagicCookie() ([]byte, error) {
+	contents, err := c.findContents(ChunkMagicCookie)
+	if err != nil {
+		return nil, err
+	}
+	return contents.(*UnknownContents).Data, nil
+}
+
+// EditCount returns the edit count of the data chunk
+func (c *CAFReader) EditCount() (uint32, error) {
+	info, ok := c.FindChunk(ChunkAudioData)
+	if !ok {
+		return 0, errChunkNotFound
+	}
+	var editCount uint32
+	if err := binary.Read(io.NewSectionReader(c.r, info.Offset, dataEditCountSize), binary.BigEndian, &editCount); err != nil {
+		return 0, err
+	}
+	return editCount, nil
+}
+
+// AudioData returns a reader for the audio of the data chunk, without its edit count
+func (c *CAFReader) AudioData() (*io.SectionReader, error) {
+	info, ok := c.FindChunk(ChunkAudioData)
+	if !ok {
+		return nil, errChunkNotFound
+	}
+	if info.Size < dataEditCountSize {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return io.NewSectionReader(c.r, info.Offset+dataEditCountSize, info.Size-dataEditCountSize), nil
+}
@@ -0,0 +1,326 @@
+package caf
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+)
+
+var (
+	errBadPacketIndex     = errors.New("packet index is damaged or not a packet index")
+	errMissingPacketIndex = errors.New("caf with variable packets cannot be recovered without its packet index")
+	errNothingRecovered   = errors.New("caf holds no whole packet to recover")
+)
+
+// PacketIndexSuffix is added to the name of a CAF to name the packet index
+// kept while it is written in crash-safe mode
+const PacketIndexSuffix = ".pidx"
+
+// packetIndexMagic starts a packet index. It is followed by records of a tag
+// byte and CAF packet table integers: a packet record holds the size and
+// frames of a packet, a trim record the priming and remainder frames.
+var packetIndexMagic = []byte("pidx")
+
+const (
+	packetIndexPacket = 'p'
+	packetIndexTrim   = 't'
+)
+
+// RecoveryReport describes the audio RecoverCaf saved
+type RecoveryReport struct {
+	// Packets is the number of whole packets recovered
+	Packets int
+	// Frames is the number of valid frames of the recovered audio
+	Frames int64
+	// LostBytes counts the audio bytes after the last whole packet, which
+	// could not be recovered
+	LostBytes int64
+}
+
+// RecoverCaf rebuilds a playable CAF from one whose writing was cut short,
+// such as a crash-safe conversion or PacketWriter recording whose process
+// was killed. The chunks ahead of the audio are kept and the packets are
+// found with the packet index in indexFile, inputFile with PacketIndexSuffix
+// added when empty. Formats with a constant packet size and duration need
+// no index. Packets the index lists but the file lacks are left out, as are
+// the remainder frames unless every packet made it.
+func RecoverCaf(inputFile string, indexFile string, outputFile string) (*RecoveryReport, error) {
+	inFile, err := os.Open(inputFile)
+	if err != nil {
+		return nil, err
+	}
+	defer inFile.Close()
+	stat, err := inFile.Stat()
+	if err != nil {
+		return nil, err
+	}
+	damaged, err := readDamagedCaf(inFile, stat.Size())
+	if err != nil {
+		return nil, err
+	}
+
+	if indexFile == "" {
+		indexFile = inputFile + PacketIndexSuffix
+	}
+	var index *packetIndex
+	contents, err := os.ReadFile(indexFile)
+	switch {
+	case err == nil:
+		if index, err = readPacketIndex(contents); err != nil {
+			return nil, err
+		}
+	case !os.IsNotExist(err):
+		return nil, err
+	case damaged.desc.BytesPerPacket == 0 || damaged.desc.FramesPerPacket == 0:
+		return nil, errMissingPacketIndex
+	default:
+		index = damaged.constantPacketIndex()
+	}
+
+	outFile, err := os.Create(outputFile)
+	if err != nil {
+		return nil, err
+	}
+	defer outFile.Close()
+
+	report, err := damaged.recover(index, outFile)
+	if err != nil {
+		return report, err
+	}
+	return report, outFile.Sync()
+}
+
+// damagedCaf is the part of a CAF cut short that can be relied on
+type damagedCaf struct {
+	r      io.ReaderAt
+	desc   CAFAudioFormat
+	chunks []CAFChunk // Chunks ahead of the audio other than desc
+	// The audio runs from dataStart to the end of the file. The size in
+	// the data chunk header, -1 when unknown, may fall short of it when
+	// packets were written after the headers were last patched.
+	dataStart    int64
+	dataSize     int64
+	declaredSize int64
+}
+
+// readDamagedCaf reads the chunks up to and including the data chunk header.
+// Packet tables and free chunks ahead of the audio are left out, whatever
+// follows the data chunk header is taken as audio.
+func readDamagedCaf(r io.ReaderAt, size int64) (*damagedCaf, error) {
+	var fileHeader CAFFileHeader
+	if err := fileHeader.Decode(io.NewSectionReader(r, 0, cafFileHeaderSize)); err != nil {
+		return nil, err
+	}
+
+	damaged := &damagedCaf{r: r}
+	foundDesc := false
+	offset := int64(cafFileHeaderSize)
+	for {
+		var header CAFChunkHeader
+		if err := binary.Read(io.NewSectionReader(r, offset, cafChunkHeaderSize), binary.BigEndian, &header); err != nil {
+			if err == io.EOF {
+				return nil, errMissingDataChunk
+			}
+			return nil, err
+		}
+		offset += cafChunkHeaderSize
+
+		if header.ChunkType == ChunkAudioData {
+			if !foundDesc {
+				return nil, errMissingDescChunk
+			}
+			damaged.dataStart = offset + dataEditCountSize
+			damaged.dataSize = size - damaged.dataStart
+			if damaged.dataSize < 0 {
+				damaged.dataSize = 0
+			}
+			damaged.declaredSize = -1
+			if header.ChunkSize >= dataEditCountSize && header.ChunkSize-dataEditCountSize <= damaged.dataSize {
+				damaged.declaredSize = header.ChunkSize - dataEditCountSize
+			}
+			return damaged, nil
+		}
+
+		if header.ChunkSize < 0 || header.ChunkSize > size-offset {
+			return nil, errChunkSizeTooLarge
+		}
+		chunkStart := offset - cafChunkHeaderSize
+		offset += header.ChunkSize
+		if header.ChunkType == ChunkPacketTable || header.ChunkType == ChunkFree {
+			continue
+		}
+		var chunk CAFChunk
+		raw := io.NewSectionReader(r, chunkStart, cafChunkHeaderSize+header.ChunkSize)
+		if err := chunk.decode(bufio.NewReader(raw), nil); err != nil {
+			return nil, err
+		}
+
+		if header.ChunkType == ChunkeAudioDescription {
+			damaged.desc = *chunk.Contents.(*CAFAudioFormat)
+			foundDesc = true
+		} else {
+			damaged.chunks = append(damaged.chunks, chunk)
+		}
+	}
+}
+
+// constantPacketIndex lists the packets of a constant format that fit in
+// the audio, without trimming
+func (d *damagedCaf) constantPacketIndex() *packetIndex {
+	index := &packetIndex{}
+	size := d.dataSize
+	if d.declaredSize >= 0 {
+		size = d.declaredSize
+	}
+	count := size / int64(d.desc.BytesPerPacket)
+	for i := int64(0); i < count; i++ {
+		index.sizes = append(index.sizes, uint64(d.desc.BytesPerPacket))
+		index.frames = append(index.frames, uint64(d.desc.FramesPerPacket))
+	}
+	return index
+}
+
+// recover writes the chunks and the indexed packets that fit in the audio
+// as a new CAF
+func (d *damagedCaf) recover(index *packetIndex, w io.Writer) (*RecoveryReport, error) {
+	report := &RecoveryReport{}
+	offset := int64(0)
+	totalFrames := int64(0)
+	for i, size := range index.sizes {
+		if offset+int64(size) > d.dataSize {
+			break
+		}
+		offset += int64(size)
+		totalFrames += int64(index.frames[i])
+		report.Packets++
+	}
+	if report.Packets == 0 {
+		return report, errNothingRecovered
+	}
+	// What follows a complete data chunk is not audio
+	report.LostBytes = d.dataSize - offset
+	if d.declaredSize >= offset {
+		report.LostBytes = d.declaredSize - offset
+	}
+
+	// A cut file still has the desc of a writer that had yet to learn the
+	// frames per packet, CAFWriter works it out from the packets
+	desc := d.desc
+	if desc.BytesPerPacket == 0 {
+		desc.FramesPerPacket = 0
+	}
+	cw, err := NewCAFWriter(w, desc, d.chunks...)
+	if err != nil {
+		return report, err
+	}
+	audio := bufio.NewReaderSize(io.NewSectionReader(d.r, d.dataStart, offset), 32*1024)
+	for i := 0; i < report.Packets; i++ {
+		packet := make([]byte, index.sizes[i])
+		if _, err := io.ReadFull(audio, packet); err != nil {
+			return report, err
+		}
+		if err := cw.WritePacket(packet, uint32(index.frames[i])); err != nil {
+			return report, err
+		}
+	}
+
+	priming := index.priming
+	remainder := index.remainder
+	if report.Packets < len(index.sizes) {
+		remainder = 0
+	}
+	if priming+remainder > totalFrames {
+		priming = totalFrames
+		remainder = 0
+	}
+	cw.SetTrim(int32(priming), int32(remainder))
+	report.Frames = totalFrames - priming - remainder
+	return report, cw.Close()
+}
+
+// packetIndex is a packet index read back
+type packetIndex struct {
+	sizes     []uint64
+	frames    []uint64
+	priming   int64
+	remainder int64
+}
+
+// readPacketIndex reads a packet index. A record cut short at the end is
+// left out, as the writer may have stopped in the middle of it.
+func readPacketIndex(contents []byte) (*packetIndex, error) {
+	if !bytes.HasPrefix(contents, packetIndexMagic) {
+		return nil, errBadPacketIndex
+	}
+	r := bytes.NewReader(contents[len(packetIndexMagic):])
+	index := &packetIndex{}
+	for {
+		tag, err := r.ReadByte()
+		if err == io.EOF {
+			return index, nil
+		}
+		first, err := decodeInt(r)
+		if err != nil {
+			return index, nil
+		}
+		second, err := decodeInt(r)
+		if err != nil {
+			return index, nil
+		}
+
+		switch tag {
+		case packetIndexPacket:
+			index.sizes = append(index.sizes, first)
+			index.frames = append(index.frames, second)
+		case packetIndexTrim:
+			index.priming = int64(first)
+			index.remainder = int64(second)
+		default:
+			return nil, errBadPacketIndex
+		}
+	}
+}
+
+// writeIndexPacket adds a packet record to a packet index. Errors are kept
+// by the bufio.Writer until it is flushed.
+func writeIndexPacket(index *bufio.Writer, size uint64, frames uint64) {
+	index.WriteByte(packetIndexPacket)
+	encodeInt(index, size)
+	encodeInt(index, frames)
+}
+
+// writeIndexTrim adds a trim record to a packet index
+func writeIndexTrim(index *bufio.Writer, priming int32, remainder int32) {
+	index.WriteByte(packetIndexTrim)
+	encodeInt(index, uint64(priming))
+	encodeInt(index, uint64(remainder))
+}
+
+// crashSafeIndex creates the packet index of a CAF being written to w when
+// w is a regular file, nil otherwise
+func crashSafeIndex(w io.Writer) (*os.File, error) {
+	file, ok := w.(*os.File)
+	if !ok {
+		return nil, nil
+	}
+	stat, err := file.Stat()
+	if err != nil || !stat.Mode().IsRegular() {
+		return nil, err
+	}
+	return os.Create(file.Name() + PacketIndexSuffix)
+}
+
+// removeCrashSafeIndex closes and deletes the packet index of a CAF that was
+// completed
+func removeCrashSafeIndex(index *os.File) error {
+	if index == nil {
+		return nil
+	}
+	if err := index.Close(); err != nil {
+		return err
+	}
+	return os.Remove(index.Name())
+}
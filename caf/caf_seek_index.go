@@ -0,0 +1,220 @@
+package caf
+
+import (
+	"errors"
+	"io"
+	"sort"
+)
+
+var errSeekOutOfRange = errors.New("sample time is outside the audio")
+
+// CAFSeekPoint is where to start decoding to reach a sample time
+type CAFSeekPoint struct {
+	// PacketIndex is the packet to start decoding from
+	PacketIndex int
+	// StartFrame is the time of the first sample of that packet, as in CAFPacket
+	StartFrame int64
+	// DataOffset is where the packet starts in the audio data
+	DataOffset int64
+	// Offset is where the packet starts in the file
+	Offset int64
+	// SkipFrames is the number of decoded samples to drop before the
+	// requested time, it includes the pre-roll
+	SkipFrames int64
+}
+
+// CAFSeekIndex maps sample times to packets and byte offsets. Times are
+// counted from the first sample after the priming frames.
+type CAFSeekIndex struct {
+	// startFrames and dataOffsets hold the start of every packet, with an
+	// extra entry for the end of the audio. Both are nil for constant size
+	// packets, whose position is computed.
+	startFrames []int64
+	dataOffsets []int64
+
+	packets         int
+	bytesPerPacket  int64
+	framesPerPacket int64
+	priming         int64
+	validFrames     int64
+	preRoll         int64
+	dataStart       int64
+}
+
+// NewCAFSeekIndex builds a seek index from the audio description and packet
+// table. dataStart is the file offset of the audio data, after the edit count.
+// Opus audio gets an 80 ms pre-roll.
+func NewCAFSeekIndex(desc *CAFAudioFormat, pakt *CAFPacketTable, dataStart int64) (*CAFSeekIndex, error) {
+	index := &CAFSeekIndex{dataStart: dataStart}
+	if desc.FormatID == NewFourByteStr("opus") {
+		index.preRoll = opusPreRoll
+	}
+	if pakt != nil {
+		index.priming = int64(pakt.Header.PrimingFrames)
+		index.validFrames = pakt.Header.NumberValidFrames
+	}
+
+	if desc.BytesPerPacket > 0 && desc.FramesPerPacket > 0 {
+		index.bytesPerPacket = int64(desc.BytesPerPacket)
+		index.framesPerPacket = int64(desc.FramesPerPacket)
+		return index, nil
+	}
+	if pakt == nil {
+		return nil, errMissingPacketTable
+	}
+	if pakt.Frames == nil && desc.FramesPerPacket == 0 {
+		return nil, errMissingFramesPerPacket
+	}
+
+	// A constant size format only lists the frame counts
+	index.packets = len(pakt.Entry)
+	if desc.BytesPerPacket > 0 {
+		index.packets = len(pakt.Frames)
+	}
+	index.startFrames = make([]int64, 0, index.packets+1)
+	index.dataOffsets = make([]int64, 0, index.packets+1)
+	frame, offset := -index.priming, int64(0)
+	for i := 0; i < index.packets; i++ {
+		index.startFrames = append(index.startFrames, frame)
+		index.dataOffsets = append(index.dataOffsets, offset)
+		if pakt.Frames != nil {
+			frame += int64(pakt.Frames[i])
+		} else {
+			frame += int64(desc.FramesPerPacket)
+		}
+		if desc.BytesPerPacket > 0 {
+			offset += int64(desc.BytesPerPacket)
+		} else {
+			offset += int64(pakt.Entry[i])
+		}
+	}
+	index.startFrames = append(index.startFrames, frame)
+	index.dataOffsets = append(index.dataOffsets, offset)
+	return index, nil
+}
+
+// newCAFSeekIndexFromPackets builds a seek index by walking the packets, for
+// files whose packet table does not give frame counts
+func newCAFSeekIndexFromPackets(desc *CAFAudioFormat, pakt *CAFPacketTable, packets *CAFPacketIterator, dataStart int64) (*CAFSeekIndex, error) {
+	withFrames := *pakt
+	withFrames.Frames = make([]uint64, 0, len(pakt.Entry))
+	for {
+		packet, err := packets.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		withFrames.Frames = append(withFrames.Frames, uint64(packet.Frames))
+	}
+	return NewCAFSeekIndex(desc, &withFrames, dataStart)
+}
+
+// SetPreRoll changes the number of samples decoded ahead of a seek target
+func (s *CAFSeekIndex) SetPreRoll(frames int64) {
+	s.preRoll = frames
+}
+
+// Duration returns the number of valid samples
+func (s *CAFSeekIndex) Duration() int64 {
+	if s.validFrames > 0 {
+		return s.validFrames
+	}
+	if s.startFrames != nil {
+		return s.startFrames[len(s.startFrames)-1]
+	}
+	return 0
+}
+
+// SeekToSample returns the packet to start decoding from to play from sampleTime,
+// allowing for the pre-roll
+func (s *CAFSeekIndex) SeekToSample(sampleTime int64) (CAFSeekPoint, error) {
+	duration := s.Duration()
+	if sampleTime < 0 || (duration > 0 && sampleTime >= duration) {
+		return CAFSeekPoint{}, errSeekOutOfRange
+	}
+	target := sampleTime - s.preRoll
+	if target < -s.priming {
+		target = -s.priming
+	}
+
+	var point CAFSeekPoint
+	if s.startFrames == nil {
+		point.PacketIndex = int((target + s.priming) / s.framesPerPacket)
+		point.StartFrame = int64(point.PacketIndex)*s.framesPerPacket - s.priming
+		point.DataOffset = int64(point.PacketIndex) * s.bytesPerPacket
+	} else {
+		// The last packet starting at or before the target
+		point.PacketIndex = sort.Search(s.packets, func(i int) bool { return s.startFrames[i+1] > target })
+		if point.PacketIndex == s.packets {
+			return CAFSeekPoint{}, errSeekOutOfRange
+		}
+		point.StartFrame = s.startFrames[point.PacketIndex]
+		point.DataOffset = s.dataOffsets[point.PacketIndex]
+	}
+	point.Offset = s.dataStart + point.DataOffset
+	point.SkipFrames = sampleTime - point.StartFrame
+	return point, nil
+}
+
+// SeekIndex builds the seek index of the CAF. Files without frame counts in
+// their packet table have their packets read to find them.
+func (c *CAFReader) SeekIndex() (*CAFSeekIndex, error) {
+	desc, err := c.AudioDescription()
+	if err == errChunkNotFound {
+		return nil, errMissingDescChunk
+	}
+	if err != nil {
+		return nil, err
+	}
+	pakt, err := c.PacketTable()
+	if err == errChunkNotFound {
+		pakt = nil
+	} else if err != nil {
+		return nil, err
+	}
+	audio, err := c.AudioData()
+	if err == errChunkNotFound {
+		return nil, errMissingDataChunk
+	}
+	if err != nil {
+		return nil, err
+	}
+	dataChunk, _ := c.FindChunk(ChunkAudioData)
+	dataStart := dataChunk.Offset + dataEditCountSize
+
+	index, err := NewCAFSeekIndex(desc, pakt, dataStart)
+	if err != errMissingFramesPerPacket {
+		return index, err
+	}
+	packets, err := NewCAFPacketIterator(desc, pakt, audio, audio.Size())
+	if err != nil {
+		return nil, err
+	}
+	return newCAFSeekIndexFromPackets(desc, pakt, packets, dataStart)
+}
+
+// SeekToSample returns the packet to start decoding from to play the CAF from
+// sampleTime. The seek index is built on the first call. It is named as
+// OggReader.SeekToSample is, a Seek method would have to be an io.Seeker.
+func (c *CAFReader) SeekToSample(sampleTime int64) (CAFSeekPoint, error) {
+	if c.seekIndex == nil {
+		index, err := c.SeekIndex()
+		if err != nil {
+			return CAFSeekPoint{}, err
+		}
+		c.seekIndex = index
+	}
+	return c.seekIndex.SeekToSample(sampleTime)
+}
+
+// PacketsFrom returns an iterator over the audio packets starting at a seek point
+func (c *CAFReader) PacketsFrom(point CAFSeekPoint) (*CAFPacketIterator, error) {
+	packets, err := c.Packets()
+	if err != nil {
+		return nil, err
+	}
+	packets.seekTo(point)
+	return packets, nil
+}
@@ -0,0 +1,430 @@
+package caf
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+var (
+	errWriterClosed         = errors.New("caf writer is closed")
+	errPacketSizeMismatch   = errors.New("packet size differs from the bytes per packet of the format")
+	errPacketFramesMismatch = errors.New("packet frame count differs from the frames per packet of the format")
+)
+
+// chunkSizeOffset is where the size of a chunk sits in its header
+const chunkSizeOffset = 4
+
+// CAFWriter writes a CAF a packet at a time, for any audio format. When the
+// writer can seek the packets go straight into the data chunk and Close adds
+// the packet table and patches the desc and data chunk headers. A packet
+// table that Flush left after the audio is never overwritten in place: it
+// is copied further on before the audio reaches it and the data chunk grows
+// over the old copy, so the CAF plays up to the last Flush even when the
+// writer stops half way through a packet. Otherwise
+// the audio is held in memory so that the packet table can be written ahead
+// of a data chunk of unknown size.
+//
+// A BytesPerPacket or FramesPerPacket of 0 in the audio description means
+// the packets vary in size or duration. Close sets FramesPerPacket when the
+// packets all turned out to hold the same number of frames.
+type CAFWriter struct {
+	desc        CAFAudioFormat
+	chunks      []CAFChunk
+	packetTable CAFPacketTableHeader
+
+	seeker      io.WriteSeeker // nil when the audio is held in memory
+	start       int64
+	dataOffset  int64 // Where the data chunk header starts, from start
+	out         *bufio.Writer
+	data        bytes.Buffer
+	dataSize    int64
+	sizes       []uint64
+	frames      []uint64
+	totalFrames int64
+	index       *bufio.Writer // Packet index for RecoverCaf, nil when not kept
+	indexOut    io.Writer
+	closed      bool
+
+	// Audio bytes handed to the seeker, and the packets among them that are
+	// listed in the packet index
+	written      int64
+	indexed      int
+	indexedBytes int64
+	// Packet table the last Flush wrote after the audio and where it now
+	// starts, counted from the start of the audio. nil before any Flush.
+	table   []byte
+	tableAt int64
+}
+
+// NewCAFWriter starts a CAF with the audio description and further chunks,
+// such as chan, kuki and info, that go ahead of the audio. Chunk sizes are
+// taken from the encoded contents.
+func NewCAFWriter(w io.Writer, desc CAFAudioFormat, chunks ...CAFChunk) (*CAFWriter, error) {
+	if desc.BytesPerPacket > 0 && desc.FramesPerPacket == 0 {
+		return nil, errMissingFramesPerPacket
+	}
+	cw := &CAFWriter{desc: desc, chunks: chunks, out: bufio.NewWriterSize(w, 32*1024)}
+
+	if ws, ok := w.(io.WriteSeeker); ok {
+		// Pipes and terminals satisfy io.WriteSeeker but fail to seek
+		if start, err := ws.Seek(0, io.SeekCurrent); err == nil {
+			cw.seeker = ws
+			cw.start = start
+		}
+	}
+	if cw.seeker == nil {
+		return cw, nil
+	}
+
+	var preamble bytes.Buffer
+	headerSize, err := writeCafPreamble(&preamble, cw.desc, cw.chunks)
+	if err != nil {
+		return nil, err
+	}
+	cw.dataOffset = headerSize
+	dataHeader := CAFChunkHeader{ChunkType: ChunkAudioData, ChunkSize: -1}
+	if err := binary.Write(&preamble, binary.BigEndian, &dataHeader); err != nil {
+		return nil, err
+	}
+	var editCount uint32
+	if err := binary.Write(&preamble, binary.BigEndian, &editCount); err != nil {
+		return nil, err
+	}
+	if _, err := cw.seeker.Write(preamble.Bytes()); err != nil {
+		return nil, err
+	}
+	cw.out.Reset(seekableAudio{cw})
+	return cw, nil
+}
+
+// SetTrim sets the priming frames at the start of the audio and the
+// remainder frames at its end that are not played
+func (cw *CAFWriter) SetTrim(priming int32, remainder int32) {
+	cw.packetTable.PrimingFrames = priming
+	cw.packetTable.RemainderFrames = remainder
+	if cw.index != nil {
+		writeIndexTrim(cw.index, priming, remainder)
+	}
+}
+
+// SetPacketIndex keeps a packet index in index alongside the CAF, which
+// lists the size and frames of every packet and the trimming, so that
+// RecoverCaf can repair the CAF should the writer never get to Close. The
+// index catches up with the packets written so far and is written out, and
+// synced along with the CAF when they are files, every time audio goes to
+// the CAF. It only lists packets that are whole in the CAF. It is of no use
+// for a writer that cannot seek.
+func (cw *CAFWriter) SetPacketIndex(index io.Writer) error {
+	if cw.seeker != nil {
+		// The audio buffered so far goes out first, so that the index can
+		// list all of it
+		if err := cw.out.Flush(); err != nil {
+			return err
+		}
+	}
+	cw.index = bufio.NewWriter(index)
+	cw.indexOut = index
+	if _, err := cw.index.Write(packetIndexMagic); err != nil {
+		return err
+	}
+	for i, size := range cw.sizes {
+		writeIndexPacket(cw.index, size, cw.frames[i])
+		cw.indexedBytes += int64(size)
+	}
+	cw.indexed = len(cw.sizes)
+	writeIndexTrim(cw.index, cw.packetTable.PrimingFrames, cw.packetTable.RemainderFrames)
+	return cw.syncIndex()
+}
+
+// syncIndex syncs the CAF to disk, then writes out the packet index and
+// syncs it
+func (cw *CAFWriter) syncIndex() error {
+	if err := syncFile(cw.seeker); err != nil {
+		return err
+	}
+	if err := cw.index.Flush(); err != nil {
+		return err
+	}
+	return syncFile(cw.indexOut)
+}
+
+// seekableAudio writes the audio of a CAF that can seek. A packet table
+// left by Flush is moved out of the way first, and the packets that were
+// written whole are added to the packet index after the audio.
+type seekableAudio struct {
+	cw *CAFWriter
+}
+
+func (a seekableAudio) Write(b []byte) (int, error) {
+	cw := a.cw
+	if cw.table != nil && cw.written+int64(len(b)) > cw.tableAt {
+		if err := cw.moveTable(cw.written + int64(len(b))); err != nil {
+			return 0, err
+		}
+	}
+	n, err := cw.seeker.Write(b)
+	cw.written += int64(n)
+	if cw.index == nil {
+		return n, err
+	}
+	for cw.indexed < len(cw.sizes) && cw.indexedBytes+int64(cw.sizes[cw.indexed]) <= cw.written {
+		writeIndexPacket(cw.index, cw.sizes[cw.indexed], cw.frames[cw.indexed])
+		cw.indexedBytes += int64(cw.sizes[cw.indexed])
+		cw.indexed++
+	}
+	if err != nil {
+		return n, err
+	}
+	return n, cw.syncIndex()
+}
+
+// moveTable copies the packet table of the last Flush past end, with room
+// for more audio, and then grows the data chunk up to the copy. The CAF
+// stays playable up to the last Flush before, between and after the two
+// writes.
+func (cw *CAFWriter) moveTable(end int64) error {
+	room := cw.written / 4
+	if room < 64*1024 {
+		room = 64 * 1024
+	}
+	tableAt := end + room
+	audioStart := cw.start + cw.dataOffset + cafChunkHeaderSize + dataEditCountSize
+	if _, err := cw.seeker.Seek(audioStart+tableAt, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := cw.seeker.Write(cw.table); err != nil {
+		return err
+	}
+	if err := cw.patch(cw.dataOffset+chunkSizeOffset, tableAt+dataEditCountSize); err != nil {
+		return err
+	}
+	cw.tableAt = tableAt
+	_, err := cw.seeker.Seek(audioStart+cw.written, io.SeekStart)
+	return err
+}
+
+// syncFile commits w to disk when it is a file
+func syncFile(w any) error {
+	if syncer, ok := w.(interface{ Sync() error }); ok {
+		return syncer.Sync()
+	}
+	return nil
+}
+
+// WritePacket adds a packet of audio holding the given number of frames
+func (cw *CAFWriter) WritePacket(data []byte, frames uint32) error {
+	if cw.closed {
+		return errWriterClosed
+	}
+	if cw.desc.BytesPerPacket > 0 && len(data) != int(cw.desc.BytesPerPacket) {
+		return errPacketSizeMismatch
+	}
+	if cw.desc.FramesPerPacket > 0 && frames != cw.desc.FramesPerPacket {
+		return errPacketFramesMismatch
+	}
+
+	// The audio of a writer that cannot seek is all written by Close
+	if cw.index != nil && cw.seeker == nil {
+		writeIndexPacket(cw.index, uint64(len(data)), uint64(frames))
+	}
+	var err error
+	if cw.seeker != nil {
+		_, err = cw.out.Write(data)
+	} else {
+		_, err = cw.data.Write(data)
+	}
+	if err != nil {
+		return err
+	}
+	cw.dataSize += int64(len(data))
+	cw.sizes = append(cw.sizes, uint64(len(data)))
+	cw.frames = append(cw.frames, uint64(frames))
+	cw.totalFrames += int64(frames)
+	return nil
+}
+
+// Flush brings the CAF up to date with the packets written so far, so that
+// it plays up to the last of them. The packet table goes after the audio
+// and the desc and data chunk headers are patched. A writer that cannot
+// seek gets nothing before Close.
+func (cw *CAFWriter) Flush() error {
+	if cw.closed {
+		return errWriterClosed
+	}
+	if cw.seeker == nil {
+		return nil
+	}
+	if err := cw.finish(); err != nil {
+		return err
+	}
+	dataEnd := cw.dataOffset + cafChunkHeaderSize + dataEditCountSize + cw.dataSize
+	_, err := cw.seeker.Seek(cw.start+dataEnd, io.SeekStart)
+	return err
+}
+
+// Close finishes the CAF. It does not close the underlying writer.
+func (cw *CAFWriter) Close() error {
+	if cw.closed {
+		return errWriterClosed
+	}
+	cw.closed = true
+	cw.desc.FramesPerPacket = cw.framesPerPacket()
+
+	if cw.seeker == nil {
+		return cw.closeStreaming()
+	}
+	return cw.finish()
+}
+
+// finish writes the packet table after the audio and patches the headers.
+// The table of the last Flush stays whole until the headers point past it,
+// behind a free chunk that a file is truncated to leave out. A format that
+// needs no packet table keeps a data chunk of size -1 until Close, so that
+// the audio that follows a Flush is never taken for a chunk.
+func (cw *CAFWriter) finish() error {
+	if err := cw.out.Flush(); err != nil {
+		return err
+	}
+	var table bytes.Buffer
+	if err := cw.writePacketTable(&table); err != nil {
+		return err
+	}
+	tableEnd := cw.written + int64(table.Len())
+	if cw.table != nil && tableEnd+cafChunkHeaderSize > cw.tableAt {
+		if err := cw.moveTable(tableEnd + cafChunkHeaderSize); err != nil {
+			return err
+		}
+	}
+	if _, err := cw.seeker.Write(table.Bytes()); err != nil {
+		return err
+	}
+	if cw.table != nil {
+		free := CAFChunkHeader{ChunkType: ChunkFree, ChunkSize: cw.tableAt + int64(len(cw.table)) - tableEnd - cafChunkHeaderSize}
+		if err := binary.Write(cw.seeker, binary.BigEndian, &free); err != nil {
+			return err
+		}
+	}
+
+	framesPerPacketOffset := int64(cafFileHeaderSize + cafChunkHeaderSize + audioDescriptionFramesPerPacketOffset)
+	if err := cw.patch(framesPerPacketOffset, cw.framesPerPacket()); err != nil {
+		return err
+	}
+	dataChunkSize := cw.written + dataEditCountSize
+	if table.Len() == 0 && !cw.closed {
+		dataChunkSize = -1
+	} else {
+		cw.table, cw.tableAt = table.Bytes(), cw.written
+	}
+	if err := cw.patch(cw.dataOffset+chunkSizeOffset, dataChunkSize); err != nil {
+		return err
+	}
+	if cw.index != nil {
+		// A bufio.Writer keeps its first error, so this catches those of
+		// the records written since the last sync
+		if err := cw.syncIndex(); err != nil {
+			return err
+		}
+	}
+	audioStart := cw.start + cw.dataOffset + cafChunkHeaderSize + dataEditCountSize
+	if _, err := cw.seeker.Seek(audioStart+tableEnd, io.SeekStart); err != nil {
+		return err
+	}
+	if truncater, ok := cw.seeker.(interface{ Truncate(size int64) error }); ok {
+		return truncater.Truncate(audioStart + tableEnd)
+	}
+	return nil
+}
+
+// framesPerPacket returns the frames per packet of the desc chunk, set to
+// the frames of every packet when the format leaves it open and they agree
+func (cw *CAFWriter) framesPerPacket() uint32 {
+	if cw.desc.FramesPerPacket == 0 && len(cw.frames) > 0 && !variableFrameCounts(cw.frames) {
+		return uint32(cw.frames[0])
+	}
+	return cw.desc.FramesPerPacket
+}
+
+// closeStreaming writes the whole file, with the packet table ahead of a
+// data chunk of size -1 so the writer never has to seek
+func (cw *CAFWriter) closeStreaming() error {
+	if _, err := writeCafPreamble(cw.out, cw.desc, cw.chunks); err != nil {
+		return err
+	}
+	if err := cw.writePacketTable(cw.out); err != nil {
+		return err
+	}
+
+	// A data chunk of size -1 runs until the end of the file
+	dataChunk := CAFChunk{
+		Header:   CAFChunkHeader{ChunkType: ChunkAudioData, ChunkSize: -1},
+		Contents: &DataX{EditCount: 0, Bytes: cw.data.Bytes()},
+	}
+	if err := dataChunk.Encode(cw.out); err != nil {
+		return err
+	}
+	return cw.out.Flush()
+}
+
+// writePacketTable writes the pakt chunk. Packet sizes are listed when they
+// vary and frame counts when they do, constant formats only get a table for
+// their priming and remainder frames or when a Flush already wrote one.
+func (cw *CAFWriter) writePacketTable(w io.Writer) error {
+	variableSize := cw.desc.BytesPerPacket == 0
+	variableFrames := cw.desc.FramesPerPacket == 0
+	if !variableSize && !variableFrames && cw.packetTable.PrimingFrames == 0 && cw.packetTable.RemainderFrames == 0 && cw.table == nil {
+		return nil
+	}
+
+	header := cw.packetTable
+	header.NumberPackets = int64(len(cw.sizes))
+	header.NumberValidFrames = cw.totalFrames - int64(header.PrimingFrames) - int64(header.RemainderFrames)
+	sizes := cw.sizes
+	if !variableSize {
+		sizes = nil
+	}
+	return writePacketTableChunk(w, sizes, cw.frames, header)
+}
+
+// patch overwrites a big endian value at offset from the start of the CAF
+func (cw *CAFWriter) patch(offset int64, value any) error {
+	if _, err := cw.seeker.Seek(cw.start+offset, io.SeekStart); err != nil {
+		return err
+	}
+	return binary.Write(cw.seeker, binary.BigEndian, value)
+}
+
+// writeCafPreamble writes the file header, the desc chunk and the given
+// chunks, and returns the number of bytes written
+func writeCafPreamble(w io.Writer, desc CAFAudioFormat, chunks []CAFChunk) (int64, error) {
+	fileHeader := CAFFileHeader{FileType: NewFourByteStr("caff"), FileVersion: 1, FileFlags: 0}
+	if err := fileHeader.Encode(w); err != nil {
+		return 0, err
+	}
+	written := int64(cafFileHeaderSize)
+
+	descChunk := CAFChunk{Header: CAFChunkHeader{ChunkType: ChunkeAudioDescription}, Contents: &desc}
+	for _, chunk := range append([]CAFChunk{descChunk}, chunks...) {
+		size, err := encodeSizedChunk(w, chunk)
+		if err != nil {
+			return 0, err
+		}
+		written += size
+	}
+	return written, nil
+}
+
+// encodeSizedChunk writes a chunk with the size of its encoded contents in
+// its header, and returns the number of bytes written
+func encodeSizedChunk(w io.Writer, chunk CAFChunk) (int64, error) {
+	var encoded bytes.Buffer
+	if err := chunk.Encode(&encoded); err != nil {
+		return 0, err
+	}
+	raw := encoded.Bytes()
+	binary.BigEndian.PutUint64(raw[chunkSizeOffset:cafChunkHeaderSize], uint64(len(raw)-cafChunkHeaderSize))
+	_, err := w.Write(raw)
+	return int64(len(raw)), err
+}
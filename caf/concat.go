@@ -0,0 +1,110 @@
+package caf
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+var (
+	errNoConcatInputs     = errors.New("no input files to concatenate")
+	errIncompatibleInputs = errors.New("inputs differ in channel count or mapping and cannot be concatenated")
+)
+
+// ConcatOpusToCaf joins Ogg Opus files into a single CAF, such as an intro,
+// an episode and an outro. The packets are copied without re-encoding into
+// one data chunk with one packet table: the pre-skip of the first file
+// becomes the priming frames and the end trimming of the last file the
+// remainder frames, the joins are trimmed as joined links are. The files
+// must have the same channel count and mapping, and the info chunk is made
+// from the comments of the first one.
+func ConcatOpusToCaf(inputFiles []string, outputFile string, options ConvertOptions) (*ConversionReport, error) {
+	inputs := make([]io.Reader, 0, len(inputFiles))
+	for _, inputFile := range inputFiles {
+		inFile, err := os.Open(inputFile)
+		if err != nil {
+			return nil, err
+		}
+		defer inFile.Close()
+		inputs = append(inputs, inFile)
+	}
+
+	outFile, err := os.Create(outputFile)
+	if err != nil {
+		return nil, err
+	}
+	defer outFile.Close()
+
+	return ConcatOpusToCafStream(inputs, outFile, options)
+}
+
+// ConcatOpusToCafStream is ConcatOpusToCaf over streams. With Chain set to
+// ChainJoin every link of a chained input is added, otherwise only the first
+// one. The report holds the problems of all inputs, with the offsets of
+// skipped bytes counted within their own input.
+func ConcatOpusToCafStream(inputs []io.Reader, w io.Writer, options ConvertOptions) (*ConversionReport, error) {
+	if len(inputs) == 0 {
+		return nil, errNoConcatInputs
+	}
+
+	var readers []*OggReader
+	var warnings []string
+	report := func() *ConversionReport {
+		report := &ConversionReport{Warnings: warnings}
+		for _, ogg := range readers {
+			report.BadPages = append(report.BadPages, ogg.BadPages()...)
+			report.Skipped = append(report.Skipped, ogg.Skipped()...)
+		}
+		return report
+	}
+
+	ogg, header, err := NewWithOptions(bufio.NewReaderSize(inputs[0], 32*1024), options.readerOptions())
+	if err != nil {
+		return nil, err
+	}
+	readers = append(readers, ogg)
+
+	cafHeader, warnings, err := cafOpusHeader(header, options)
+	if err != nil {
+		return nil, err
+	}
+	info, err := readCafInformation(ogg, options)
+	if err != nil {
+		return report(), err
+	}
+
+	input := 0
+	source := joinedLinkAudio(ogg, header, func() (*OggReader, *OggHeader, error) {
+		current := readers[len(readers)-1]
+		if options.Chain == ChainJoin {
+			next, err := current.NextLink()
+			if err != io.EOF {
+				return current, next, err
+			}
+		}
+
+		input++
+		if input == len(inputs) {
+			return nil, nil, io.EOF
+		}
+		next, nextHeader, err := NewWithOptions(bufio.NewReaderSize(inputs[input], 32*1024), options.readerOptions())
+		if err != nil {
+			return nil, nil, fmt.Errorf("input %d: %w", input+1, err)
+		}
+		readers = append(readers, next)
+		if !nextHeader.sameChannels(header) {
+			return nil, nil, fmt.Errorf("input %d: %w", input+1, errIncompatibleInputs)
+		}
+		return next, nextHeader, nil
+	})
+	source, err = options.timeRangeAudio(source, header)
+	if err != nil {
+		return report(), err
+	}
+
+	audioWarnings, err := writeCaf(cafHeader, info, source, w, options.CrashSafe)
+	warnings = append(warnings, audioWarnings...)
+	return report(), err
+}
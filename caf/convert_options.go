@@ -0,0 +1,70 @@
+package caf
+
+import "time"
+
+// ChainMode sets how the links of a chained Ogg file are converted
+type ChainMode int
+
+const (
+	// ChainFirstLink converts the first link only
+	ChainFirstLink ChainMode = iota
+	// ChainJoin joins all links into a single CAF
+	ChainJoin
+)
+
+// ConvertOptions configures an Opus to CAF conversion
+type ConvertOptions struct {
+	// Lenient skips Ogg pages whose CRC does not match instead of failing,
+	// the skipped pages are listed in the ConversionReport
+	Lenient bool
+	// Serial selects the logical stream of a multiplexed file, the first
+	// Opus stream is converted when nil
+	Serial *uint32
+	// Chain sets how the links of a chained file are converted, use
+	// SplitOpusLinksToCaf to write one CAF per link
+	Chain ChainMode
+	// KeepDemixingMatrix stores ambisonics with a mixing demixing matrix
+	// (channel mapping family 3) as is, with a warning in the report,
+	// instead of failing
+	KeepDemixingMatrix bool
+	// Metadata sets which OpusTags comments are written to the info chunk
+	Metadata MetadataMode
+	// Start and End convert only the audio between the two times, counted
+	// from the first sample after the pre-skip. The cut is made at packet
+	// boundaries with the Opus pre-roll kept ahead of Start, and the packet
+	// table trims playback to the exact samples. An End of 0 converts to
+	// the end of the audio.
+	Start time.Duration
+	End   time.Duration
+	// CrashSafe keeps a packet index next to a CAF written to a file, named
+	// after it with PacketIndexSuffix, until the CAF is complete. RecoverCaf
+	// uses it to repair a CAF whose conversion never finished.
+	CrashSafe bool
+}
+
+// ConversionReport describes problems with the input that did not stop a conversion
+type ConversionReport struct {
+	BadPages []*OggCRCError
+	// Skipped lists the bytes passed over to find valid pages, including
+	// those of bad pages
+	Skipped []SkippedBytes
+	// Warnings describe parts of the input the output may not play back as intended
+	Warnings []string
+}
+
+// SkippedByteCount returns the total number of input bytes that were skipped
+func (r *ConversionReport) SkippedByteCount() int64 {
+	count := int64(0)
+	for _, skipped := range r.Skipped {
+		count += skipped.Length
+	}
+	return count
+}
+
+func (o ConvertOptions) readerOptions() OggReaderOptions {
+	return OggReaderOptions{Lenient: o.Lenient, Serial: o.Serial}
+}
+
+func newConversionReport(ogg *OggReader, warnings []string) *ConversionReport {
+	return &ConversionReport{BadPages: ogg.BadPages(), Skipped: ogg.Skipped(), Warnings: warnings}
+}
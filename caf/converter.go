@@ -2,10 +2,14 @@ package caf
 
 import (
 	"bufio"
-	"bytes"
-	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
+	"math"
+	"math/rand"
 	"os"
+	"path/filepath"
+	"strings"
 )
 
 var ChunkeAudioDescription = NewFourByteStr("desc")
@@ -14,189 +18,654 @@ var ChunkInformation = NewFourByteStr("info")
 var ChunkAudioData = NewFourByteStr("data")
 var ChunkPacketTable = NewFourByteStr("pakt")
 var ChunkMidi = NewFourByteStr("midi")
+var ChunkMagicCookie = NewFourByteStr("kuki")
+
+const defaultOpusVendor = "opus_caf_converter"
+
+var (
+	errMissingDescChunk    = errors.New("caf file has no audio description chunk")
+	errMissingDataChunk    = errors.New("caf file has no audio data chunk")
+	errMissingPacketTable  = errors.New("caf file has no packet table chunk")
+	errNotOpusCaf          = errors.New("caf file does not contain opus audio")
+	errUnsupportedChannels = errors.New("multichannel opus caf has no magic cookie with its channel mapping")
+	errPacketTableOverflow = errors.New("packet table describes more bytes than the data chunk holds")
+	errIncompatibleLinks   = errors.New("links differ in channel count or mapping and cannot be joined")
+	errPrimingOutOfRange   = errors.New("caf priming frames do not fit in an opus pre-skip")
+
+	errUnrepresentableDemixingMatrix = errors.New("ambisonic demixing matrix mixes channels and cannot be stored as a channel mapping")
+)
 
 func ConvertOpusToCaf(inputFile string, outputFile string) error {
+	_, err := ConvertOpusToCafWithOptions(inputFile, outputFile, ConvertOptions{})
+	return err
+}
+
+// ConvertOpusToCafWithOptions converts an Ogg Opus file into a CAF file and
+// reports the damage to the input it worked around
+func ConvertOpusToCafWithOptions(inputFile string, outputFile string, options ConvertOptions) (*ConversionReport, error) {
 	inFile, err := os.Open(inputFile)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer inFile.Close()
 
 	outFile, err := os.Create(outputFile)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer outFile.Close()
 
-	bufferedReader := bufio.NewReaderSize(inFile, 32*1024) // Increased buffer size
-	bufferedWriter := bufio.NewWriterSize(outFile, 32*1024) // Increased buffer size
-	
-	ogg, header, err := NewWith(bufferedReader)
+	return ConvertOpusToCafStreamWithOptions(inFile, outFile, options)
+}
+
+// ConvertOpusToCafStream converts Ogg Opus read from r into a CAF written to w.
+// When w is an io.WriteSeeker the data chunk is written first and the headers
+// are patched in place once all packets are known. Otherwise the audio is
+// held in memory so that the packet table can be written ahead of a data
+// chunk of unknown size.
+func ConvertOpusToCafStream(r io.Reader, w io.Writer) error {
+	_, err := ConvertOpusToCafStreamWithOptions(r, w, ConvertOptions{})
+	return err
+}
+
+// ConvertOpusToCafStreamWithOptions is ConvertOpusToCafStream with options,
+// it reports the damage to the input it worked around
+func ConvertOpusToCafStreamWithOptions(r io.Reader, w io.Writer, options ConvertOptions) (*ConversionReport, error) {
+	bufferedReader := bufio.NewReaderSize(r, 32*1024) // Increased buffer size
+
+	ogg, header, err := NewWithOptions(bufferedReader, options.readerOptions())
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// Write CAF file header
-	cafHeader := CAFFileHeader{
-		FileType:    NewFourByteStr("caff"),
-		FileVersion: 1,
-		FileFlags:   0,
+	cafHeader, warnings, err := cafOpusHeader(header, options)
+	if err != nil {
+		return nil, err
 	}
-	if err := cafHeader.Encode(bufferedWriter); err != nil {
-		return err
+	info, err := readCafInformation(ogg, options)
+	if err != nil {
+		return newConversionReport(ogg, warnings), err
 	}
 
-	frameSize := uint32(0)
+	source := linkAudio(ogg, header)
+	if options.Chain == ChainJoin {
+		source = joinedLinkAudio(ogg, header, func() (*OggReader, *OggHeader, error) {
+			next, err := ogg.NextLink()
+			return ogg, next, err
+		})
+	}
+	source, err = options.timeRangeAudio(source, header)
+	if err != nil {
+		return newConversionReport(ogg, warnings), err
+	}
 
-	// Write audio description chunk
-	descChunk := CAFChunk{
-		Header: CAFChunkHeader{ChunkType: ChunkeAudioDescription, ChunkSize: 32},
-		Contents: &CAFAudioFormat{
-			SampleRate:        48000,
-			FormatID:          NewFourByteStr("opus"),
-			FormatFlags:       0x00000000,
-			BytesPerPacket:    0,
-			FramesPerPacket:   frameSize,
-			BitsPerChannel:    0,
-			ChannelsPerPacket: uint32(header.Channels),
-		},
+	audioWarnings, err := writeCaf(cafHeader, info, source, w, options.CrashSafe)
+	return newConversionReport(ogg, append(warnings, audioWarnings...)), err
+}
+
+// SplitOpusLinksToCaf converts every link of a chained Ogg Opus file into its
+// own CAF file. The files are named after outputFile with the link number
+// added, so out.caf becomes out_1.caf, out_2.caf and so on. A time range in
+// the options is cut from every link.
+func SplitOpusLinksToCaf(inputFile string, outputFile string, options ConvertOptions) ([]string, *ConversionReport, error) {
+	inFile, err := os.Open(inputFile)
+	if err != nil {
+		return nil, nil, err
 	}
-	if err := descChunk.Encode(bufferedWriter); err != nil {
-		return err
+	defer inFile.Close()
+
+	ogg, header, err := NewWithOptions(bufio.NewReaderSize(inFile, 32*1024), options.readerOptions())
+	if err != nil {
+		return nil, nil, err
 	}
 
-	// Write channel layout chunk
-	chanChunk := CAFChunk{
-		Header: CAFChunkHeader{ChunkType: ChunkChannelLayout, ChunkSize: 12},
-		Contents: &CAFChannelLayout{
-			ChannelLayoutTag:          GetChannelLayoutForChannels(uint32(header.Channels)),
-			ChannelBitmap:             0x0,
-			NumberChannelDescriptions: 0,
-		},
+	var outputFiles []string
+	var warnings []string
+	for link := 1; ; link++ {
+		cafHeader, linkWarnings, err := cafOpusHeader(header, options)
+		warnings = append(warnings, linkWarnings...)
+		if err != nil {
+			return outputFiles, newConversionReport(ogg, warnings), err
+		}
+
+		info, err := readCafInformation(ogg, options)
+		if err != nil {
+			return outputFiles, newConversionReport(ogg, warnings), err
+		}
+
+		source, err := options.timeRangeAudio(linkAudio(ogg, header), header)
+		if err != nil {
+			return outputFiles, newConversionReport(ogg, warnings), err
+		}
+		linkFile := numberedFileName(outputFile, link)
+		linkWarnings, err = writeCafFile(linkFile, cafHeader, info, source, options.CrashSafe)
+		warnings = append(warnings, linkWarnings...)
+		if err != nil {
+			return outputFiles, newConversionReport(ogg, warnings), err
+		}
+		outputFiles = append(outputFiles, linkFile)
+
+		header, err = ogg.NextLink()
+		if err == io.EOF {
+			return outputFiles, newConversionReport(ogg, warnings), nil
+		}
+		if err != nil {
+			return outputFiles, newConversionReport(ogg, warnings), err
+		}
 	}
-	if err := chanChunk.Encode(bufferedWriter); err != nil {
-		return err
+}
+
+// cafOpusHeader returns the Opus header to describe in the CAF. Players only
+// know channel mapping tables, so a family 3 demixing matrix that merely
+// routes channels is stored as the equivalent family 2 mapping. A matrix that
+// mixes channels is refused, or kept with a warning when the options allow it.
+func cafOpusHeader(header *OggHeader, options ConvertOptions) (*OggHeader, []string, error) {
+	if header.ChannelMap != 3 {
+		return header, nil, nil
 	}
 
-	// Write information chunk
-	infoChunk := CAFChunk{
-		Header:   CAFChunkHeader{ChunkType: ChunkInformation, ChunkSize: 25},
-		Contents: &CAFStringsChunk{NumEntries: 1, Strings: []Information{{Key: "encoder\x00", Value: "Lavf60.3.100\x00"}}},
+	if mapping, ok := header.demixingPermutation(); ok {
+		cafHeader := *header
+		cafHeader.ChannelMap = 2
+		cafHeader.ChannelMapping = mapping
+		cafHeader.DemixingMatrix = nil
+		return &cafHeader, nil, nil
 	}
-	if err := infoChunk.Encode(bufferedWriter); err != nil {
-		return err
+
+	if !options.KeepDemixingMatrix {
+		return nil, nil, errUnrepresentableDemixingMatrix
 	}
+	warning := fmt.Sprintf("kept a %dx%d demixing matrix in the magic cookie, players without Opus projection decoding cannot play this file",
+		header.Channels, int(header.StreamCount)+int(header.CoupledCount))
+	return header, []string{warning}, nil
+}
 
-	dataOffset := bufferedWriter.Buffered()
-	// Write audio data chunk header
-	dataChunkHeader := CAFChunkHeader{ChunkType: ChunkAudioData, ChunkSize: -1}
-	if err := binary.Write(bufferedWriter, binary.BigEndian, &dataChunkHeader); err != nil {
-		return err
+// numberedFileName adds a number to a file name ahead of its extension
+func numberedFileName(fileName string, number int) string {
+	ext := filepath.Ext(fileName)
+	return fmt.Sprintf("%s_%d%s", strings.TrimSuffix(fileName, ext), number, ext)
+}
+
+func writeCafFile(outputFile string, header *OggHeader, info []Information, source audioSource, crashSafe bool) ([]string, error) {
+	outFile, err := os.Create(outputFile)
+	if err != nil {
+		return nil, err
 	}
+	defer outFile.Close()
 
-	// Write edit count
-	var editCount uint32 = 0
-	if err := binary.Write(bufferedWriter, binary.BigEndian, &editCount); err != nil {
-		return err
+	return writeCaf(header, info, source, outFile, crashSafe)
+}
+
+// writeCaf writes the audio from source as a CAF and returns the warnings of
+// the source. When crashSafe is set and w is a file, a packet index is kept
+// next to it until the CAF is complete.
+func writeCaf(header *OggHeader, info []Information, source audioSource, w io.Writer, crashSafe bool) ([]string, error) {
+	cw, err := NewCAFWriter(w, opusAudioFormat(header), opusHeaderChunks(header, info)...)
+	if err != nil {
+		return nil, err
+	}
+	var index *os.File
+	if crashSafe {
+		if index, err = crashSafeIndex(w); err != nil {
+			return nil, err
+		}
+	}
+	if index != nil {
+		defer index.Close()
+		if err := cw.SetPacketIndex(index); err != nil {
+			return nil, err
+		}
+		// The pre-skip is known from the start, a CAF recovered from the
+		// index trims it even when the end of the audio was never reached
+		cw.SetTrim(int32(header.PreSkip), 0)
+	}
+
+	audio, err := source(cw.WritePacket)
+	if err != nil {
+		return audio.warnings, err
+	}
+	cw.SetTrim(audio.packetTable.PrimingFrames, audio.packetTable.RemainderFrames)
+	if err := cw.Close(); err != nil {
+		return audio.warnings, err
+	}
+	return audio.warnings, removeCrashSafeIndex(index)
+}
+
+// opusAudioFormat is the audio description of Opus with the given header,
+// the packets vary in size and possibly in duration
+func opusAudioFormat(header *OggHeader) CAFAudioFormat {
+	return CAFAudioFormat{
+		SampleRate:        opusSampleRate,
+		FormatID:          NewFourByteStr("opus"),
+		FormatFlags:       0x00000000,
+		BytesPerPacket:    0,
+		FramesPerPacket:   0,
+		BitsPerChannel:    0,
+		ChannelsPerPacket: uint32(header.Channels),
+	}
+}
+
+// opusHeaderChunks returns the chan, kuki and info chunks of an Opus CAF, the
+// info chunk is left out when there are no entries
+func opusHeaderChunks(header *OggHeader, info []Information) []CAFChunk {
+	chunks := []CAFChunk{NewChannelLayoutChunk(GetChannelLayoutForOpusHeader(header))}
+
+	// Multistream Opus cannot be decoded without the stream counts and
+	// mapping table, so the OpusHead goes into a magic cookie
+	if header.ChannelMap != 0 {
+		cookie := header.bytes()
+		chunks = append(chunks, CAFChunk{
+			Header:   CAFChunkHeader{ChunkType: ChunkMagicCookie, ChunkSize: int64(len(cookie))},
+			Contents: &UnknownContents{Data: cookie},
+		})
+	}
+
+	if len(info) > 0 {
+		chunks = append(chunks, CAFChunk{
+			Header:   CAFChunkHeader{ChunkType: ChunkInformation, ChunkSize: informationChunkSize(info)},
+			Contents: &CAFStringsChunk{NumEntries: uint32(len(info)), Strings: info},
+		})
+	}
+	return chunks
+}
+
+// readCafInformation reads the OpusTags of the current link and returns the
+// info chunk entries for them. In lenient mode a damaged comment header
+// leaves the info chunk out instead of failing.
+func readCafInformation(ogg *OggReader, options ConvertOptions) ([]Information, error) {
+	tags, err := readOpusTags(ogg, options)
+	if err != nil {
+		return nil, err
+	}
+	return cafInformation(tags, options.Metadata), nil
+}
+
+// readOpusTags reads the OpusTags of the current link, which are nil when
+// lenient mode passes over a damaged comment header
+func readOpusTags(ogg *OggReader, options ConvertOptions) (*OpusTags, error) {
+	tags, err := ogg.ReadTags()
+	if err != nil {
+		if options.Lenient && (errors.Is(err, errBadOpusTagsSignature) || errors.Is(err, errBadOpusTagsLength)) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return tags, nil
+}
+
+// cafAudio describes the packets an audioSource handed out
+type cafAudio struct {
+	packetTable CAFPacketTableHeader
+	// warnings tell of trimming the packet table could not express
+	warnings []string
+}
+
+// audioSource calls handle with every audio packet and its duration
+type audioSource func(handle func(packet []byte, frames uint32) error) (cafAudio, error)
+
+// linkAudio is the audio of the current link of ogg
+func linkAudio(ogg *OggReader, header *OggHeader) audioSource {
+	return func(handle func(packet []byte, frames uint32) error) (cafAudio, error) {
+		stats, err := readAudioPackets(ogg, handle)
+		if err != nil {
+			return cafAudio{}, err
+		}
+		return cafAudio{packetTable: packetTableHeader(header, stats)}, nil
+	}
+}
+
+// joinedLinkAudio is the audio of a link followed by the links returned by
+// next until it returns io.EOF. The pre-skip of the first link becomes the
+// priming frames and the end trimming of the last link the remainder frames.
+// A packet table cannot trim at the boundaries between links, so the whole
+// packets of a later link that lie within its pre-skip are left out, keeping
+// the 80 ms pre-roll ahead of its first sample. The rest of its pre-skip and
+// the end trimming of the link before stay part of the valid frames, which
+// a warning reports.
+func joinedLinkAudio(ogg *OggReader, header *OggHeader, next func() (*OggReader, *OggHeader, error)) audioSource {
+	return func(handle func(packet []byte, frames uint32) error) (cafAudio, error) {
+		var joined cafAudio
+		linkHeader := header
+		for link := 0; ; link++ {
+			if !linkHeader.sameChannels(header) {
+				return joined, errIncompatibleLinks
+			}
+
+			linkHandle := handle
+			droppedPackets, droppedFrames := int64(0), int64(0)
+			if link > 0 {
+				droppable := int64(linkHeader.PreSkip) - opusPreRoll
+				kept := false
+				linkHandle = func(packet []byte, frames uint32) error {
+					if !kept && droppedFrames+int64(frames) <= droppable {
+						droppedPackets++
+						droppedFrames += int64(frames)
+						return nil
+					}
+					kept = true
+					return handle(packet, frames)
+				}
+			}
+
+			stats, err := readAudioPackets(ogg, linkHandle)
+			if err != nil {
+				return joined, err
+			}
+			packetTable := packetTableHeader(linkHeader, stats)
+
+			if link == 0 {
+				joined.packetTable = packetTable
+			} else {
+				untrimmed := int64(joined.packetTable.RemainderFrames) + int64(packetTable.PrimingFrames) - droppedFrames
+				if untrimmed > 0 {
+					joined.warnings = append(joined.warnings, fmt.Sprintf("link %d: %d samples of its pre-skip and %d trimmed from the end of the link before play as audio, only whole packets can be dropped where links meet",
+						link+1, int64(packetTable.PrimingFrames)-droppedFrames, joined.packetTable.RemainderFrames))
+				}
+				joined.packetTable.NumberPackets += packetTable.NumberPackets - droppedPackets
+				joined.packetTable.NumberValidFrames += untrimmed + packetTable.NumberValidFrames
+				joined.packetTable.RemainderFrames = packetTable.RemainderFrames
+			}
+
+			ogg, linkHeader, err = next()
+			if err == io.EOF {
+				return joined, nil
+			}
+			if err != nil {
+				return joined, err
+			}
+		}
 	}
+}
+
+// audioStats describes the audio packets of an Ogg Opus stream
+type audioStats struct {
+	packets         int
+	totalFrames     int64
+	firstGranule    uint64
+	firstPageFrames int64
+	lastGranule     uint64
+	audioPages      int
+	pageFrames      int64 // Frames of the page being read
+}
 
-	// Process audio data
-	var totalBytes int64
-	packetSizes := make([]uint64, 0, 1024) // Pre-allocate slice
+func newAudioStats() audioStats {
+	return audioStats{lastGranule: unknownGranulePosition}
+}
 
+// add counts an audio packet of the given duration, the frame counts and
+// granule positions are taken when the last packet of a page comes in
+func (s *audioStats) add(packet *OggPacket, frames uint32) {
+	s.pageFrames += int64(frames)
+	s.packets++
+	if !packet.LastOnPage {
+		return
+	}
+	s.totalFrames += s.pageFrames
+	if s.audioPages == 0 {
+		s.firstGranule = packet.PageHeader.GranulePosition
+		s.firstPageFrames = s.pageFrames
+	}
+	if packet.PageHeader.GranulePosition != unknownGranulePosition {
+		s.lastGranule = packet.PageHeader.GranulePosition
+	}
+	s.pageFrames = 0
+	s.audioPages++
+}
+
+// readAudioPackets calls handle with every audio packet after the Opus headers
+// and its duration, and returns the frame counts and granule positions of the
+// audio pages
+func readAudioPackets(ogg *OggReader, handle func(packet []byte, frames uint32) error) (audioStats, error) {
+	stats := newAudioStats()
 	for {
-		segments, pageHeader, err := ogg.ParseNextPage()
+		packet, err := ogg.ReadPacket()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			return err
+			return stats, err
 		}
 
-		segment := segments[0]
-		index := pageHeader.Index
-		if index == 2 && len(segment) > 0 {
-			tmptoc := int(segment[0] & 255)
-			frameSize = CalculateFrameSize(tmptoc)
-		}
-
-		if index == 1 && bytes.HasPrefix(segment, []byte("OpusTags")) {
+		// Skip the OpusHead and OpusTags packets, however many pages they span
+		if packet.Index < opusHeaderPackets {
 			continue
 		}
 
-		if index <= 2 && bytes.HasPrefix(segment, []byte("OpusHead")) {
-			continue
+		frames, err := PacketDuration(packet.Data)
+		if err != nil {
+			return stats, err
 		}
+		if err := handle(packet.Data, frames); err != nil {
+			return stats, err
+		}
+		stats.add(packet, frames)
+	}
 
-		for _, segment := range segments {
-			segmentLen := len(segment)
-			totalBytes += int64(segmentLen)
-			packetSizes = append(packetSizes, uint64(segmentLen))
+	return stats, nil
+}
 
-			if _, err := bufferedWriter.Write(segment); err != nil {
-				return err
-			}
+// packetTableHeader works out the priming, remainder and valid frames of the
+// stream following RFC 7845: the pre-skip is trimmed from the start and the
+// granule position of the last page gives the end, relative to the granule
+// position the stream starts at.
+func packetTableHeader(header *OggHeader, stats audioStats) CAFPacketTableHeader {
+	priming := int64(header.PreSkip)
+	if priming > stats.totalFrames {
+		priming = stats.totalFrames
+	}
+	valid := stats.totalFrames - priming
+
+	if stats.lastGranule != unknownGranulePosition {
+		// A first page that ends later than the samples it holds means the
+		// stream was cut from a longer one and starts at that offset
+		startGranule := int64(0)
+		if stats.firstGranule > uint64(stats.firstPageFrames) {
+			startGranule = int64(stats.firstGranule) - stats.firstPageFrames
+		}
+		if end := int64(stats.lastGranule) - startGranule - priming; end >= 0 && end < valid {
+			valid = end
 		}
 	}
 
-	packetTableLength := calculatePacketTableLength(packetSizes)
+	return CAFPacketTableHeader{
+		NumberPackets:     int64(stats.packets),
+		NumberValidFrames: valid,
+		PrimingFrames:     int32(priming),
+		RemainderFrames:   int32(stats.totalFrames - priming - valid),
+	}
+}
+
+// writePacketTableChunk writes the pakt chunk for the given packet sizes. The
+// frame counts are only stored when they vary, as the desc chunk then has a
+// frames per packet of 0.
+func writePacketTableChunk(w io.Writer, packetSizes []uint64, frameCounts []uint64, header CAFPacketTableHeader) error {
+	if !variableFrameCounts(frameCounts) {
+		frameCounts = nil
+	}
+	packetTableLength := calculatePacketTableLength(packetSizes, frameCounts)
 
-	// Write packet table chunk
 	paktChunk := CAFChunk{
 		Header: CAFChunkHeader{ChunkType: ChunkPacketTable, ChunkSize: int64(packetTableLength)},
 		Contents: &CAFPacketTable{
-			Header: CAFPacketTableHeader{
-				NumberPackets:     int64(len(packetSizes)),
-				NumberValidFrames: int64(int(frameSize) * len(packetSizes)),
-				PrimingFrames:     0,
-				RemainderFrames:   0,
-			},
-			Entry: packetSizes,
+			Header: header,
+			Entry:  packetSizes,
+			Frames: frameCounts,
 		},
 	}
-	if err := paktChunk.Encode(bufferedWriter); err != nil {
+	return paktChunk.Encode(w)
+}
+
+func variableFrameCounts(frameCounts []uint64) bool {
+	for _, frames := range frameCounts {
+		if frames != frameCounts[0] {
+			return true
+		}
+	}
+	return false
+}
+
+func calculatePacketTableLength(packetSizes []uint64, frameCounts []uint64) int {
+	packetTableLength := 24
+
+	for _, value := range packetSizes {
+		packetTableLength += encodedIntLength(value)
+	}
+	for _, value := range frameCounts {
+		packetTableLength += encodedIntLength(value)
+	}
+	return packetTableLength
+}
+
+// encodedIntLength returns the number of bytes encodeInt writes for value
+func encodedIntLength(value uint64) int {
+	length := 1
+	for value >= 0x80 {
+		value >>= 7
+		length++
+	}
+	return length
+}
+
+func ConvertCafToOpus(inputFile string, outputFile string) error {
+	inFile, err := os.Open(inputFile)
+	if err != nil {
 		return err
 	}
+	defer inFile.Close()
 
-	// Flush the buffered writer
-	if err := bufferedWriter.Flush(); err != nil {
+	inInfo, err := inFile.Stat()
+	if err != nil {
+		return err
+	}
+	cf, err := NewCAFReader(inFile, inInfo.Size())
+	if err != nil {
 		return err
 	}
 
-	// Update frame size in audio description chunk
-	if _, err := outFile.Seek(40, io.SeekStart); err != nil {
+	desc, err := cf.AudioDescription()
+	if err == errChunkNotFound {
+		return errMissingDescChunk
+	}
+	if err != nil {
 		return err
 	}
-	if err := binary.Write(outFile, binary.BigEndian, frameSize); err != nil {
+	if desc.FormatID != NewFourByteStr("opus") {
+		return errNotOpusCaf
+	}
+	pakt, err := cf.PacketTable()
+	if err == errChunkNotFound {
+		return errMissingPacketTable
+	}
+	if err != nil {
+		return err
+	}
+	packets, err := cf.Packets()
+	if err != nil {
 		return err
 	}
 
-	// Update data chunk size
-	if _, err := outFile.Seek(int64(dataOffset + 4), io.SeekStart); err != nil {
+	outFile, err := os.Create(outputFile)
+	if err != nil {
+		return err
+	}
+	defer outFile.Close()
+
+	bufferedWriter := bufio.NewWriterSize(outFile, 32*1024)
+	ogg := NewOggWriter(bufferedWriter, rand.Uint32())
+
+	// A pre-skip holds at most 65535 samples, whole packets of a longer
+	// priming are dropped until it fits, which leaves far more than the
+	// pre-roll
+	trimmed := *pakt
+	for trimmed.Header.PrimingFrames > math.MaxUint16 {
+		packet, err := packets.Next()
+		if err == io.EOF {
+			return errPrimingOutOfRange
+		}
+		if err != nil {
+			return err
+		}
+		trimmed.Header.PrimingFrames -= int32(packet.Frames)
+	}
+
+	// Write identification header
+	header, err := cf.opusHeader(desc, &trimmed)
+	if err != nil {
+		return err
+	}
+	if err := ogg.WritePacket(header.bytes(), 0); err != nil {
 		return err
 	}
-	if err := binary.Write(outFile, binary.BigEndian, totalBytes+4); err != nil {
+	if err := ogg.Flush(); err != nil {
 		return err
 	}
 
-	return nil
-}
+	// Write comment header from the information chunk
+	var info []Information
+	infoChunk, err := cf.Information()
+	if err == nil {
+		info = infoChunk.Strings
+	} else if err != errChunkNotFound {
+		return err
+	}
+	if err := ogg.WritePacket(opusTagsFromInformation(info).bytes(), 0); err != nil {
+		return err
+	}
+	if err := ogg.Flush(); err != nil {
+		return err
+	}
 
-func calculatePacketTableLength(trailing_data []uint64) int {
-	packetTableLength := 24
+	// Write audio packets, granule positions include the pre-skip
+	priming := int64(trimmed.Header.PrimingFrames)
+	for {
+		packet, err := packets.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
 
-	for _, value := range trailing_data {
-		if value < 0x80 {
-			packetTableLength++
-		} else if value < 0x4000 {
-			packetTableLength += 2
-		} else if value < 0x200000 {
-			packetTableLength += 3
-		} else if value < 0x10000000 {
-			packetTableLength += 4
-		} else {
-			packetTableLength += 5
+		granule := priming + packet.StartFrame + int64(packet.Frames)
+		if packet.Index == len(pakt.Entry)-1 && pakt.Header.NumberValidFrames > 0 && granule > priming+pakt.Header.NumberValidFrames {
+			granule = priming + pakt.Header.NumberValidFrames
+		}
+		if err := ogg.WritePacket(packet.Data, uint64(granule)); err != nil {
+			return err
 		}
 	}
-	return packetTableLength
-}
\ No newline at end of file
+	if err := ogg.Close(); err != nil {
+		return err
+	}
+
+	return bufferedWriter.Flush()
+}
+
+// opusHeader returns the OpusHead of an Opus CAF, the priming frames are the
+// pre-skip and have to fit in one. A magic cookie holds the OpusHead of
+// multistream Opus.
+func (c *CAFReader) opusHeader(desc *CAFAudioFormat, pakt *CAFPacketTable) (*OggHeader, error) {
+	header := &OggHeader{
+		Version:    1,
+		Channels:   uint8(desc.ChannelsPerPacket),
+		SampleRate: uint32(desc.SampleRate),
+		OutputGain: 0,
+		ChannelMap: 0,
+	}
+	cookie, err := c.MagicCookie()
+	switch {
+	case err == nil:
+		if header, err = parseOpusHead(cookie); err != nil {
+			return nil, err
+		}
+	case err != errChunkNotFound:
+		return nil, err
+	case desc.ChannelsPerPacket < 1 || desc.ChannelsPerPacket > 2:
+		return nil, errUnsupportedChannels
+	}
+	if pakt.Header.PrimingFrames < 0 || pakt.Header.PrimingFrames > math.MaxUint16 {
+		return nil, errPrimingOutOfRange
+	}
+	header.PreSkip = uint16(pakt.Header.PrimingFrames)
+	return header, nil
+}
@@ -1,7 +1,11 @@
 package caf
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
 	"os"
 	"runtime"
 	"runtime/debug"
@@ -75,15 +79,33 @@ func TestBasicCafEncodingDecoding(t *testing.T) {
 
 func TestCompareCafFFMpeg(t *testing.T) {
 
+	// ffmpeg writes no priming or remainder frames, so the expected packet
+	// table headers follow the pre-skip and final granule of each input.
+	// ffmpeg also replaces the OpusTags with its own encoder string, so the
+	// expected info entries follow the comment header of each input.
 	testCases := []struct {
-		name       string
-		inputFile  string
-		outputFile string
+		name        string
+		inputFile   string
+		outputFile  string
+		packetTable CAFPacketTableHeader
+		info        []Information
 	}{
-		{"tiny", "samples/tiny.opus", "ffmpeg/tiny.caf"},
-		{"sample_mono_48000", "samples/sample_mono_48000.opus", "ffmpeg/sample_mono_48000.caf"},
-		{"sample_stereo", "samples/sample_stereo.opus", "ffmpeg/sample_stereo.caf"},
-		{"sample_large", "samples/sample_large.opus", "ffmpeg/sample_large.caf"},
+		{"tiny", "samples/tiny.opus", "ffmpeg/tiny.caf", CAFPacketTableHeader{1, 279, 312, 369}, []Information{
+			{Key: "source encoder\x00", Value: "Lavf59.16.100\x00"},
+			{Key: "encoding application\x00", Value: "Lavc59.18.100 libopus\x00"},
+		}},
+		{"sample_mono_48000", "samples/sample_mono_48000.opus", "ffmpeg/sample_mono_48000.caf", CAFPacketTableHeader{1653, 1586154, 120, 606}, []Information{
+			{Key: "source encoder\x00", Value: "Lavf59.27.100\x00"},
+			{Key: "encoding application\x00", Value: "Lavc59.37.100 opus\x00"},
+		}},
+		{"sample_stereo", "samples/sample_stereo.opus", "ffmpeg/sample_stereo.caf", CAFPacketTableHeader{6106, 5860491, 312, 957}, []Information{
+			{Key: "source encoder\x00", Value: "Lavf57.83.100\x00"},
+			{Key: "encoding application\x00", Value: "Lavc57.107.100 libopus\x00"},
+		}},
+		{"sample_large", "samples/sample_large.opus", "ffmpeg/sample_large.caf", CAFPacketTableHeader{12224, 11734215, 312, 513}, []Information{
+			{Key: "source encoder\x00", Value: "Lavf57.83.100\x00"},
+			{Key: "encoding application\x00", Value: "Lavc57.107.100 libopus\x00"},
+		}},
 	}
 
 	for _, tc := range testCases {
@@ -98,23 +120,39 @@ func TestCompareCafFFMpeg(t *testing.T) {
 				err := ConvertOpusToCaf(inputFile, outputFileCode)
 				require.NoError(t, err)
 
-				contents1, err := os.ReadFile(outputFileFFmpeg)
-				require.NoError(t, err)
-				contents2, err := os.ReadFile(outputFileCode)
-				require.NoError(t, err)
+				contents1 := decodeCafFile(t, outputFileFFmpeg)
+				contents2 := decodeCafFile(t, outputFileCode)
+
+				require.Equal(t, contents1.CAFFileHeader, contents2.CAFFileHeader)
+				require.Equal(t, len(contents1.Chunks), len(contents2.Chunks), "Chunk counts differ")
+				for i := range contents1.Chunks {
+					expected, actual := contents1.Chunks[i], contents2.Chunks[i]
+					if expected.Header.ChunkType == ChunkInformation {
+						require.Equal(t, ChunkInformation, actual.Header.ChunkType)
+						require.Equal(t, informationChunkSize(tc.info), actual.Header.ChunkSize)
+						require.Equal(t, tc.info, actual.Contents.(*CAFStringsChunk).Strings)
+						continue
+					}
+					require.Equal(t, expected.Header, actual.Header, "Chunk headers differ")
 
-				require.Equal(t, len(contents1), len(contents2), "File sizes differ")
-				if len(contents1) == len(contents2) {
-					for i := range contents1 {
-						if contents1[i] != contents2[i] {
-							t.Errorf("File contents differ at byte index %d: file1=%d, file2=%d", i, contents1[i], contents2[i])
-							break
+					switch expected.Header.ChunkType {
+					case ChunkeAudioDescription:
+						expectedDesc := *expected.Contents.(*CAFAudioFormat)
+						actualDesc := *actual.Contents.(*CAFAudioFormat)
+						// ffmpeg leaves the frames per packet at 0 when it has not probed it
+						if expectedDesc.FramesPerPacket == 0 {
+							expectedDesc.FramesPerPacket = actualDesc.FramesPerPacket
 						}
+						require.Equal(t, expectedDesc, actualDesc)
+					case ChunkPacketTable:
+						expectedPakt := expected.Contents.(*CAFPacketTable)
+						actualPakt := actual.Contents.(*CAFPacketTable)
+						require.Equal(t, expectedPakt.Entry, actualPakt.Entry, "Packet sizes differ")
+						require.Equal(t, tc.packetTable, actualPakt.Header)
+					default:
+						require.Equal(t, expected.Contents, actual.Contents, "Chunk contents differ")
 					}
-				} else {
-					require.Equal(t, contents1, contents2, "File contents differ")
 				}
-
 			})
 		})
 	}
@@ -199,3 +237,2204 @@ func TestInvalidInputFile(t *testing.T) {
 		require.Error(t, err)
 	})
 }
+
+func decodeCafFile(t *testing.T, path string) *CAFFileData {
+	contents, err := os.ReadFile(path)
+	require.NoError(t, err)
+	f := &CAFFileData{}
+	require.NoError(t, f.Decode(bytes.NewReader(contents)))
+	return f
+}
+
+func TestConvertCafToOpusRoundTrip(t *testing.T) {
+	testCases := []struct {
+		name      string
+		inputFile string
+	}{
+		{"tiny", "ffmpeg/tiny.caf"},
+		{"sample_mono_48000", "ffmpeg/sample_mono_48000.caf"},
+		{"sample_stereo", "ffmpeg/sample_stereo.caf"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			runTest(t, "TestConvertCafToOpusRoundTrip/"+tc.name, func() {
+				opusFile := "output_" + tc.name + ".opus"
+				cafFile := "output_" + tc.name + "_roundtrip.caf"
+				defer os.Remove(opusFile)
+				defer os.Remove(cafFile)
+
+				require.NoError(t, ConvertCafToOpus(tc.inputFile, opusFile))
+				require.NoError(t, ConvertOpusToCaf(opusFile, cafFile))
+
+				original := decodeCafFile(t, tc.inputFile)
+				roundTrip := decodeCafFile(t, cafFile)
+
+				originalData := original.findChunk(ChunkAudioData).Contents.(*DataX)
+				roundTripData := roundTrip.findChunk(ChunkAudioData).Contents.(*DataX)
+				require.Equal(t, originalData.Bytes, roundTripData.Bytes)
+
+				originalPakt := original.findChunk(ChunkPacketTable).Contents.(*CAFPacketTable)
+				roundTripPakt := roundTrip.findChunk(ChunkPacketTable).Contents.(*CAFPacketTable)
+				require.Equal(t, originalPakt.Entry, roundTripPakt.Entry)
+
+				originalDesc := original.findChunk(ChunkeAudioDescription).Contents.(*CAFAudioFormat)
+				roundTripDesc := roundTrip.findChunk(ChunkeAudioDescription).Contents.(*CAFAudioFormat)
+				require.Equal(t, originalDesc.ChannelsPerPacket, roundTripDesc.ChannelsPerPacket)
+			})
+		})
+	}
+}
+
+func TestOggWriterPageCRC(t *testing.T) {
+	out := &bytes.Buffer{}
+	ogg := NewOggWriter(out, 1234)
+	require.NoError(t, ogg.WritePacket(bytes.Repeat([]byte{0xfc}, 70000), 960))
+	require.NoError(t, ogg.Close())
+
+	// Every page checksum must match the one computed with the CRC field zeroed
+	contents := out.Bytes()
+	pages := 0
+	for len(contents) > 0 {
+		require.Equal(t, pageHeaderSignature, string(contents[:4]))
+		segmentsCount := int(contents[26])
+		size := pageHeaderLen + segmentsCount
+		for _, lacing := range contents[pageHeaderLen:size] {
+			size += int(lacing)
+		}
+		page := append([]byte(nil), contents[:size]...)
+		expected := binary.LittleEndian.Uint32(page[22:26])
+		binary.LittleEndian.PutUint32(page[22:26], 0)
+		require.Equal(t, expected, oggCRC32(0, page))
+		contents = contents[size:]
+		pages++
+	}
+	require.Equal(t, 2, pages)
+}
+
+func TestOggWriterPacketBoundaries(t *testing.T) {
+	header := OggHeader{Version: 1, Channels: 1, SampleRate: 48000}
+	out := &bytes.Buffer{}
+	ogg := NewOggWriter(out, 1)
+	require.NoError(t, ogg.WritePacket(header.bytes(), 0))
+	require.NoError(t, ogg.Flush())
+	require.NoError(t, ogg.WritePacket(encodeOpusTags(defaultOpusVendor, nil), 0))
+	require.NoError(t, ogg.Flush())
+
+	// 255 tiny packets fill the first page right at a packet boundary, the
+	// long packet in the middle of the second page runs into the third
+	var packets [][]byte
+	for i := 0; i < 400; i++ {
+		packets = append(packets, []byte{31 << 3, byte(i), byte(i >> 8)})
+		if i == 255+100-1 {
+			packets = append(packets, bytes.Repeat([]byte{0xfc}, 255*200))
+		}
+	}
+	for i, packet := range packets {
+		require.NoError(t, ogg.WritePacket(packet, uint64(i+1)*960))
+	}
+	require.NoError(t, ogg.Close())
+
+	reader, _, err := NewWith(bytes.NewReader(out.Bytes()))
+	require.NoError(t, err)
+	var read [][]byte
+	for {
+		packet, err := reader.ReadPacket()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		if packet.Index >= opusHeaderPackets {
+			read = append(read, append([]byte(nil), packet.Data...))
+		}
+	}
+	require.Equal(t, packets, read)
+}
+
+func TestConvertOpusToCafStream(t *testing.T) {
+	testCases := []struct {
+		name      string
+		inputFile string
+	}{
+		{"sample_mono_48000", "samples/sample_mono_48000.opus"},
+		{"sample_stereo", "samples/sample_stereo.opus"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			runTest(t, "TestConvertOpusToCafStream/"+tc.name, func() {
+				outputFile := "output_" + tc.name + ".caf"
+				defer os.Remove(outputFile)
+				require.NoError(t, ConvertOpusToCaf(tc.inputFile, outputFile))
+
+				input, err := os.Open(tc.inputFile)
+				require.NoError(t, err)
+				defer input.Close()
+
+				// bytes.Buffer cannot seek, so pakt must come before a data chunk of size -1
+				output := &bytes.Buffer{}
+				require.NoError(t, ConvertOpusToCafStream(input, output))
+
+				streamed := &CAFFileData{}
+				require.NoError(t, streamed.Decode(bytes.NewReader(output.Bytes())))
+				seeked := decodeCafFile(t, outputFile)
+
+				var chunkTypes []string
+				for _, c := range streamed.Chunks {
+					chunkTypes = append(chunkTypes, string(c.Header.ChunkType[:]))
+				}
+				require.Equal(t, []string{"desc", "chan", "info", "pakt", "data"}, chunkTypes)
+				require.Equal(t, int64(-1), streamed.findChunk(ChunkAudioData).Header.ChunkSize)
+
+				require.Equal(t, seeked.findChunk(ChunkeAudioDescription).Contents, streamed.findChunk(ChunkeAudioDescription).Contents)
+				require.Equal(t, seeked.findChunk(ChunkPacketTable).Contents, streamed.findChunk(ChunkPacketTable).Contents)
+				require.Equal(t, seeked.findChunk(ChunkAudioData).Contents, streamed.findChunk(ChunkAudioData).Contents)
+			})
+		})
+	}
+}
+
+// writeTrimmedOpus writes the packets of a CAF into an Ogg Opus file with the
+// given pre-skip, end trimming and granule position of the first sample
+func writeTrimmedOpus(t *testing.T, path string, source *CAFFileData, preSkip uint16, endTrim uint64, startGranule uint64) {
+	data := source.findChunk(ChunkAudioData).Contents.(*DataX).Bytes
+	pakt := source.findChunk(ChunkPacketTable).Contents.(*CAFPacketTable)
+	desc := source.findChunk(ChunkeAudioDescription).Contents.(*CAFAudioFormat)
+
+	out := &bytes.Buffer{}
+	ogg := NewOggWriter(out, 1)
+	header := OggHeader{Version: 1, Channels: uint8(desc.ChannelsPerPacket), PreSkip: preSkip, SampleRate: 48000}
+	require.NoError(t, ogg.WritePacket(header.bytes(), 0))
+	require.NoError(t, ogg.Flush())
+	require.NoError(t, ogg.WritePacket(encodeOpusTags(defaultOpusVendor, nil), 0))
+	require.NoError(t, ogg.Flush())
+
+	total := uint64(desc.FramesPerPacket) * uint64(len(pakt.Entry))
+	offset := uint64(0)
+	for i, size := range pakt.Entry {
+		granule := startGranule + uint64(i+1)*uint64(desc.FramesPerPacket)
+		if i == len(pakt.Entry)-1 {
+			granule = startGranule + total - endTrim
+		}
+		require.NoError(t, ogg.WritePacket(data[offset:offset+size], granule))
+		offset += size
+	}
+	require.NoError(t, ogg.Close())
+	require.NoError(t, os.WriteFile(path, out.Bytes(), 0o644))
+}
+
+func TestConversionOfTrimmedFiles(t *testing.T) {
+	source := decodeCafFile(t, "ffmpeg/sample_mono_48000.caf")
+	packets := int64(len(source.findChunk(ChunkPacketTable).Contents.(*CAFPacketTable).Entry))
+	total := packets * 960
+
+	testCases := []struct {
+		name         string
+		preSkip      uint16
+		endTrim      uint64
+		startGranule uint64
+		expected     CAFPacketTableHeader
+	}{
+		{"no_trim", 0, 0, 0, CAFPacketTableHeader{packets, total, 0, 0}},
+		{"long_pre_skip", 3840, 0, 0, CAFPacketTableHeader{packets, total - 3840, 3840, 0}},
+		{"end_trim", 312, 700, 0, CAFPacketTableHeader{packets, total - 312 - 700, 312, 700}},
+		{"start_offset", 312, 100, 480000, CAFPacketTableHeader{packets, total - 312 - 100, 312, 100}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			inputFile := "output_trimmed_" + tc.name + ".opus"
+			outputFile := "output_trimmed_" + tc.name + ".caf"
+			defer os.Remove(inputFile)
+			defer os.Remove(outputFile)
+
+			writeTrimmedOpus(t, inputFile, source, tc.preSkip, tc.endTrim, tc.startGranule)
+			require.NoError(t, ConvertOpusToCaf(inputFile, outputFile))
+
+			pakt := decodeCafFile(t, outputFile).findChunk(ChunkPacketTable).Contents.(*CAFPacketTable)
+			require.Equal(t, tc.expected, pakt.Header)
+		})
+	}
+}
+
+func TestPacketDuration(t *testing.T) {
+	testCases := []struct {
+		name     string
+		packet   []byte
+		expected uint32
+	}{
+		{"silk_nb_10ms", []byte{0 << 3}, 480},
+		{"silk_wb_20ms", []byte{9 << 3}, 960},
+		{"silk_mb_40ms", []byte{6 << 3}, 1920},
+		{"silk_nb_60ms", []byte{3 << 3}, 2880},
+		{"hybrid_fb_10ms", []byte{14 << 3}, 480},
+		{"celt_fb_2_5ms", []byte{28 << 3}, 120},
+		{"celt_fb_20ms", []byte{31 << 3}, 960},
+		{"two_equal_frames", []byte{31<<3 | 1}, 1920},
+		{"two_different_frames", []byte{30<<3 | 2}, 960},
+		{"three_arbitrary_frames", []byte{31<<3 | 3, 3}, 2880},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			duration, err := PacketDuration(tc.packet)
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, duration)
+		})
+	}
+
+	_, err := PacketDuration(nil)
+	require.Error(t, err)
+	_, err = PacketDuration([]byte{31<<3 | 3})
+	require.Error(t, err)
+	_, err = PacketDuration([]byte{3<<3 | 3, 3})
+	require.Error(t, err, "packets longer than 120 ms are invalid")
+	_, err = PacketDuration([]byte{31<<3 | 3, 0})
+	require.ErrorIs(t, err, errZeroFrameCount)
+}
+
+func TestPacketTableForms(t *testing.T) {
+	encode := func(desc CAFAudioFormat, pakt CAFPacketTable, size int64) []byte {
+		cf := CAFFileData{
+			CAFFileHeader: CAFFileHeader{FileType: NewFourByteStr("caff"), FileVersion: 1},
+			Chunks: []CAFChunk{
+				{Header: CAFChunkHeader{ChunkType: ChunkeAudioDescription, ChunkSize: 32}, Contents: &desc},
+				{Header: CAFChunkHeader{ChunkType: ChunkPacketTable, ChunkSize: size}, Contents: &pakt},
+			},
+		}
+		out := &bytes.Buffer{}
+		require.NoError(t, cf.Encode(out))
+		return out.Bytes()
+	}
+	header := CAFPacketTableHeader{NumberPackets: 3, NumberValidFrames: 30}
+	opus := CAFAudioFormat{SampleRate: 48000, FormatID: NewFourByteStr("opus"), ChannelsPerPacket: 1}
+
+	// The desc chunk says which values the table holds
+	testCases := []struct {
+		name   string
+		desc   CAFAudioFormat
+		entry  []uint64
+		frames []uint64
+	}{
+		{"sizes_and_frames", opus, []uint64{3, 200, 5}, []uint64{960, 480, 960}},
+		{"sizes", CAFAudioFormat{SampleRate: 48000, FormatID: NewFourByteStr("opus"), FramesPerPacket: 960, ChannelsPerPacket: 1}, []uint64{3, 200, 5}, nil},
+		{"frames", CAFAudioFormat{SampleRate: 48000, FormatID: NewFourByteStr("test"), BytesPerPacket: 4, ChannelsPerPacket: 1}, nil, []uint64{10, 300, 10}},
+		{"constant", CAFAudioFormat{SampleRate: 48000, FormatID: NewFourByteStr("lpcm"), BytesPerPacket: 4, FramesPerPacket: 1, ChannelsPerPacket: 1}, nil, nil},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			pakt := CAFPacketTable{Header: header, Entry: tc.entry, Frames: tc.frames}
+			contents := encode(tc.desc, pakt, int64(calculatePacketTableLength(tc.entry, tc.frames)))
+			cf := decodeCafBytes(t, contents)
+			require.Equal(t, &pakt, cf.findChunk(ChunkPacketTable).Contents)
+
+			reader, err := NewCAFReader(bytes.NewReader(contents), int64(len(contents)))
+			require.NoError(t, err)
+			read, err := reader.PacketTable()
+			require.NoError(t, err)
+			require.Equal(t, &pakt, read)
+		})
+	}
+
+	// Packets of a constant size take their durations from the table
+	frames := CAFAudioFormat{SampleRate: 48000, FormatID: NewFourByteStr("test"), BytesPerPacket: 4, ChannelsPerPacket: 1}
+	packets, err := NewCAFPacketIterator(&frames, &CAFPacketTable{Header: header, Frames: []uint64{10, 300, 10}}, bytes.NewReader(make([]byte, 12)), 12)
+	require.NoError(t, err)
+	var durations []uint32
+	for {
+		packet, err := packets.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		durations = append(durations, packet.Frames)
+	}
+	require.Equal(t, []uint32{10, 300, 10}, durations)
+
+	// ffmpeg leaves the frame counts out when desc has no frames per packet
+	pakt := CAFPacketTable{Header: header, Entry: []uint64{3, 200, 5}}
+	cf := decodeCafBytes(t, encode(opus, pakt, int64(calculatePacketTableLength(pakt.Entry, nil))))
+	require.Equal(t, &pakt, cf.findChunk(ChunkPacketTable).Contents)
+
+	// Damaged chunk sizes fail instead of allocating what they claim
+	for _, size := range []int64{0, 23, 1 << 40} {
+		decoded := &CAFFileData{}
+		err := decoded.Decode(bytes.NewReader(encode(opus, pakt, size)))
+		require.Error(t, err, "chunk size %d", size)
+	}
+	decoded := &CAFFileData{}
+	require.ErrorIs(t, decoded.Decode(bytes.NewReader(encode(opus, pakt, 10))), errBadPacketTableSize)
+	// Too few values for the packets
+	short := encode(opus, CAFPacketTable{Header: header, Entry: []uint64{3, 200}}, int64(calculatePacketTableLength([]uint64{3, 200}, nil)))
+	require.ErrorIs(t, decoded.Decode(bytes.NewReader(short)), io.ErrUnexpectedEOF)
+}
+
+func TestConversionWithVariableFrameDurations(t *testing.T) {
+	packets := [][]byte{
+		append([]byte{31 << 3}, bytes.Repeat([]byte{1}, 40)...),
+		append([]byte{30 << 3}, bytes.Repeat([]byte{2}, 20)...),
+		append([]byte{31<<3 | 3, 3}, bytes.Repeat([]byte{3}, 120)...),
+		append([]byte{15<<3 | 1}, bytes.Repeat([]byte{4}, 300)...),
+	}
+	frames := []uint64{960, 480, 2880, 1920}
+
+	out := &bytes.Buffer{}
+	ogg := NewOggWriter(out, 1)
+	header := OggHeader{Version: 1, Channels: 2, PreSkip: 312, SampleRate: 48000}
+	require.NoError(t, ogg.WritePacket(header.bytes(), 0))
+	require.NoError(t, ogg.Flush())
+	require.NoError(t, ogg.WritePacket(encodeOpusTags(defaultOpusVendor, nil), 0))
+	require.NoError(t, ogg.Flush())
+	granule := uint64(0)
+	for i, packet := range packets {
+		granule += frames[i]
+		require.NoError(t, ogg.WritePacket(packet, granule))
+	}
+	require.NoError(t, ogg.Close())
+
+	inputFile := "output_variable.opus"
+	outputFile := "output_variable.caf"
+	roundTripFile := "output_variable_roundtrip.opus"
+	defer os.Remove(inputFile)
+	defer os.Remove(outputFile)
+	defer os.Remove(roundTripFile)
+	require.NoError(t, os.WriteFile(inputFile, out.Bytes(), 0o644))
+
+	require.NoError(t, ConvertOpusToCaf(inputFile, outputFile))
+	f := decodeCafFile(t, outputFile)
+	desc := f.findChunk(ChunkeAudioDescription).Contents.(*CAFAudioFormat)
+	require.Equal(t, uint32(0), desc.FramesPerPacket)
+	pakt := f.findChunk(ChunkPacketTable).Contents.(*CAFPacketTable)
+	require.Equal(t, []uint64{41, 21, 122, 301}, pakt.Entry)
+	require.Equal(t, frames, pakt.Frames)
+	require.Equal(t, CAFPacketTableHeader{4, 6240 - 312, 312, 0}, pakt.Header)
+
+	// Going back to Ogg must keep the per packet durations in the granule positions
+	require.NoError(t, ConvertCafToOpus(outputFile, roundTripFile))
+	require.NoError(t, ConvertOpusToCaf(roundTripFile, outputFile))
+	roundTrip := decodeCafFile(t, outputFile).findChunk(ChunkPacketTable).Contents.(*CAFPacketTable)
+	require.Equal(t, pakt, roundTrip)
+
+	// Priming beyond a pre-skip loses whole packets until it fits
+	writePrimed := func(priming int32) {
+		outFile, err := os.Create(outputFile)
+		require.NoError(t, err)
+		defer outFile.Close()
+		cw, err := NewCAFWriter(outFile, opusAudioFormat(&OggHeader{Channels: 1}))
+		require.NoError(t, err)
+		for i := 0; i < 100; i++ {
+			require.NoError(t, cw.WritePacket([]byte{31 << 3, byte(i)}, 960))
+		}
+		cw.SetTrim(priming, 0)
+		require.NoError(t, cw.Close())
+	}
+	writePrimed(70000)
+	require.NoError(t, ConvertCafToOpus(outputFile, roundTripFile))
+	contents, err := os.ReadFile(roundTripFile)
+	require.NoError(t, err)
+	_, oggHeader, err := NewWith(bytes.NewReader(contents))
+	require.NoError(t, err)
+	require.Equal(t, uint16(70000-5*960), oggHeader.PreSkip)
+	require.NoError(t, ConvertOpusToCaf(roundTripFile, outputFile))
+	roundTrip = decodeCafFile(t, outputFile).findChunk(ChunkPacketTable).Contents.(*CAFPacketTable)
+	require.Equal(t, CAFPacketTableHeader{95, 100*960 - 70000, 70000 - 5*960, 0}, roundTrip.Header)
+
+	writePrimed(-1)
+	require.ErrorIs(t, ConvertCafToOpus(outputFile, roundTripFile), errPrimingOutOfRange)
+}
+
+func TestConversionWithPacketsAcrossPages(t *testing.T) {
+	// Cover art makes the OpusTags packet span several pages
+	coverArt := "METADATA_BLOCK_PICTURE=" + string(bytes.Repeat([]byte{'A'}, 200000))
+	packets := [][]byte{
+		append([]byte{31 << 3}, bytes.Repeat([]byte{1}, 100)...),
+		append([]byte{31 << 3}, bytes.Repeat([]byte{2}, 70000)...),
+		append([]byte{31 << 3}, bytes.Repeat([]byte{3}, 254)...),
+		append([]byte{31 << 3}, bytes.Repeat([]byte{4}, 65024)...),
+		append([]byte{31 << 3}, bytes.Repeat([]byte{5}, 10)...),
+	}
+
+	out := &bytes.Buffer{}
+	ogg := NewOggWriter(out, 1)
+	header := OggHeader{Version: 1, Channels: 1, SampleRate: 48000}
+	require.NoError(t, ogg.WritePacket(header.bytes(), 0))
+	require.NoError(t, ogg.Flush())
+	require.NoError(t, ogg.WritePacket(encodeOpusTags(defaultOpusVendor, []string{coverArt}), 0))
+	require.NoError(t, ogg.Flush())
+	for i, packet := range packets {
+		require.NoError(t, ogg.WritePacket(packet, uint64(i+1)*960))
+	}
+	require.NoError(t, ogg.Close())
+
+	reader, _, err := NewWith(bytes.NewReader(out.Bytes()))
+	require.NoError(t, err)
+	tags, err := reader.ReadPacket()
+	require.NoError(t, err)
+	require.Equal(t, 1, tags.Index)
+	require.True(t, bytes.HasPrefix(tags.Data, []byte(commentPageSignature)))
+	require.True(t, tags.PageHeader.Index > 2, "tags should span several pages")
+	for i, expected := range packets {
+		packet, err := reader.ReadPacket()
+		require.NoError(t, err)
+		require.Equal(t, i+2, packet.Index)
+		require.Equal(t, expected, packet.Data)
+	}
+
+	output := &bytes.Buffer{}
+	require.NoError(t, ConvertOpusToCafStream(bytes.NewReader(out.Bytes()), output))
+	f := &CAFFileData{}
+	require.NoError(t, f.Decode(bytes.NewReader(output.Bytes())))
+	pakt := f.findChunk(ChunkPacketTable).Contents.(*CAFPacketTable)
+	require.Equal(t, []uint64{101, 70001, 255, 65025, 11}, pakt.Entry)
+	require.Equal(t, bytes.Join(packets, nil), f.findChunk(ChunkAudioData).Contents.(*DataX).Bytes)
+}
+
+func TestConversionWithCorruptedPage(t *testing.T) {
+	contents, err := os.ReadFile("samples/sample_mono_48000.opus")
+	require.NoError(t, err)
+
+	// Flip a byte in the body of the fifth page
+	offset := 0
+	for page := 0; page < 4; page++ {
+		segmentsCount := int(contents[offset+26])
+		size := pageHeaderLen + segmentsCount
+		for _, lacing := range contents[offset+pageHeaderLen : offset+pageHeaderLen+segmentsCount] {
+			size += int(lacing)
+		}
+		offset += size
+	}
+	corrupted := append([]byte(nil), contents...)
+	corrupted[offset+100] ^= 0xff
+
+	_, err = ConvertOpusToCafStreamWithOptions(bytes.NewReader(corrupted), &bytes.Buffer{}, ConvertOptions{})
+	var crcErr *OggCRCError
+	require.ErrorAs(t, err, &crcErr)
+	require.Equal(t, uint32(4), crcErr.PageSequence)
+	require.Equal(t, int64(offset), crcErr.Offset)
+
+	output := &bytes.Buffer{}
+	report, err := ConvertOpusToCafStreamWithOptions(bytes.NewReader(corrupted), output, ConvertOptions{Lenient: true})
+	require.NoError(t, err)
+	require.Len(t, report.BadPages, 1)
+	require.Equal(t, uint32(4), report.BadPages[0].PageSequence)
+	require.Len(t, report.Skipped, 1)
+	require.Equal(t, int64(offset), report.Skipped[0].Offset)
+
+	// The 50 packets of the damaged page are missing from the output
+	f := &CAFFileData{}
+	require.NoError(t, f.Decode(bytes.NewReader(output.Bytes())))
+	pakt := f.findChunk(ChunkPacketTable).Contents.(*CAFPacketTable)
+	require.Equal(t, int64(1653-50), pakt.Header.NumberPackets)
+}
+
+func TestConversionWithGarbageInput(t *testing.T) {
+	contents, err := os.ReadFile("samples/sample_stereo.opus")
+	require.NoError(t, err)
+	expected := &bytes.Buffer{}
+	require.NoError(t, ConvertOpusToCafStream(bytes.NewReader(contents), expected))
+
+	// An ID3 tag in front of the first page, holding a false capture pattern
+	prefix := append([]byte("ID3\x04\x00\x00"), bytes.Repeat([]byte{0x42}, 1000)...)
+	prefix = append(prefix, []byte("OggS\x00\x02 not a page")...)
+	// Chunk framing left between two pages by a broken HTTP client
+	firstPages := 0
+	for page := 0; page < 3; page++ {
+		segmentsCount := int(contents[firstPages+26])
+		size := pageHeaderLen + segmentsCount
+		for _, lacing := range contents[firstPages+pageHeaderLen : firstPages+pageHeaderLen+segmentsCount] {
+			size += int(lacing)
+		}
+		firstPages += size
+	}
+	chunkHeader := []byte("\r\n1000\r\n")
+
+	input := append([]byte(nil), prefix...)
+	input = append(input, contents[:firstPages]...)
+	input = append(input, chunkHeader...)
+	input = append(input, contents[firstPages:]...)
+
+	output := &bytes.Buffer{}
+	report, err := ConvertOpusToCafStreamWithOptions(bytes.NewReader(input), output, ConvertOptions{})
+	require.NoError(t, err)
+	require.Equal(t, expected.Bytes(), output.Bytes())
+	require.Empty(t, report.BadPages)
+	require.Equal(t, []SkippedBytes{
+		{Offset: 0, Length: int64(len(prefix))},
+		{Offset: int64(len(prefix) + firstPages), Length: int64(len(chunkHeader))},
+	}, report.Skipped)
+	require.Equal(t, int64(len(prefix)+len(chunkHeader)), report.SkippedByteCount())
+}
+
+// encodeTestOpus returns an Ogg Opus stream holding 20 ms packets of the
+// given sizes, each filled with fill, with the last packet trimmed by endTrim
+func encodeTestOpus(t *testing.T, serial uint32, header OggHeader, sizes []int, fill byte, endTrim uint64) []byte {
+	out := &bytes.Buffer{}
+	ogg := NewOggWriter(out, serial)
+	require.NoError(t, ogg.WritePacket(header.bytes(), 0))
+	require.NoError(t, ogg.Flush())
+	require.NoError(t, ogg.WritePacket(encodeOpusTags(defaultOpusVendor, nil), 0))
+	require.NoError(t, ogg.Flush())
+	for i, size := range sizes {
+		granule := uint64(i+1) * 960
+		if i == len(sizes)-1 {
+			granule -= endTrim
+		}
+		packet := append([]byte{31 << 3}, bytes.Repeat([]byte{fill}, size-1)...)
+		require.NoError(t, ogg.WritePacket(packet, granule))
+	}
+	require.NoError(t, ogg.Close())
+	return out.Bytes()
+}
+
+// splitOggPages returns the pages of an Ogg stream
+func splitOggPages(contents []byte) [][]byte {
+	var pages [][]byte
+	for len(contents) > 0 {
+		segmentsCount := int(contents[26])
+		size := pageHeaderLen + segmentsCount
+		for _, lacing := range contents[pageHeaderLen : pageHeaderLen+segmentsCount] {
+			size += int(lacing)
+		}
+		pages = append(pages, contents[:size])
+		contents = contents[size:]
+	}
+	return pages
+}
+
+func decodeCafBytes(t *testing.T, contents []byte) *CAFFileData {
+	f := &CAFFileData{}
+	require.NoError(t, f.Decode(bytes.NewReader(contents)))
+	return f
+}
+
+func TestConversionOfChainedFile(t *testing.T) {
+	header := OggHeader{Version: 1, Channels: 2, PreSkip: 312, SampleRate: 48000}
+	first := encodeTestOpus(t, 1, header, []int{10, 20, 30}, 1, 100)
+	second := encodeTestOpus(t, 2, header, []int{40, 50}, 2, 200)
+	chained := append(append([]byte(nil), first...), second...)
+
+	output := &bytes.Buffer{}
+	require.NoError(t, ConvertOpusToCafStream(bytes.NewReader(chained), output))
+	pakt := decodeCafBytes(t, output.Bytes()).findChunk(ChunkPacketTable).Contents.(*CAFPacketTable)
+	require.Equal(t, []uint64{10, 20, 30}, pakt.Entry)
+	require.Equal(t, CAFPacketTableHeader{3, 3*960 - 312 - 100, 312, 100}, pakt.Header)
+
+	output.Reset()
+	_, err := ConvertOpusToCafStreamWithOptions(bytes.NewReader(chained), output, ConvertOptions{Chain: ChainJoin})
+	require.NoError(t, err)
+	joined := decodeCafBytes(t, output.Bytes())
+	pakt = joined.findChunk(ChunkPacketTable).Contents.(*CAFPacketTable)
+	require.Equal(t, []uint64{10, 20, 30, 40, 50}, pakt.Entry)
+	require.Equal(t, CAFPacketTableHeader{5, 5*960 - 312 - 200, 312, 200}, pakt.Header)
+	require.Len(t, joined.findChunk(ChunkAudioData).Contents.(*DataX).Bytes, 150)
+
+	// The whole packets of a long pre-skip are dropped where links meet,
+	// bar the 80 ms pre-roll, and the rest plays with a warning
+	longPreSkip := OggHeader{Version: 1, Channels: 2, PreSkip: opusPreRoll + 2*960 + 100, SampleRate: 48000}
+	third := encodeTestOpus(t, 3, longPreSkip, []int{40, 50, 60, 70, 80, 90, 100, 110}, 3, 200)
+	output.Reset()
+	report, err := ConvertOpusToCafStreamWithOptions(bytes.NewReader(append(append([]byte(nil), first...), third...)), output, ConvertOptions{Chain: ChainJoin})
+	require.NoError(t, err)
+	pakt = decodeCafBytes(t, output.Bytes()).findChunk(ChunkPacketTable).Contents.(*CAFPacketTable)
+	require.Equal(t, []uint64{10, 20, 30, 60, 70, 80, 90, 100, 110}, pakt.Entry)
+	untrimmed := int64(longPreSkip.PreSkip) - 2*960
+	require.Equal(t, CAFPacketTableHeader{9, (3*960 - 312 - 100) + 100 + untrimmed + (8*960 - 200 - int64(longPreSkip.PreSkip)), 312, 200}, pakt.Header)
+	require.Equal(t, int64(9*960-312-200), pakt.Header.NumberValidFrames)
+	require.Len(t, report.Warnings, 1)
+	require.Contains(t, report.Warnings[0], fmt.Sprintf("link 2: %d samples of its pre-skip and 100", untrimmed))
+
+	inputFile := "output_chained.opus"
+	defer os.Remove(inputFile)
+	require.NoError(t, os.WriteFile(inputFile, chained, 0o644))
+	outputFiles, _, err := SplitOpusLinksToCaf(inputFile, "output_chained.caf", ConvertOptions{})
+	for _, file := range outputFiles {
+		defer os.Remove(file)
+	}
+	require.NoError(t, err)
+	require.Equal(t, []string{"output_chained_1.caf", "output_chained_2.caf"}, outputFiles)
+	pakt = decodeCafFile(t, outputFiles[1]).findChunk(ChunkPacketTable).Contents.(*CAFPacketTable)
+	require.Equal(t, []uint64{40, 50}, pakt.Entry)
+	require.Equal(t, CAFPacketTableHeader{2, 2*960 - 312 - 200, 312, 200}, pakt.Header)
+
+	// Links with different channel counts cannot share a CAF
+	mono := encodeTestOpus(t, 3, OggHeader{Version: 1, Channels: 1, SampleRate: 48000}, []int{10}, 3, 0)
+	mismatched := append(append([]byte(nil), first...), mono...)
+	_, err = ConvertOpusToCafStreamWithOptions(bytes.NewReader(mismatched), &bytes.Buffer{}, ConvertOptions{Chain: ChainJoin})
+	require.ErrorIs(t, err, errIncompatibleLinks)
+}
+
+func TestConversionOfMultiplexedFile(t *testing.T) {
+	header := OggHeader{Version: 1, Channels: 2, SampleRate: 48000}
+	firstPages := splitOggPages(encodeTestOpus(t, 20, header, []int{10, 20, 30}, 1, 0))
+	secondPages := splitOggPages(encodeTestOpus(t, 30, header, []int{40, 50, 60}, 2, 0))
+
+	skeleton := &bytes.Buffer{}
+	skeletonWriter := NewOggWriter(skeleton, 10)
+	require.NoError(t, skeletonWriter.WritePacket([]byte("fishead\x00 skeleton"), 0))
+	require.NoError(t, skeletonWriter.Close())
+
+	// All beginning of stream pages come first, then the pages interleave
+	var multiplexed []byte
+	multiplexed = append(multiplexed, skeleton.Bytes()...)
+	for i := range firstPages {
+		multiplexed = append(multiplexed, firstPages[i]...)
+		multiplexed = append(multiplexed, secondPages[i]...)
+	}
+
+	ogg, _, err := NewWith(bytes.NewReader(multiplexed))
+	require.NoError(t, err)
+	require.Len(t, ogg.Streams(), 3)
+	require.False(t, ogg.Streams()[0].IsOpus())
+	require.Equal(t, uint32(20), ogg.Serial())
+
+	output := &bytes.Buffer{}
+	require.NoError(t, ConvertOpusToCafStream(bytes.NewReader(multiplexed), output))
+	pakt := decodeCafBytes(t, output.Bytes()).findChunk(ChunkPacketTable).Contents.(*CAFPacketTable)
+	require.Equal(t, []uint64{10, 20, 30}, pakt.Entry)
+
+	serial := uint32(30)
+	output.Reset()
+	_, err = ConvertOpusToCafStreamWithOptions(bytes.NewReader(multiplexed), output, ConvertOptions{Serial: &serial})
+	require.NoError(t, err)
+	pakt = decodeCafBytes(t, output.Bytes()).findChunk(ChunkPacketTable).Contents.(*CAFPacketTable)
+	require.Equal(t, []uint64{40, 50, 60}, pakt.Entry)
+
+	serial = 10
+	_, err = ConvertOpusToCafStreamWithOptions(bytes.NewReader(multiplexed), &bytes.Buffer{}, ConvertOptions{Serial: &serial})
+	require.Error(t, err, "the skeleton stream is not Opus")
+	serial = 99
+	_, err = ConvertOpusToCafStreamWithOptions(bytes.NewReader(multiplexed), &bytes.Buffer{}, ConvertOptions{Serial: &serial})
+	require.ErrorIs(t, err, errStreamNotFound)
+}
+
+func TestConversionOfMultichannelFiles(t *testing.T) {
+	// Stream and coupled counts libopus uses for the Vorbis channel orders
+	testCases := []struct {
+		name     string
+		header   OggHeader
+		expected uint32
+	}{
+		{"3.0", OggHeader{Channels: 3, ChannelMap: 1, StreamCount: 2, CoupledCount: 1, ChannelMapping: []uint8{0, 2, 1}}, kCAFChannelLayoutTag_Ogg_3_0},
+		{"quad", OggHeader{Channels: 4, ChannelMap: 1, StreamCount: 2, CoupledCount: 2, ChannelMapping: []uint8{0, 1, 2, 3}}, kCAFChannelLayoutTag_Ogg_4_0},
+		{"5.0", OggHeader{Channels: 5, ChannelMap: 1, StreamCount: 3, CoupledCount: 2, ChannelMapping: []uint8{0, 4, 1, 2, 3}}, kCAFChannelLayoutTag_Ogg_5_0},
+		{"5.1", OggHeader{Channels: 6, ChannelMap: 1, StreamCount: 4, CoupledCount: 2, ChannelMapping: []uint8{0, 4, 1, 2, 3, 5}}, kCAFChannelLayoutTag_Ogg_5_1},
+		{"6.1", OggHeader{Channels: 7, ChannelMap: 1, StreamCount: 4, CoupledCount: 3, ChannelMapping: []uint8{0, 4, 1, 2, 3, 5, 6}}, kCAFChannelLayoutTag_Ogg_6_1},
+		{"7.1", OggHeader{Channels: 8, ChannelMap: 1, StreamCount: 5, CoupledCount: 3, ChannelMapping: []uint8{0, 6, 1, 2, 3, 4, 5, 7}}, kCAFChannelLayoutTag_Ogg_7_1},
+		{"discrete", OggHeader{Channels: 3, ChannelMap: 255, StreamCount: 3, CoupledCount: 0, ChannelMapping: []uint8{0, 1, 255}}, kCAFChannelLayoutTag_DiscreteInOrder | 3},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			header := tc.header
+			header.Version = 1
+			header.PreSkip = 312
+			header.SampleRate = 48000
+			input := encodeTestOpus(t, 1, header, []int{100, 200}, 1, 0)
+
+			output := &bytes.Buffer{}
+			require.NoError(t, ConvertOpusToCafStream(bytes.NewReader(input), output))
+			f := decodeCafBytes(t, output.Bytes())
+
+			desc := f.findChunk(ChunkeAudioDescription).Contents.(*CAFAudioFormat)
+			require.Equal(t, uint32(header.Channels), desc.ChannelsPerPacket)
+			chanChunk := f.findChunk(ChunkChannelLayout)
+			require.Equal(t, tc.expected, chanChunk.Contents.(*CAFChannelLayout).ChannelLayoutTag)
+			require.Equal(t, int64(12), chanChunk.Header.ChunkSize)
+			kuki := f.findChunk(ChunkMagicCookie)
+			require.NotNil(t, kuki)
+			require.Equal(t, header.bytes(), kuki.Contents.(*UnknownContents).Data)
+
+			// The magic cookie brings the mapping table back when going to Ogg
+			cafFile := "output_multichannel.caf"
+			opusFile := "output_multichannel.opus"
+			defer os.Remove(cafFile)
+			defer os.Remove(opusFile)
+			require.NoError(t, os.WriteFile(cafFile, output.Bytes(), 0o644))
+			require.NoError(t, ConvertCafToOpus(cafFile, opusFile))
+			roundTrip, err := os.ReadFile(opusFile)
+			require.NoError(t, err)
+			_, roundTripHeader, err := NewWith(bytes.NewReader(roundTrip))
+			require.NoError(t, err)
+			require.Equal(t, &header, roundTripHeader)
+		})
+	}
+}
+
+func TestInvalidChannelMappings(t *testing.T) {
+	testCases := []struct {
+		name   string
+		header OggHeader
+	}{
+		{"family_0_surround", OggHeader{Channels: 6, ChannelMap: 0}},
+		{"no_channels", OggHeader{Channels: 0, ChannelMap: 0}},
+		{"family_1_too_many_channels", OggHeader{Channels: 9, ChannelMap: 1, StreamCount: 9, ChannelMapping: make([]uint8, 9)}},
+		{"more_coupled_than_streams", OggHeader{Channels: 2, ChannelMap: 1, StreamCount: 1, CoupledCount: 2, ChannelMapping: []uint8{0, 1}}},
+		{"mapping_out_of_range", OggHeader{Channels: 2, ChannelMap: 1, StreamCount: 1, CoupledCount: 0, ChannelMapping: []uint8{0, 1}}},
+		{"ambisonics_not_square", OggHeader{Channels: 5, ChannelMap: 2, StreamCount: 5, ChannelMapping: []uint8{0, 1, 2, 3, 4}}},
+		{"ambisonics_with_one_extra_channel", OggHeader{Channels: 10, ChannelMap: 2, StreamCount: 10, ChannelMapping: []uint8{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := parseOpusHead(tc.header.bytes())
+			require.ErrorIs(t, err, errBadChannelMapping)
+		})
+	}
+
+	truncated := OggHeader{Channels: 6, ChannelMap: 1, StreamCount: 4, CoupledCount: 2, ChannelMapping: []uint8{0, 4, 1, 2, 3, 5}}
+	_, err := parseOpusHead(truncated.bytes()[:23])
+	require.ErrorIs(t, err, errBadIDPageLength)
+}
+
+func TestConversionOfAmbisonicFiles(t *testing.T) {
+	convert := func(t *testing.T, header OggHeader, options ConvertOptions) (*CAFFileData, *ConversionReport, error) {
+		header.Version = 1
+		header.SampleRate = 48000
+		input := encodeTestOpus(t, 1, header, []int{100, 200}, 1, 0)
+		output := &bytes.Buffer{}
+		report, err := ConvertOpusToCafStreamWithOptions(bytes.NewReader(input), output, options)
+		if err != nil {
+			return nil, report, err
+		}
+		return decodeCafBytes(t, output.Bytes()), report, nil
+	}
+
+	t.Run("first_order", func(t *testing.T) {
+		header := OggHeader{Channels: 4, ChannelMap: 2, StreamCount: 4, ChannelMapping: []uint8{0, 1, 2, 3}}
+		f, _, err := convert(t, header, ConvertOptions{})
+		require.NoError(t, err)
+		layout := f.findChunk(ChunkChannelLayout).Contents.(*CAFChannelLayout)
+		require.Equal(t, uint32(kCAFChannelLayoutTag_HOA_ACN_SN3D|4), layout.ChannelLayoutTag)
+	})
+
+	t.Run("second_order", func(t *testing.T) {
+		header := OggHeader{Channels: 9, ChannelMap: 2, StreamCount: 9, ChannelMapping: []uint8{0, 1, 2, 3, 4, 5, 6, 7, 8}}
+		f, _, err := convert(t, header, ConvertOptions{})
+		require.NoError(t, err)
+		layout := f.findChunk(ChunkChannelLayout).Contents.(*CAFChannelLayout)
+		require.Equal(t, uint32(kCAFChannelLayoutTag_HOA_ACN_SN3D|9), layout.ChannelLayoutTag)
+	})
+
+	t.Run("non_diegetic_stereo", func(t *testing.T) {
+		header := OggHeader{Channels: 6, ChannelMap: 2, StreamCount: 5, CoupledCount: 1, ChannelMapping: []uint8{2, 3, 4, 5, 0, 1}}
+		f, _, err := convert(t, header, ConvertOptions{})
+		require.NoError(t, err)
+		chanChunk := f.findChunk(ChunkChannelLayout)
+		require.Equal(t, int64(12+channelDescriptionSize*6), chanChunk.Header.ChunkSize)
+		layout := chanChunk.Contents.(*CAFChannelLayout)
+		require.Equal(t, uint32(kCAFChannelLayoutTag_UseChannelDescriptions), layout.ChannelLayoutTag)
+		var labels []uint32
+		for _, description := range layout.Channels {
+			labels = append(labels, description.ChannelLabel)
+		}
+		require.Equal(t, []uint32{
+			kCAFChannelLabel_HOA_ACN_0, kCAFChannelLabel_HOA_ACN_0 | 1, kCAFChannelLabel_HOA_ACN_0 | 2, kCAFChannelLabel_HOA_ACN_0 | 3,
+			kCAFChannelLabel_Left, kCAFChannelLabel_Right,
+		}, labels)
+	})
+
+	t.Run("routing_demixing_matrix", func(t *testing.T) {
+		// Swaps the first two decoded channels, which a mapping table can express
+		header := OggHeader{Channels: 4, ChannelMap: 3, StreamCount: 2, CoupledCount: 2, DemixingMatrix: []int16{
+			0, 32767, 0, 0,
+			32767, 0, 0, 0,
+			0, 0, 32767, 0,
+			0, 0, 0, 32767,
+		}}
+		f, report, err := convert(t, header, ConvertOptions{})
+		require.NoError(t, err)
+		require.Empty(t, report.Warnings)
+		layout := f.findChunk(ChunkChannelLayout).Contents.(*CAFChannelLayout)
+		require.Equal(t, uint32(kCAFChannelLayoutTag_HOA_ACN_SN3D|4), layout.ChannelLayoutTag)
+		cookie, err := parseOpusHead(f.findChunk(ChunkMagicCookie).Contents.(*UnknownContents).Data)
+		require.NoError(t, err)
+		require.Equal(t, uint8(2), cookie.ChannelMap)
+		require.Equal(t, []uint8{1, 0, 2, 3}, cookie.ChannelMapping)
+		require.Nil(t, cookie.DemixingMatrix)
+	})
+
+	t.Run("mixing_demixing_matrix", func(t *testing.T) {
+		header := OggHeader{Channels: 4, ChannelMap: 3, StreamCount: 2, CoupledCount: 2, DemixingMatrix: []int16{
+			16384, 16384, 0, 0,
+			16384, -16384, 0, 0,
+			0, 0, 32767, 0,
+			0, 0, 0, 32767,
+		}}
+		_, _, err := convert(t, header, ConvertOptions{})
+		require.ErrorIs(t, err, errUnrepresentableDemixingMatrix)
+
+		f, report, err := convert(t, header, ConvertOptions{KeepDemixingMatrix: true})
+		require.NoError(t, err)
+		require.Len(t, report.Warnings, 1)
+		cookie, err := parseOpusHead(f.findChunk(ChunkMagicCookie).Contents.(*UnknownContents).Data)
+		require.NoError(t, err)
+		require.Equal(t, uint8(3), cookie.ChannelMap)
+		require.Equal(t, header.DemixingMatrix, cookie.DemixingMatrix)
+	})
+}
+
+func TestConversionOfOpusTags(t *testing.T) {
+	header := OggHeader{Version: 1, Channels: 2, PreSkip: 312, SampleRate: 48000}
+	tags := OpusTags{Vendor: "libopus 1.4", Comments: []OpusComment{
+		{Key: "TITLE", Value: "Song"},
+		{Key: "ARTIST", Value: "First"},
+		{Key: "ARTIST", Value: "Second"},
+		{Key: "album", Value: "Record"},
+		{Key: "DATE", Value: "2023"},
+		{Key: "REPLAYGAIN_TRACK_GAIN", Value: "-3.2 dB"},
+	}}
+	input := &bytes.Buffer{}
+	ogg := NewOggWriter(input, 1)
+	require.NoError(t, ogg.WritePacket(header.bytes(), 0))
+	require.NoError(t, ogg.Flush())
+	require.NoError(t, ogg.WritePacket(tags.bytes(), 0))
+	require.NoError(t, ogg.Flush())
+	require.NoError(t, ogg.WritePacket([]byte{31 << 3, 1, 2, 3}, 960))
+	require.NoError(t, ogg.Close())
+
+	reader, _, err := NewWith(bytes.NewReader(input.Bytes()))
+	require.NoError(t, err)
+	parsed, err := reader.ReadTags()
+	require.NoError(t, err)
+	require.Equal(t, &tags, parsed)
+	require.Equal(t, []string{"First", "Second"}, parsed.Get("artist"))
+
+	standard := []Information{
+		{Key: "source encoder\x00", Value: "libopus 1.4\x00"},
+		{Key: "title\x00", Value: "Song\x00"},
+		{Key: "artist\x00", Value: "First\x00"},
+		{Key: "artist\x00", Value: "Second\x00"},
+		{Key: "album\x00", Value: "Record\x00"},
+		{Key: "recorded date\x00", Value: "2023\x00"},
+	}
+	testCases := []struct {
+		name     string
+		mode     MetadataMode
+		expected []Information
+		size     int64
+	}{
+		{"pass_through", MetadataPassThrough, append(standard[:len(standard):len(standard)], Information{Key: "replaygain_track_gain\x00", Value: "-3.2 dB\x00"}), 131},
+		{"standard_only", MetadataStandardOnly, standard, 101},
+		{"strip", MetadataStrip, nil, 0},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			output := &bytes.Buffer{}
+			_, err := ConvertOpusToCafStreamWithOptions(bytes.NewReader(input.Bytes()), output, ConvertOptions{Metadata: tc.mode})
+			require.NoError(t, err)
+			f := decodeCafBytes(t, output.Bytes())
+			infoChunk := f.findChunk(ChunkInformation)
+			if tc.expected == nil {
+				require.Nil(t, infoChunk)
+				return
+			}
+			require.Equal(t, tc.size, infoChunk.Header.ChunkSize)
+			require.Equal(t, tc.expected, infoChunk.Contents.(*CAFStringsChunk).Strings)
+		})
+	}
+
+	// The info chunk maps back to the same comments
+	output := &bytes.Buffer{}
+	require.NoError(t, ConvertOpusToCafStream(bytes.NewReader(input.Bytes()), output))
+	cafFile := "output_tags.caf"
+	opusFile := "output_tags.opus"
+	defer os.Remove(cafFile)
+	defer os.Remove(opusFile)
+	require.NoError(t, os.WriteFile(cafFile, output.Bytes(), 0o644))
+	require.NoError(t, ConvertCafToOpus(cafFile, opusFile))
+	roundTrip, err := os.ReadFile(opusFile)
+	require.NoError(t, err)
+	reader, _, err = NewWith(bytes.NewReader(roundTrip))
+	require.NoError(t, err)
+	parsed, err = reader.ReadTags()
+	require.NoError(t, err)
+	tags.Comments[3].Key = "ALBUM"
+	require.Equal(t, &tags, parsed)
+
+	_, err = ParseOpusTags(tags.bytes()[:20])
+	require.ErrorIs(t, err, errBadOpusTagsLength)
+	_, err = ParseOpusTags([]byte("OpusHead"))
+	require.ErrorIs(t, err, errBadOpusTagsSignature)
+}
+
+func TestChannelLayouts(t *testing.T) {
+	// The table of fixed tags is complete and every entry parses
+	byNumber := map[uint32]bool{}
+	for tag := range channelLayoutTags {
+		_, err := parseChannelLayoutTag(tag)
+		require.NoError(t, err)
+		byNumber[tag>>16] = true
+	}
+	for number := uint32(100); number <= kCAFChannelLayoutTag_MPEG_7_1_D>>16; number++ {
+		switch number << 16 {
+		case kCAFChannelLayoutTag_DiscreteInOrder, kCAFChannelLayoutTag_HOA_ACN_SN3D, kCAFChannelLayoutTag_HOA_ACN_N3D:
+			continue
+		}
+		require.True(t, byNumber[number], "no layout for tag %d", number)
+	}
+	cicp13 := CAFChannelLayout{ChannelLayoutTag: kCAFChannelLayoutTag_CICP_13}
+	require.NoError(t, cicp13.Validate(24))
+	require.Equal(t, "CICP_13", ChannelLayoutTagName(kCAFChannelLayoutTag_CICP_13))
+
+	// Every fixed tag expands to its channels and back
+	for tag := range channelLayoutTags {
+		layout := CAFChannelLayout{ChannelLayoutTag: tag}
+		require.NoError(t, layout.Validate(tag&0xFFFF), ChannelLayoutTagName(tag))
+		described, err := layout.WithDescriptions()
+		require.NoError(t, err)
+		require.Equal(t, int(tag&0xFFFF), described.ChannelCount())
+		labels, err := described.ChannelLabels()
+		require.NoError(t, err)
+		compact := NewChannelLayoutForLabels(labels)
+		compactLabels, err := compact.ChannelLabels()
+		require.NoError(t, err)
+		require.Equal(t, labels, compactLabels, ChannelLayoutTagName(tag))
+	}
+
+	surround := CAFChannelLayout{ChannelLayoutTag: kCAFChannelLayoutTag_MPEG_5_1_A}
+	bitmap, err := surround.WithBitmap()
+	require.NoError(t, err)
+	require.Equal(t, CAFChannelLayout{ChannelLayoutTag: kCAFChannelLayoutTag_UseChannelBitmap, ChannelBitmap: 0x3F}, bitmap)
+	require.Equal(t, 6, bitmap.ChannelCount())
+	tagged, err := bitmap.WithTag()
+	require.NoError(t, err)
+	require.Equal(t, surround, tagged)
+
+	// The Vorbis order has the centre before the right channel
+	ogg := CAFChannelLayout{ChannelLayoutTag: kCAFChannelLayoutTag_Ogg_5_1}
+	_, err = ogg.WithBitmap()
+	require.ErrorIs(t, err, errNotChannelBitmap)
+	labels, err := ogg.ChannelLabels()
+	require.NoError(t, err)
+	var names []string
+	for _, label := range labels {
+		names = append(names, ChannelLabelName(label))
+	}
+	require.Equal(t, []string{"Left", "Center", "Right", "LeftSurround", "RightSurround", "LFEScreen"}, names)
+
+	// Height channels without a tag for their order fall back to a bitmap
+	heights := NewChannelLayoutForLabels([]uint32{kCAFChannelLabel_Left, kCAFChannelLabel_Right, kCAFChannelLabel_LeftTopMiddle, kCAFChannelLabel_RightTopMiddle})
+	require.Equal(t, CAFChannelLayout{ChannelLayoutTag: kCAFChannelLayoutTag_UseChannelBitmap, ChannelBitmap: 0x3 | kCAFChannelBit_LeftTopMiddle | kCAFChannelBit_RightTopMiddle}, heights)
+	_, err = heights.WithTag()
+	require.ErrorIs(t, err, errNoMatchingChannelLayout)
+
+	// Channels out of bit order need descriptions
+	swapped := NewChannelLayoutForLabels([]uint32{kCAFChannelLabel_Right, kCAFChannelLabel_Left, kCAFChannelLabel_Center})
+	require.Equal(t, uint32(kCAFChannelLayoutTag_UseChannelDescriptions), swapped.ChannelLayoutTag)
+	require.Equal(t, uint32(3), swapped.NumberChannelDescriptions)
+
+	hoa := CAFChannelLayout{ChannelLayoutTag: kCAFChannelLayoutTag_HOA_ACN_SN3D | 4}
+	labels, err = hoa.ChannelLabels()
+	require.NoError(t, err)
+	require.Equal(t, []uint32{kCAFChannelLabel_HOA_ACN_0, kCAFChannelLabel_HOA_ACN_0 | 1, kCAFChannelLabel_HOA_ACN_0 | 2, kCAFChannelLabel_HOA_ACN_0 | 3}, labels)
+	require.Equal(t, "HOA_ACN_3", ChannelLabelName(labels[3]))
+	require.Equal(t, "HOA_ACN_SN3D(4)", ChannelLayoutTagName(hoa.ChannelLayoutTag))
+	require.Equal(t, "Ogg_5_1", ChannelLayoutTagName(kCAFChannelLayoutTag_Ogg_5_1))
+
+	require.ErrorIs(t, hoa.Validate(6), errChannelLayoutChannelCount)
+	broken := CAFChannelLayout{NumberChannelDescriptions: 2}
+	require.ErrorIs(t, broken.Validate(2), errChannelDescriptionCount)
+	unknown := CAFChannelLayout{ChannelLayoutTag: 99<<16 | 2}
+	require.ErrorIs(t, unknown.Validate(2), errUnknownChannelLayoutTag)
+
+	// A rewritten chan chunk decodes to the same layout
+	chunk := NewChannelLayoutChunk(swapped)
+	encoded := &bytes.Buffer{}
+	require.NoError(t, chunk.Encode(encoded))
+	var decoded CAFChunk
+	require.NoError(t, decoded.decode(bufio.NewReader(encoded), nil))
+	require.Equal(t, chunk, decoded)
+}
+
+func TestCAFReader(t *testing.T) {
+	outputFile := "output_reader.caf"
+	defer os.Remove(outputFile)
+	require.NoError(t, ConvertOpusToCaf("samples/sample_large.opus", outputFile))
+	decoded := decodeCafFile(t, outputFile)
+
+	file, err := os.Open(outputFile)
+	require.NoError(t, err)
+	defer file.Close()
+	stat, err := file.Stat()
+	require.NoError(t, err)
+
+	// Reading the metadata does not load the audio
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	cf, err := NewCAFReader(file, stat.Size())
+	require.NoError(t, err)
+	desc, err := cf.AudioDescription()
+	require.NoError(t, err)
+	layout, err := cf.ChannelLayout()
+	require.NoError(t, err)
+	info, err := cf.Information()
+	require.NoError(t, err)
+	pakt, err := cf.PacketTable()
+	require.NoError(t, err)
+	runtime.ReadMemStats(&after)
+	dataBytes := decoded.findChunk(ChunkAudioData).Contents.(*DataX).Bytes
+	require.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(len(dataBytes)/4))
+
+	require.Equal(t, decoded.CAFFileHeader, cf.FileHeader())
+	require.Len(t, cf.Chunks(), len(decoded.Chunks))
+	for i, chunk := range cf.Chunks() {
+		require.Equal(t, decoded.Chunks[i].Header, chunk.Header)
+	}
+	require.Equal(t, decoded.findChunk(ChunkeAudioDescription).Contents, desc)
+	require.Equal(t, decoded.findChunk(ChunkChannelLayout).Contents, layout)
+	require.Equal(t, decoded.findChunk(ChunkInformation).Contents, info)
+	require.Equal(t, decoded.findChunk(ChunkPacketTable).Contents, pakt)
+	_, err = cf.MagicCookie()
+	require.ErrorIs(t, err, errChunkNotFound)
+
+	audio, err := cf.AudioData()
+	require.NoError(t, err)
+	audioBytes, err := io.ReadAll(audio)
+	require.NoError(t, err)
+	require.Equal(t, dataBytes, audioBytes)
+
+	// A streamed CAF has a data chunk of unknown size running to the end
+	streamed := &bytes.Buffer{}
+	input, err := os.ReadFile("samples/tiny.opus")
+	require.NoError(t, err)
+	require.NoError(t, ConvertOpusToCafStream(bytes.NewReader(input), struct{ io.Writer }{streamed}))
+	cf, err = NewCAFReader(bytes.NewReader(streamed.Bytes()), int64(streamed.Len()))
+	require.NoError(t, err)
+	dataChunk, ok := cf.FindChunk(ChunkAudioData)
+	require.True(t, ok)
+	require.Equal(t, int64(-1), dataChunk.Header.ChunkSize)
+	require.Equal(t, int64(streamed.Len())-dataChunk.Offset, dataChunk.Size)
+	editCount, err := cf.EditCount()
+	require.NoError(t, err)
+	require.Equal(t, uint32(0), editCount)
+
+	truncated := streamed.Bytes()[:30]
+	_, err = NewCAFReader(bytes.NewReader(truncated), int64(len(truncated)))
+	require.ErrorIs(t, err, errChunkSizeTooLarge)
+}
+
+func TestCAFPacketIterator(t *testing.T) {
+	outputFile := "output_packets.caf"
+	defer os.Remove(outputFile)
+	require.NoError(t, ConvertOpusToCaf("samples/sample_stereo.opus", outputFile))
+	decoded := decodeCafFile(t, outputFile)
+	pakt := decoded.findChunk(ChunkPacketTable).Contents.(*CAFPacketTable)
+	data := decoded.findChunk(ChunkAudioData).Contents.(*DataX).Bytes
+
+	file, err := os.Open(outputFile)
+	require.NoError(t, err)
+	defer file.Close()
+	stat, err := file.Stat()
+	require.NoError(t, err)
+	cf, err := NewCAFReader(file, stat.Size())
+	require.NoError(t, err)
+
+	lazy, err := cf.Packets()
+	require.NoError(t, err)
+	inMemory, err := decoded.Packets()
+	require.NoError(t, err)
+
+	offset := int64(0)
+	start := -int64(pakt.Header.PrimingFrames)
+	for i, size := range pakt.Entry {
+		packet, err := lazy.Next()
+		require.NoError(t, err)
+		require.Equal(t, i, packet.Index)
+		require.Equal(t, offset, packet.Offset)
+		require.Equal(t, data[offset:offset+int64(size)], packet.Data)
+		require.Equal(t, uint32(960), packet.Frames)
+		require.Equal(t, start, packet.StartFrame)
+
+		other, err := inMemory.Next()
+		require.NoError(t, err)
+		require.Equal(t, packet, other)
+
+		offset += int64(size)
+		start += int64(packet.Frames)
+	}
+	_, err = lazy.Next()
+	require.Equal(t, io.EOF, err)
+	require.Equal(t, pakt.Header.NumberValidFrames+int64(pakt.Header.RemainderFrames), start)
+
+	// Constant size packets need no packet table, priming still applies when there is one
+	lpcm := &CAFFileData{
+		CAFFileHeader: CAFFileHeader{FileType: NewFourByteStr("caff"), FileVersion: 1},
+		Chunks: []CAFChunk{
+			{Header: CAFChunkHeader{ChunkType: ChunkeAudioDescription, ChunkSize: 32}, Contents: &CAFAudioFormat{
+				SampleRate: 48000, FormatID: NewFourByteStr("lpcm"), BytesPerPacket: 4, FramesPerPacket: 1, ChannelsPerPacket: 2, BitsPerChannel: 16,
+			}},
+			{Header: CAFChunkHeader{ChunkType: ChunkAudioData, ChunkSize: 4 + 40}, Contents: &DataX{Bytes: make([]byte, 40)}},
+		},
+	}
+	packets, err := lpcm.Packets()
+	require.NoError(t, err)
+	count := 0
+	for ; ; count++ {
+		packet, err := packets.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		require.Equal(t, int64(count*4), packet.Offset)
+		require.Equal(t, int64(count), packet.StartFrame)
+		require.Len(t, packet.Data, 4)
+	}
+	require.Equal(t, 10, count)
+
+	lpcm.Chunks = append(lpcm.Chunks, CAFChunk{
+		Header:   CAFChunkHeader{ChunkType: ChunkPacketTable, ChunkSize: 24},
+		Contents: &CAFPacketTable{Header: CAFPacketTableHeader{NumberValidFrames: 7, PrimingFrames: 2, RemainderFrames: 1}},
+	})
+	packets, err = lpcm.Packets()
+	require.NoError(t, err)
+	packet, err := packets.Next()
+	require.NoError(t, err)
+	require.Equal(t, int64(-2), packet.StartFrame)
+
+	// Variable size packets cannot be found without a packet table
+	withoutPakt := &CAFFileData{Chunks: []CAFChunk{decoded.Chunks[0], *decoded.findChunk(ChunkAudioData)}}
+	_, err = withoutPakt.Packets()
+	require.ErrorIs(t, err, errMissingPacketTable)
+}
+
+func TestCAFSeekIndex(t *testing.T) {
+	output := &bytes.Buffer{}
+	input, err := os.ReadFile("samples/sample_stereo.opus")
+	require.NoError(t, err)
+	require.NoError(t, ConvertOpusToCafStream(bytes.NewReader(input), output))
+	contents := output.Bytes()
+
+	// Without frames per packet in desc, the packets are read to find their durations
+	withoutFrames := append([]byte(nil), contents...)
+	binary.BigEndian.PutUint32(withoutFrames[40:44], 0)
+
+	for name, contents := range map[string][]byte{"frames_per_packet": contents, "packet_durations": withoutFrames} {
+		t.Run(name, func(t *testing.T) {
+			cf, err := NewCAFReader(bytes.NewReader(contents), int64(len(contents)))
+			require.NoError(t, err)
+
+			// The first packets hold the priming frames, so seeking to the start skips them
+			point, err := cf.SeekToSample(0)
+			require.NoError(t, err)
+			require.Equal(t, 0, point.PacketIndex)
+			require.Equal(t, int64(-312), point.StartFrame)
+			require.Equal(t, int64(312), point.SkipFrames)
+
+			// One second in, decoding starts at least 80 ms earlier
+			point, err = cf.SeekToSample(48000)
+			require.NoError(t, err)
+			require.Equal(t, 46, point.PacketIndex)
+			require.Equal(t, int64(46*960-312), point.StartFrame)
+			require.Equal(t, int64(48000-46*960+312), point.SkipFrames)
+			require.GreaterOrEqual(t, point.SkipFrames, int64(3840))
+
+			packets, err := cf.PacketsFrom(point)
+			require.NoError(t, err)
+			packet, err := packets.Next()
+			require.NoError(t, err)
+			require.Equal(t, point.PacketIndex, packet.Index)
+			require.Equal(t, point.StartFrame, packet.StartFrame)
+			require.Equal(t, point.DataOffset, packet.Offset)
+			require.Equal(t, packet.Data, contents[point.Offset:point.Offset+int64(len(packet.Data))])
+
+			_, err = cf.SeekToSample(-1)
+			require.ErrorIs(t, err, errSeekOutOfRange)
+			_, err = cf.SeekToSample(5860491)
+			require.ErrorIs(t, err, errSeekOutOfRange)
+			point, err = cf.SeekToSample(5860490)
+			require.NoError(t, err)
+			require.Equal(t, 6101, point.PacketIndex)
+		})
+	}
+
+	// Constant size packets are located without a table, and only Opus has a pre-roll
+	desc := &CAFAudioFormat{SampleRate: 48000, FormatID: NewFourByteStr("lpcm"), BytesPerPacket: 4, FramesPerPacket: 1, ChannelsPerPacket: 2, BitsPerChannel: 16}
+	pakt := &CAFPacketTable{Header: CAFPacketTableHeader{NumberValidFrames: 7, PrimingFrames: 2, RemainderFrames: 1}}
+	index, err := NewCAFSeekIndex(desc, pakt, 100)
+	require.NoError(t, err)
+	point, err := index.SeekToSample(5)
+	require.NoError(t, err)
+	require.Equal(t, CAFSeekPoint{PacketIndex: 7, StartFrame: 5, DataOffset: 28, Offset: 128}, point)
+	index.SetPreRoll(3)
+	point, err = index.SeekToSample(5)
+	require.NoError(t, err)
+	require.Equal(t, CAFSeekPoint{PacketIndex: 4, StartFrame: 2, DataOffset: 16, Offset: 116, SkipFrames: 3}, point)
+}
+
+func TestOggSeeking(t *testing.T) {
+	// Long enough for bisection, with packets large enough to continue across pages
+	sizes := make([]int, 3000)
+	for i := range sizes {
+		sizes[i] = 20 + i%200
+		if i%500 == 250 {
+			sizes[i] = 5000
+		}
+	}
+	header := OggHeader{Version: 1, Channels: 2, PreSkip: 312, SampleRate: 48000}
+	contents := append([]byte("ID3 tag in front"), encodeTestOpus(t, 1, header, sizes, 1, 100)...)
+
+	ogg, _, err := NewWith(bytes.NewReader(contents))
+	require.NoError(t, err)
+	skipped := ogg.Skipped()
+
+	duration, err := ogg.Duration()
+	require.NoError(t, err)
+	require.Equal(t, int64(3000*960-100-312), duration)
+
+	// Duration leaves the reader where it was
+	packet, err := ogg.ReadPacket()
+	require.NoError(t, err)
+	require.Equal(t, 1, packet.Index)
+
+	for _, sample := range []int64{0, 1000, 48000, 240000 + 123, 1440000, duration - 1} {
+		start, err := ogg.SeekToSample(sample)
+		require.NoError(t, err)
+		if sample+312 < 3840 {
+			require.Equal(t, int64(-312), start, "the pre-roll reaches back to the first packet")
+		} else {
+			require.LessOrEqual(t, start, sample-3840, "the pre-roll is allowed for")
+			require.Greater(t, start, sample-3840-60*960, "the seek lands near the target")
+		}
+		require.Equal(t, int64(0), (start+312)%960, "packets start every 960 samples")
+
+		first := int((start + 312) / 960)
+		for i := first; i < first+3 && i < len(sizes); i++ {
+			packet, err := ogg.ReadPacket()
+			require.NoError(t, err)
+			require.Len(t, packet.Data, sizes[i], "packet %d after seeking to %d", i, sample)
+		}
+	}
+	require.Equal(t, skipped, ogg.Skipped())
+
+	_, err = ogg.SeekToSample(-1)
+	require.ErrorIs(t, err, errSeekOutOfRange)
+
+	unseekable, _, err := NewWith(bufio.NewReader(bytes.NewReader(contents)))
+	require.NoError(t, err)
+	_, err = unseekable.Duration()
+	require.ErrorIs(t, err, errNotSeekable)
+	_, err = unseekable.SeekToSample(0)
+	require.ErrorIs(t, err, errNotSeekable)
+}
+
+func TestConversionOfTimeRange(t *testing.T) {
+	sizes := make([]int, 1000)
+	for i := range sizes {
+		sizes[i] = 10 + i%100
+	}
+	header := OggHeader{Version: 1, Channels: 2, PreSkip: 312, SampleRate: 48000}
+	contents := encodeTestOpus(t, 1, header, sizes, 1, 100)
+
+	convert := func(options ConvertOptions) (*CAFPacketTable, error) {
+		output := &bytes.Buffer{}
+		if _, err := ConvertOpusToCafStreamWithOptions(bytes.NewReader(contents), output, options); err != nil {
+			return nil, err
+		}
+		return decodeCafBytes(t, output.Bytes()).findChunk(ChunkPacketTable).Contents.(*CAFPacketTable), nil
+	}
+
+	// The pre-roll reaches back to packet 46, which starts 4152 samples
+	// ahead of 1s, and the packet holding the last sample before 1.5s is 75
+	pakt, err := convert(ConvertOptions{Start: time.Second, End: 1500 * time.Millisecond})
+	require.NoError(t, err)
+	require.Equal(t, CAFPacketTableHeader{30, 24000, 4152, 648}, pakt.Header)
+	require.Len(t, pakt.Entry, 30)
+	for i, size := range pakt.Entry {
+		require.Equal(t, uint64(sizes[46+i]), size)
+	}
+
+	// Close to the start the pre-roll is cut short by the first packet
+	pakt, err = convert(ConvertOptions{Start: 40 * time.Millisecond})
+	require.NoError(t, err)
+	require.Equal(t, CAFPacketTableHeader{1000, 1000*960 - 312 - 100 - 1920, 312 + 1920, 100}, pakt.Header)
+
+	// An end past the audio stops at the end trimming of the stream
+	pakt, err = convert(ConvertOptions{End: time.Hour})
+	require.NoError(t, err)
+	require.Equal(t, CAFPacketTableHeader{1000, 1000*960 - 312 - 100, 312, 100}, pakt.Header)
+
+	_, err = convert(ConvertOptions{Start: time.Second, End: time.Second})
+	require.ErrorIs(t, err, errBadTimeRange)
+	_, err = convert(ConvertOptions{Start: -time.Second})
+	require.ErrorIs(t, err, errBadTimeRange)
+	_, err = convert(ConvertOptions{Start: time.Minute})
+	require.ErrorIs(t, err, errEmptyTimeRange)
+}
+
+func TestConcatenation(t *testing.T) {
+	header := OggHeader{Version: 1, Channels: 2, PreSkip: 312, SampleRate: 48000}
+	intro := encodeTestOpus(t, 1, header, []int{10, 20}, 1, 100)
+	body := encodeTestOpus(t, 2, OggHeader{Version: 1, Channels: 2, PreSkip: 120, SampleRate: 48000}, []int{30, 40, 50}, 2, 50)
+	outro := encodeTestOpus(t, 3, header, []int{60}, 3, 200)
+
+	output := &bytes.Buffer{}
+	_, err := ConcatOpusToCafStream([]io.Reader{bytes.NewReader(intro), bytes.NewReader(body), bytes.NewReader(outro)}, output, ConvertOptions{})
+	require.NoError(t, err)
+	cf := decodeCafBytes(t, output.Bytes())
+	pakt := cf.findChunk(ChunkPacketTable).Contents.(*CAFPacketTable)
+	require.Equal(t, []uint64{10, 20, 30, 40, 50, 60}, pakt.Entry)
+	require.Equal(t, CAFPacketTableHeader{6, 6*960 - 312 - 200, 312, 200}, pakt.Header)
+	data := cf.findChunk(ChunkAudioData).Contents.(*DataX).Bytes
+	require.Len(t, data, 210)
+	require.Equal(t, byte(2), data[30+1])
+	require.Equal(t, byte(3), data[len(data)-1])
+
+	// A chained input adds its first link only, unless links are joined
+	chained := append(append([]byte(nil), intro...), outro...)
+	output.Reset()
+	_, err = ConcatOpusToCafStream([]io.Reader{bytes.NewReader(chained), bytes.NewReader(body)}, output, ConvertOptions{})
+	require.NoError(t, err)
+	pakt = decodeCafBytes(t, output.Bytes()).findChunk(ChunkPacketTable).Contents.(*CAFPacketTable)
+	require.Equal(t, []uint64{10, 20, 30, 40, 50}, pakt.Entry)
+	output.Reset()
+	_, err = ConcatOpusToCafStream([]io.Reader{bytes.NewReader(chained), bytes.NewReader(body)}, output, ConvertOptions{Chain: ChainJoin})
+	require.NoError(t, err)
+	pakt = decodeCafBytes(t, output.Bytes()).findChunk(ChunkPacketTable).Contents.(*CAFPacketTable)
+	require.Equal(t, []uint64{10, 20, 60, 30, 40, 50}, pakt.Entry)
+
+	inputFiles := []string{"output_intro.opus", "output_outro.opus"}
+	for i, contents := range [][]byte{intro, outro} {
+		require.NoError(t, os.WriteFile(inputFiles[i], contents, 0o644))
+		defer os.Remove(inputFiles[i])
+	}
+	defer os.Remove("output_concat.caf")
+	_, err = ConcatOpusToCaf(inputFiles, "output_concat.caf", ConvertOptions{})
+	require.NoError(t, err)
+	pakt = decodeCafFile(t, "output_concat.caf").findChunk(ChunkPacketTable).Contents.(*CAFPacketTable)
+	require.Equal(t, CAFPacketTableHeader{3, 3*960 - 312 - 200, 312, 200}, pakt.Header)
+
+	// Inputs must decode to the same channels
+	mono := encodeTestOpus(t, 4, OggHeader{Version: 1, Channels: 1, SampleRate: 48000}, []int{10}, 4, 0)
+	_, err = ConcatOpusToCafStream([]io.Reader{bytes.NewReader(intro), bytes.NewReader(mono)}, &bytes.Buffer{}, ConvertOptions{})
+	require.ErrorIs(t, err, errIncompatibleInputs)
+	require.Contains(t, err.Error(), "input 2")
+
+	surround := OggHeader{Version: 1, Channels: 3, SampleRate: 48000, ChannelMap: 1, StreamCount: 2, CoupledCount: 1, ChannelMapping: []uint8{0, 2, 1}}
+	reordered := surround
+	reordered.ChannelMapping = []uint8{0, 1, 2}
+	_, err = ConcatOpusToCafStream([]io.Reader{
+		bytes.NewReader(encodeTestOpus(t, 5, surround, []int{10}, 5, 0)),
+		bytes.NewReader(encodeTestOpus(t, 6, reordered, []int{10}, 6, 0)),
+	}, &bytes.Buffer{}, ConvertOptions{})
+	require.ErrorIs(t, err, errIncompatibleInputs)
+
+	_, err = ConcatOpusToCafStream(nil, &bytes.Buffer{}, ConvertOptions{})
+	require.ErrorIs(t, err, errNoConcatInputs)
+}
+
+func TestSplitting(t *testing.T) {
+	header := OggHeader{Version: 1, Channels: 2, PreSkip: 312, SampleRate: 48000}
+	tags := OpusTags{Vendor: "libopus 1.4", Comments: []OpusComment{
+		{Key: "TITLE", Value: "Episode"},
+		{Key: "CHAPTER002", Value: "00:00:05.000"},
+		{Key: "CHAPTER002NAME", Value: "Interview"},
+		{Key: "CHAPTER001", Value: "00:00:00.000"},
+		{Key: "CHAPTER001NAME", Value: "Intro"},
+		{Key: "chapter003", Value: "00:00:12.5"},
+		{Key: "CHAPTER004", Value: "soon"},
+	}}
+	require.Equal(t, []Chapter{
+		{Start: 0, Name: "Intro"},
+		{Start: 5 * time.Second, Name: "Interview"},
+		{Start: 12500 * time.Millisecond},
+	}, tags.Chapters())
+
+	sizes := make([]int, 1000)
+	input := &bytes.Buffer{}
+	ogg := NewOggWriter(input, 1)
+	require.NoError(t, ogg.WritePacket(header.bytes(), 0))
+	require.NoError(t, ogg.Flush())
+	require.NoError(t, ogg.WritePacket(tags.bytes(), 0))
+	require.NoError(t, ogg.Flush())
+	for i := range sizes {
+		sizes[i] = 10 + i%100
+		granule := uint64(i+1) * 960
+		if i == len(sizes)-1 {
+			granule -= 100
+		}
+		require.NoError(t, ogg.WritePacket(append([]byte{31 << 3}, bytes.Repeat([]byte{1}, sizes[i]-1)...), granule))
+	}
+	require.NoError(t, ogg.Close())
+
+	inputFile := "output_split.opus"
+	require.NoError(t, os.WriteFile(inputFile, input.Bytes(), 0o644))
+	defer os.Remove(inputFile)
+	cafFile := "output_split.caf"
+	_, err := ConvertOpusToCafWithOptions(inputFile, cafFile, ConvertOptions{})
+	require.NoError(t, err)
+	defer os.Remove(cafFile)
+
+	split := func(inputFile string, split SplitOptions) []*CAFFileData {
+		outputFiles, _, err := SplitToCaf(inputFile, "output_part.caf", split, ConvertOptions{})
+		for _, file := range outputFiles {
+			defer os.Remove(file)
+		}
+		require.NoError(t, err)
+		pieces := make([]*CAFFileData, 0, len(outputFiles))
+		for i, file := range outputFiles {
+			require.Equal(t, numberedFileName("output_part.caf", i+1), file)
+			pieces = append(pieces, decodeCafFile(t, file))
+		}
+		return pieces
+	}
+
+	// Both inputs carry the chapters, the CAF one in its info chunk
+	for _, file := range []string{inputFile, cafFile} {
+		pieces := split(file, SplitOptions{Chapters: true})
+		require.Len(t, pieces, 3)
+		// Later pieces start with the four packets of the pre-roll
+		expected := []CAFPacketTableHeader{{250, 250*960 - 312, 312, 0}, {379, 375 * 960, 3840, 0}, {379, 375*960 - 100, 3840, 100}}
+		for i, piece := range pieces {
+			require.Equal(t, expected[i], piece.findChunk(ChunkPacketTable).Contents.(*CAFPacketTable).Header, file)
+			info := piece.findChunk(ChunkInformation).Contents.(*CAFStringsChunk).Strings
+			require.Equal(t, []Information{
+				{Key: "source encoder\x00", Value: "libopus 1.4\x00"},
+				{Key: "title\x00", Value: "Episode\x00"},
+				{Key: "part number\x00", Value: fmt.Sprintf("%d\x00", i+1)},
+			}, info)
+		}
+	}
+
+	pieces := split(cafFile, SplitOptions{Duration: 10 * time.Second})
+	require.Len(t, pieces, 2)
+	require.Equal(t, CAFPacketTableHeader{500, 500*960 - 312, 312, 0}, pieces[0].findChunk(ChunkPacketTable).Contents.(*CAFPacketTable).Header)
+	require.Equal(t, CAFPacketTableHeader{504, 500*960 - 100, 3840, 100}, pieces[1].findChunk(ChunkPacketTable).Contents.(*CAFPacketTable).Header)
+	// The pre-roll of the second piece repeats the end of the first
+	iterator, err := pieces[1].Packets()
+	require.NoError(t, err)
+	first, err := iterator.Next()
+	require.NoError(t, err)
+	require.Equal(t, int64(-3840), first.StartFrame)
+	firstData := pieces[0].findChunk(ChunkAudioData).Contents.(*DataX).Bytes
+	secondData := pieces[1].findChunk(ChunkAudioData).Contents.(*DataX).Bytes
+	preRollSize := int(sum(pieces[1].findChunk(ChunkPacketTable).Contents.(*CAFPacketTable).Entry[:4]))
+	require.Equal(t, firstData[len(firstData)-preRollSize:], secondData[:preRollSize])
+
+	// Every piece fits the size, and the pieces hold all packets in order
+	outputFiles, _, err := SplitToCaf(inputFile, "output_part.caf", SplitOptions{MaxSize: 8000}, ConvertOptions{})
+	for _, file := range outputFiles {
+		defer os.Remove(file)
+	}
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, len(outputFiles), 8)
+	var entries []uint64
+	for i, file := range outputFiles {
+		stat, err := os.Stat(file)
+		require.NoError(t, err)
+		require.LessOrEqual(t, stat.Size(), int64(8000))
+		if i < len(outputFiles)-1 {
+			require.Greater(t, stat.Size(), int64(8000-200))
+		}
+		pakt := decodeCafFile(t, file).findChunk(ChunkPacketTable).Contents.(*CAFPacketTable)
+		if i > 0 {
+			require.Equal(t, int32(3840), pakt.Header.PrimingFrames)
+			pakt.Entry = pakt.Entry[4:]
+		}
+		entries = append(entries, pakt.Entry...)
+	}
+	require.Len(t, entries, len(sizes))
+	for i, size := range sizes {
+		require.Equal(t, uint64(size), entries[i])
+	}
+
+	_, _, err = SplitToCaf(inputFile, "output_part.caf", SplitOptions{MaxSize: 200}, ConvertOptions{})
+	require.ErrorIs(t, err, errSplitPacketTooLarge)
+	_, _, err = SplitToCaf(inputFile, "output_part.caf", SplitOptions{}, ConvertOptions{})
+	require.ErrorIs(t, err, errNoSplitRule)
+	_, _, err = SplitToCaf(inputFile, "output_part.caf", SplitOptions{Chapters: true}, ConvertOptions{End: time.Second})
+	require.ErrorIs(t, err, errSplitTimeRange)
+}
+
+func TestCAFEditing(t *testing.T) {
+	header := OggHeader{Version: 1, Channels: 2, PreSkip: 312, SampleRate: 48000}
+	sizes := make([]int, 100)
+	for i := range sizes {
+		sizes[i] = 10 + i
+	}
+	output := &bytes.Buffer{}
+	require.NoError(t, ConvertOpusToCafStream(bytes.NewReader(encodeTestOpus(t, 1, header, sizes, 1, 100)), output))
+	original := output.Bytes()
+	edit := func() *CAFFileData {
+		return decodeCafBytes(t, original)
+	}
+	packetTable := func(cf *CAFFileData) *CAFPacketTable {
+		return cf.findChunk(ChunkPacketTable).Contents.(*CAFPacketTable)
+	}
+	reencoded := func(cf *CAFFileData) *CAFFileData {
+		encoded := &bytes.Buffer{}
+		require.NoError(t, cf.Encode(encoded))
+		return decodeCafBytes(t, encoded.Bytes())
+	}
+
+	// In the middle only whole packets go: 10000 to 20000 holds packets 11 to 20
+	cf := edit()
+	start, end, err := cf.DeleteRange(10000, 20000)
+	require.NoError(t, err)
+	require.Equal(t, []int64{11*960 - 312, 21*960 - 312}, []int64{start, end})
+	cf = reencoded(cf)
+	pakt := packetTable(cf)
+	require.Equal(t, CAFPacketTableHeader{90, 100*960 - 312 - 100 - 10*960, 312, 100}, pakt.Header)
+	require.Equal(t, uint64(20), pakt.Entry[10])
+	require.Equal(t, uint64(31), pakt.Entry[11])
+	require.Equal(t, uint32(1), cf.findChunk(ChunkAudioData).Contents.(*DataX).EditCount)
+	require.Len(t, cf.findChunk(ChunkAudioData).Contents.(*DataX).Bytes, int(sum(pakt.Entry)))
+
+	// At the start the priming frames cut exactly, keeping the pre-roll
+	cf = edit()
+	start, end, err = cf.DeleteRange(0, 48000)
+	require.NoError(t, err)
+	require.Equal(t, []int64{0, 48000}, []int64{start, end})
+	pakt = packetTable(reencoded(cf))
+	require.Equal(t, uint64(10+46), pakt.Entry[0])
+	require.Equal(t, CAFPacketTableHeader{54, 100*960 - 312 - 100 - 48000, 48000 - (46*960 - 312), 100}, pakt.Header)
+
+	// At the end the remainder frames do
+	cf = edit()
+	start, end, err = cf.DeleteRange(50000, 100*960-312-100)
+	require.NoError(t, err)
+	require.Equal(t, []int64{50000, 100*960 - 312 - 100}, []int64{start, end})
+	pakt = packetTable(reencoded(cf))
+	require.Len(t, pakt.Entry, 53)
+	require.Equal(t, CAFPacketTableHeader{53, 50000, 312, 53*960 - 312 - 50000}, pakt.Header)
+
+	// A range inside a single packet removes nothing
+	start, end, err = edit().DeleteRange(10000, 10500)
+	require.NoError(t, err)
+	require.Equal(t, []int64{10000, 10000}, []int64{start, end})
+
+	_, _, err = edit().DeleteRange(0, 100*960-312-100)
+	require.ErrorIs(t, err, errEditRemovesAll)
+	_, _, err = edit().DeleteRange(100, 100)
+	require.ErrorIs(t, err, errEditOutOfRange)
+	_, _, err = edit().DeleteRange(0, 100*960)
+	require.ErrorIs(t, err, errEditOutOfRange)
+
+	// Silence is rounded up to 2.5 ms packets and goes in at a packet boundary
+	cf = edit()
+	position, err := cf.InsertSilence(10000, 1500)
+	require.NoError(t, err)
+	require.Equal(t, int64(11*960-312), position)
+	cf = reencoded(cf)
+	pakt = packetTable(cf)
+	require.Equal(t, CAFPacketTableHeader{103, 100*960 - 312 - 100 + 1560, 312, 100}, pakt.Header)
+	require.Equal(t, []uint64{960, 480, 120}, pakt.Frames[11:14])
+	require.Equal(t, uint32(0), cf.findChunk(ChunkeAudioDescription).Contents.(*CAFAudioFormat).FramesPerPacket)
+	silence, err := cf.Packets()
+	require.NoError(t, err)
+	for i := 0; i < 14; i++ {
+		packet, err := silence.Next()
+		require.NoError(t, err)
+		// CELT-only fullband stereo of 20, 10 and 2.5 ms
+		if toc := map[int]byte{11: 0xfc, 12: 0xf4, 13: 0xe4}[i]; toc != 0 {
+			require.Equal(t, []byte{toc, 0xff, 0xfe}, packet.Data)
+		}
+	}
+
+	// At the end the silence goes in ahead of the padded last packet, whose
+	// padding stays trimmed
+	cf = edit()
+	position, err = cf.InsertSilence(100*960-312-100, 1080)
+	require.NoError(t, err)
+	require.Equal(t, int64(99*960-312), position)
+	cf = reencoded(cf)
+	pakt = packetTable(cf)
+	require.Equal(t, CAFPacketTableHeader{102, 100*960 - 312 - 100 + 1080, 312, 100}, pakt.Header)
+	require.Equal(t, []uint64{960, 120, 960}, pakt.Frames[99:])
+	require.Equal(t, uint64(10+99), pakt.Entry[101])
+
+	// Without padding the remainder frames cut the silence to length
+	output.Reset()
+	require.NoError(t, ConvertOpusToCafStream(bytes.NewReader(encodeTestOpus(t, 1, header, sizes, 1, 0)), output))
+	cf = decodeCafBytes(t, output.Bytes())
+	position, err = cf.InsertSilence(100*960-312, 1000)
+	require.NoError(t, err)
+	require.Equal(t, int64(100*960-312), position)
+	pakt = packetTable(reencoded(cf))
+	require.Equal(t, CAFPacketTableHeader{102, 100*960 - 312 + 1000, 312, 80}, pakt.Header)
+
+	// Every stream of multistream Opus gets a silence frame
+	surround := OggHeader{Version: 1, Channels: 3, SampleRate: 48000, ChannelMap: 1, StreamCount: 2, CoupledCount: 1, ChannelMapping: []uint8{0, 2, 1}}
+	output.Reset()
+	require.NoError(t, ConvertOpusToCafStream(bytes.NewReader(encodeTestOpus(t, 1, surround, []int{10, 10}, 1, 0)), output))
+	cf = decodeCafBytes(t, output.Bytes())
+	_, err = cf.InsertSilence(0, 960)
+	require.NoError(t, err)
+	require.Equal(t, []byte{31<<3 | 0x04, 2, 0xff, 0xfe, 31 << 3, 0xff, 0xfe}, cf.findChunk(ChunkAudioData).Contents.(*DataX).Bytes[:7])
+}
+
+func sum(values []uint64) uint64 {
+	total := uint64(0)
+	for _, value := range values {
+		total += value
+	}
+	return total
+}
+
+func TestAppendingToCaf(t *testing.T) {
+	header := OggHeader{Version: 1, Channels: 2, PreSkip: 312, SampleRate: 48000}
+	first := encodeTestOpus(t, 1, header, []int{10, 20, 30}, 1, 100)
+	second := encodeTestOpus(t, 2, header, []int{40, 50}, 2, 200)
+	secondFile := "output_append.opus"
+	require.NoError(t, os.WriteFile(secondFile, second, 0o644))
+	defer os.Remove(secondFile)
+
+	// A streamed CAF has its packet table ahead of a data chunk of size -1
+	streamed := &bytes.Buffer{}
+	require.NoError(t, ConvertOpusToCafStream(bytes.NewReader(first), streamed))
+	cafFile := "output_append.caf"
+	require.NoError(t, os.WriteFile(cafFile, streamed.Bytes(), 0o644))
+	defer os.Remove(cafFile)
+
+	_, err := AppendOpusToCaf(cafFile, secondFile, ConvertOptions{})
+	require.NoError(t, err)
+	cf := decodeCafFile(t, cafFile)
+	var types []string
+	for _, chunk := range cf.Chunks {
+		types = append(types, string(chunk.Header.ChunkType[:]))
+	}
+	require.Equal(t, []string{"desc", "chan", "info", "free", "data", "pakt"}, types)
+	pakt := cf.findChunk(ChunkPacketTable).Contents.(*CAFPacketTable)
+	require.Equal(t, []uint64{10, 20, 30, 40, 50}, pakt.Entry)
+	require.Equal(t, CAFPacketTableHeader{5, 5*960 - 312 - 200, 312, 200}, pakt.Header)
+	require.Equal(t, int64(150+4), cf.findChunk(ChunkAudioData).Header.ChunkSize)
+	require.Equal(t, uint32(960), cf.findChunk(ChunkeAudioDescription).Contents.(*CAFAudioFormat).FramesPerPacket)
+
+	// Chunks after the data chunk move behind the new audio, the ones ahead of it stay
+	cf = decodeCafBytes(t, streamed.Bytes())
+	info := *cf.findChunk(ChunkInformation)
+	cf.Chunks = []CAFChunk{cf.Chunks[0], cf.Chunks[1], *cf.findChunk(ChunkAudioData), *cf.findChunk(ChunkPacketTable), info}
+	cf.Chunks[2].Header.ChunkSize = 60 + 4
+	rearranged := &bytes.Buffer{}
+	require.NoError(t, cf.Encode(rearranged))
+	require.NoError(t, os.WriteFile(cafFile, rearranged.Bytes(), 0o644))
+
+	otherFile := "output_append_other.caf"
+	require.NoError(t, os.WriteFile(otherFile, append([]byte(nil), streamed.Bytes()...), 0o644))
+	defer os.Remove(otherFile)
+	require.NoError(t, AppendCafToCaf(cafFile, otherFile))
+	appended, err := os.ReadFile(cafFile)
+	require.NoError(t, err)
+	dataStart := bytes.Index(rearranged.Bytes(), []byte("data"))
+	require.Equal(t, rearranged.Bytes()[:dataStart], appended[:dataStart])
+	cf = decodeCafBytes(t, appended)
+	types = nil
+	for _, chunk := range cf.Chunks {
+		types = append(types, string(chunk.Header.ChunkType[:]))
+	}
+	require.Equal(t, []string{"desc", "chan", "data", "info", "pakt"}, types)
+	require.Equal(t, info, *cf.findChunk(ChunkInformation))
+	pakt = cf.findChunk(ChunkPacketTable).Contents.(*CAFPacketTable)
+	require.Equal(t, []uint64{10, 20, 30, 10, 20, 30}, pakt.Entry)
+	require.Equal(t, CAFPacketTableHeader{6, 6*960 - 312 - 100, 312, 100}, pakt.Header)
+
+	// Other channels cannot be appended
+	mono := encodeTestOpus(t, 3, OggHeader{Version: 1, Channels: 1, SampleRate: 48000}, []int{10}, 3, 0)
+	require.NoError(t, os.WriteFile(secondFile, mono, 0o644))
+	_, err = AppendOpusToCaf(cafFile, secondFile, ConvertOptions{})
+	require.ErrorIs(t, err, errIncompatibleAppend)
+	unchanged, err := os.ReadFile(cafFile)
+	require.NoError(t, err)
+	require.Equal(t, appended, unchanged)
+
+	// A source that fails part way leaves the CAF as it was
+	sizes := make([]int, 1000)
+	for i := range sizes {
+		sizes[i] = 100
+	}
+	damaged := encodeTestOpus(t, 4, header, sizes, 4, 0)
+	pages := splitOggPages(damaged)
+	// The last byte of the second to last page
+	damaged[len(damaged)-len(pages[len(pages)-1])-1] ^= 0xff
+	require.NoError(t, os.WriteFile(secondFile, damaged, 0o644))
+	_, err = AppendOpusToCaf(cafFile, secondFile, ConvertOptions{})
+	var crcErr *OggCRCError
+	require.ErrorAs(t, err, &crcErr)
+	unchanged, err = os.ReadFile(cafFile)
+	require.NoError(t, err)
+	require.Equal(t, appended, unchanged)
+	decodeCafBytes(t, unchanged)
+
+	// A CAF that cannot be restored either is reported as damaged, with
+	// the error that stopped the append
+	readOnly, err := os.Open(cafFile)
+	require.NoError(t, err)
+	defer readOnly.Close()
+	restoreErr := restoreCaf(readOnly, unchanged[:10], nil, 10, int64(len(unchanged)))
+	require.Error(t, restoreErr)
+	err = &AppendRestoreError{Err: crcErr, RestoreErr: restoreErr}
+	require.ErrorAs(t, err, &crcErr)
+	require.Contains(t, err.Error(), "damaged")
+}
+
+func TestCAFWriter(t *testing.T) {
+	// 16 bit stereo PCM has a constant packet size and duration
+	desc := CAFAudioFormat{
+		SampleRate:        44100,
+		FormatID:          NewFourByteStr("lpcm"),
+		BytesPerPacket:    4,
+		FramesPerPacket:   1,
+		BitsPerChannel:    16,
+		ChannelsPerPacket: 2,
+	}
+	chanChunk := NewChannelLayoutChunk(CAFChannelLayout{ChannelLayoutTag: kCAFChannelLayoutTag_Stereo})
+	writePCM := func(w io.Writer, priming int32, remainder int32) {
+		cw, err := NewCAFWriter(w, desc, chanChunk)
+		require.NoError(t, err)
+		for i := 0; i < 10; i++ {
+			require.NoError(t, cw.WritePacket([]byte{byte(i), 0, byte(i), 1}, 1))
+		}
+		require.Equal(t, errPacketSizeMismatch, cw.WritePacket([]byte{1, 2, 3}, 1))
+		require.Equal(t, errPacketFramesMismatch, cw.WritePacket([]byte{1, 2, 3, 4}, 2))
+		cw.SetTrim(priming, remainder)
+		require.NoError(t, cw.Close())
+		require.Equal(t, errWriterClosed, cw.WritePacket([]byte{1, 2, 3, 4}, 1))
+		require.Equal(t, errWriterClosed, cw.Close())
+	}
+
+	outputFile := "output_writer.caf"
+	defer os.Remove(outputFile)
+	for _, trim := range [][2]int32{{0, 0}, {2, 3}} {
+		outFile, err := os.Create(outputFile)
+		require.NoError(t, err)
+		writePCM(outFile, trim[0], trim[1])
+		require.NoError(t, outFile.Close())
+		seekable := decodeCafFile(t, outputFile)
+
+		streamed := &bytes.Buffer{}
+		writePCM(streamed, trim[0], trim[1])
+		cf := decodeCafBytes(t, streamed.Bytes())
+
+		for _, cf := range []*CAFFileData{seekable, cf} {
+			require.Equal(t, desc, *cf.findChunk(ChunkeAudioDescription).Contents.(*CAFAudioFormat))
+			require.NotNil(t, cf.findChunk(ChunkChannelLayout))
+			data := cf.findChunk(ChunkAudioData).Contents.(*DataX).Bytes
+			require.Len(t, data, 40)
+			require.Equal(t, []byte{9, 0, 9, 1}, data[36:])
+
+			// Constant formats only get a packet table for their trimming
+			paktChunk := cf.findChunk(ChunkPacketTable)
+			if trim[0] == 0 && trim[1] == 0 {
+				require.Nil(t, paktChunk)
+				continue
+			}
+			pakt := paktChunk.Contents.(*CAFPacketTable)
+			require.Equal(t, CAFPacketTableHeader{10, 5, 2, 3}, pakt.Header)
+			require.Empty(t, pakt.Entry)
+
+			packets, err := cf.Packets()
+			require.NoError(t, err)
+			packet, err := packets.Next()
+			require.NoError(t, err)
+			require.Equal(t, int64(-2), packet.StartFrame)
+		}
+		require.Equal(t, int64(40+4), seekable.findChunk(ChunkAudioData).Header.ChunkSize)
+		require.Equal(t, int64(-1), cf.findChunk(ChunkAudioData).Header.ChunkSize)
+	}
+
+	// A constant packet size needs a constant packet duration
+	desc.FramesPerPacket = 0
+	_, err := NewCAFWriter(&bytes.Buffer{}, desc)
+	require.Equal(t, errMissingFramesPerPacket, err)
+
+	// Variable formats get their frames per packet once the packets are known
+	opusDesc := opusAudioFormat(&OggHeader{Channels: 1})
+	for _, frames := range [][]uint32{{960, 960, 960}, {960, 480, 960}} {
+		streamed := &bytes.Buffer{}
+		cw, err := NewCAFWriter(streamed, opusDesc)
+		require.NoError(t, err)
+		for i, packetFrames := range frames {
+			require.NoError(t, cw.WritePacket(make([]byte, i+1), packetFrames))
+		}
+		require.NoError(t, cw.Close())
+		cf := decodeCafBytes(t, streamed.Bytes())
+		pakt := cf.findChunk(ChunkPacketTable).Contents.(*CAFPacketTable)
+		require.Equal(t, []uint64{1, 2, 3}, pakt.Entry)
+		if frames[1] == 960 {
+			require.Equal(t, uint32(960), cf.findChunk(ChunkeAudioDescription).Contents.(*CAFAudioFormat).FramesPerPacket)
+			require.Nil(t, pakt.Frames)
+		} else {
+			require.Equal(t, uint32(0), cf.findChunk(ChunkeAudioDescription).Contents.(*CAFAudioFormat).FramesPerPacket)
+			require.Equal(t, []uint64{960, 480, 960}, pakt.Frames)
+		}
+	}
+}
+
+func TestPacketWriter(t *testing.T) {
+	header := &OggHeader{Version: 1, Channels: 2, PreSkip: 312, SampleRate: 48000}
+	packet := func(size int) []byte {
+		return append([]byte{31 << 3}, bytes.Repeat([]byte{1}, size-1)...)
+	}
+	tags := &OpusTags{Vendor: "webrtc", Comments: []OpusComment{{Key: "TITLE", Value: "Call"}}}
+	options := PacketWriterOptions{FlushInterval: 40 * time.Millisecond, Tags: tags}
+
+	outputFile := "output_packet_writer.caf"
+	defer os.Remove(outputFile)
+	outFile, err := os.Create(outputFile)
+	require.NoError(t, err)
+	defer outFile.Close()
+	pw, err := NewPacketWriter(outFile, header, options)
+	require.NoError(t, err)
+
+	// Packets from a channel, the durations come from the TOC bytes
+	packets := make(chan []byte, 3)
+	for _, size := range []int{10, 20, 30} {
+		packets <- packet(size)
+	}
+	close(packets)
+	require.NoError(t, pw.WriteFrom(func() ([]byte, uint32, error) {
+		data, ok := <-packets
+		if !ok {
+			return nil, 0, io.EOF
+		}
+		return data, 0, nil
+	}))
+
+	// The file plays up to the flush after the second packet
+	cf := decodeCafFile(t, outputFile)
+	pakt := cf.findChunk(ChunkPacketTable).Contents.(*CAFPacketTable)
+	require.Equal(t, []uint64{10, 20}, pakt.Entry)
+	require.Equal(t, CAFPacketTableHeader{2, 2*960 - 312, 312, 0}, pakt.Header)
+	require.Equal(t, int64(30+4), cf.findChunk(ChunkAudioData).Header.ChunkSize)
+	require.Equal(t, uint32(960), cf.findChunk(ChunkeAudioDescription).Contents.(*CAFAudioFormat).FramesPerPacket)
+	require.Contains(t, cf.findChunk(ChunkInformation).Contents.(*CAFStringsChunk).Strings, Information{Key: "title\x00", Value: "Call\x00"})
+
+	require.NoError(t, pw.WritePacket(packet(40)[:20], 480))
+	require.NoError(t, pw.Close())
+	require.Equal(t, errWriterClosed, pw.WritePacket(packet(10), 960))
+	cf = decodeCafFile(t, outputFile)
+	pakt = cf.findChunk(ChunkPacketTable).Contents.(*CAFPacketTable)
+	require.Equal(t, []uint64{10, 20, 30, 20}, pakt.Entry)
+	require.Equal(t, []uint64{960, 960, 960, 480}, pakt.Frames)
+	require.Equal(t, CAFPacketTableHeader{4, 3*960 + 480 - 312, 312, 0}, pakt.Header)
+	require.Equal(t, uint32(0), cf.findChunk(ChunkeAudioDescription).Contents.(*CAFAudioFormat).FramesPerPacket)
+	recorded, err := os.ReadFile(outputFile)
+	require.NoError(t, err)
+
+	// A writer that cannot seek gets the same audio on Close
+	streamed := &bytes.Buffer{}
+	pw, err = NewPacketWriter(streamed, header, options)
+	require.NoError(t, err)
+	for _, size := range []int{10, 20, 30} {
+		require.NoError(t, pw.WritePacket(packet(size), 960))
+	}
+	require.NoError(t, pw.WritePacket(packet(40)[:20], 480))
+	require.Zero(t, streamed.Len())
+	require.NoError(t, pw.Close())
+	cf = decodeCafBytes(t, streamed.Bytes())
+	require.Equal(t, pakt, cf.findChunk(ChunkPacketTable).Contents.(*CAFPacketTable))
+	require.Equal(t, decodeCafBytes(t, recorded).findChunk(ChunkAudioData).Contents, cf.findChunk(ChunkAudioData).Contents)
+
+	// The pre-skip cannot be more than the audio
+	streamed.Reset()
+	pw, err = NewPacketWriter(streamed, header, PacketWriterOptions{})
+	require.NoError(t, err)
+	require.NoError(t, pw.WritePacket(packet(10)[:5], 120))
+	require.NoError(t, pw.Close())
+	cf = decodeCafBytes(t, streamed.Bytes())
+	require.Equal(t, CAFPacketTableHeader{1, 0, 120, 0}, cf.findChunk(ChunkPacketTable).Contents.(*CAFPacketTable).Header)
+	require.Nil(t, cf.findChunk(ChunkInformation))
+
+	_, err = NewPacketWriter(streamed, &OggHeader{Version: 1, Channels: 3}, PacketWriterOptions{})
+	require.Equal(t, errBadStreamConfig, err)
+
+	// A recording cut after a flush and part of the next packets still
+	// plays up to the flush
+	outFile, err = os.OpenFile(outputFile, os.O_RDWR|os.O_TRUNC, 0)
+	require.NoError(t, err)
+	cw, err := NewCAFWriter(outFile, opusAudioFormat(header))
+	require.NoError(t, err)
+	for _, size := range []int{10, 20, 30} {
+		require.NoError(t, cw.WritePacket(packet(size), 960))
+	}
+	cw.SetTrim(312, 0)
+	require.NoError(t, cw.Flush())
+	flushed, err := os.ReadFile(outputFile)
+	require.NoError(t, err)
+	for round := 0; round < 3; round++ {
+		// The second packet only partly fits the buffer, which goes out
+		require.NoError(t, cw.WritePacket(packet(20000), 960))
+		require.NoError(t, cw.WritePacket(packet(20000), 960))
+		cut, err := os.ReadFile(outputFile)
+		require.NoError(t, err)
+		require.Greater(t, len(cut), len(flushed))
+		cf = decodeCafBytes(t, cut)
+		require.Equal(t, decodeCafBytes(t, flushed).findChunk(ChunkPacketTable).Contents, cf.findChunk(ChunkPacketTable).Contents)
+		require.NoError(t, cw.Flush())
+		flushed, err = os.ReadFile(outputFile)
+		require.NoError(t, err)
+	}
+	require.NoError(t, cw.Close())
+	cf = decodeCafFile(t, outputFile)
+	pakt = cf.findChunk(ChunkPacketTable).Contents.(*CAFPacketTable)
+	require.Len(t, pakt.Entry, 9)
+	require.Equal(t, int64(60+6*20000+4), cf.findChunk(ChunkAudioData).Header.ChunkSize)
+	require.Nil(t, cf.findChunk(ChunkFree))
+
+	// Constant formats keep a data chunk running to the end of the file
+	outFile, err = os.OpenFile(outputFile, os.O_RDWR|os.O_TRUNC, 0)
+	require.NoError(t, err)
+	desc := CAFAudioFormat{SampleRate: 44100, FormatID: NewFourByteStr("lpcm"), BytesPerPacket: 4, FramesPerPacket: 1, BitsPerChannel: 16, ChannelsPerPacket: 2}
+	cw, err = NewCAFWriter(outFile, desc)
+	require.NoError(t, err)
+	require.NoError(t, cw.WritePacket([]byte{1, 2, 3, 4}, 1))
+	require.NoError(t, cw.Flush())
+	_, err = outFile.Write([]byte{5, 6})
+	require.NoError(t, err)
+	require.Len(t, decodeCafFile(t, outputFile).findChunk(ChunkAudioData).Contents.(*DataX).Bytes, 6)
+	require.NoError(t, outFile.Close())
+}
+
+func TestCrashRecovery(t *testing.T) {
+	header := &OggHeader{Version: 1, Channels: 2, PreSkip: 312, SampleRate: 48000}
+	packet := func(size int) []byte {
+		return append([]byte{31 << 3}, bytes.Repeat([]byte{byte(size)}, size-1)...)
+	}
+	tags := &OpusTags{Comments: []OpusComment{{Key: "TITLE", Value: "Call"}}}
+	recordingFile := "output_crash.caf"
+	recoveredFile := "output_crash_recovered.caf"
+	defer os.Remove(recordingFile)
+	defer os.Remove(recordingFile + PacketIndexSuffix)
+	defer os.Remove(recoveredFile)
+
+	// A recording that is flushed every two packets and never closed
+	outFile, err := os.Create(recordingFile)
+	require.NoError(t, err)
+	pw, err := NewPacketWriter(outFile, header, PacketWriterOptions{FlushInterval: 40 * time.Millisecond, Tags: tags, CrashSafe: true})
+	require.NoError(t, err)
+	for _, size := range []int{10, 20, 30, 40, 50} {
+		require.NoError(t, pw.WritePacket(packet(size), 960))
+	}
+	require.NoError(t, outFile.Close())
+
+	report, err := RecoverCaf(recordingFile, "", recoveredFile)
+	require.NoError(t, err)
+	require.Equal(t, &RecoveryReport{Packets: 4, Frames: 4*960 - 312}, report)
+	cf := decodeCafFile(t, recoveredFile)
+	var types []string
+	for _, chunk := range cf.Chunks {
+		types = append(types, string(chunk.Header.ChunkType[:]))
+	}
+	require.Equal(t, []string{"desc", "chan", "info", "data", "pakt"}, types)
+	require.Contains(t, cf.findChunk(ChunkInformation).Contents.(*CAFStringsChunk).Strings, Information{Key: "title\x00", Value: "Call\x00"})
+	pakt := cf.findChunk(ChunkPacketTable).Contents.(*CAFPacketTable)
+	require.Equal(t, []uint64{10, 20, 30, 40}, pakt.Entry)
+	require.Equal(t, CAFPacketTableHeader{4, 4*960 - 312, 312, 0}, pakt.Header)
+	var data []byte
+	for _, size := range []int{10, 20, 30, 40} {
+		data = append(data, packet(size)...)
+	}
+	require.Equal(t, data, cf.findChunk(ChunkAudioData).Contents.(*DataX).Bytes)
+
+	// A packet cut short is lost
+	contents, err := os.ReadFile(recordingFile)
+	require.NoError(t, err)
+	dataStart := bytes.Index(contents, []byte("data")) + cafChunkHeaderSize + dataEditCountSize
+	require.NoError(t, os.WriteFile(recordingFile, contents[:dataStart+100-15], 0o644))
+	report, err = RecoverCaf(recordingFile, "", recoveredFile)
+	require.NoError(t, err)
+	require.Equal(t, &RecoveryReport{Packets: 3, Frames: 3*960 - 312, LostBytes: 25}, report)
+
+	// Variable packets need the index
+	indexFile := recordingFile + PacketIndexSuffix
+	index, err := os.ReadFile(indexFile)
+	require.NoError(t, err)
+	require.NoError(t, os.Remove(indexFile))
+	_, err = RecoverCaf(recordingFile, "", recoveredFile)
+	require.Equal(t, errMissingPacketIndex, err)
+	require.NoError(t, os.WriteFile(indexFile, []byte("junk"), 0o644))
+	_, err = RecoverCaf(recordingFile, "", recoveredFile)
+	require.Equal(t, errBadPacketIndex, err)
+
+	// An index cut in the middle of a record still works
+	require.NoError(t, os.WriteFile(indexFile, append(index, packetIndexPacket, 0x81), 0o644))
+	report, err = RecoverCaf(recordingFile, indexFile, recoveredFile)
+	require.NoError(t, err)
+	require.Equal(t, 3, report.Packets)
+
+	// A closed recording leaves no index behind
+	outFile, err = os.Create(recordingFile)
+	require.NoError(t, err)
+	pw, err = NewPacketWriter(outFile, header, PacketWriterOptions{CrashSafe: true})
+	require.NoError(t, err)
+	require.NoError(t, pw.WritePacket(packet(10), 960))
+	require.NoError(t, pw.Close())
+	require.NoError(t, outFile.Close())
+	_, err = os.Stat(indexFile)
+	require.True(t, os.IsNotExist(err))
+
+	// Nor does a crash-safe conversion, whose index matches the CAF
+	opusFile := "output_crash.opus"
+	defer os.Remove(opusFile)
+	require.NoError(t, os.WriteFile(opusFile, encodeTestOpus(t, 1, *header, []int{10, 20, 30}, 1, 100), 0o644))
+	_, err = ConvertOpusToCafWithOptions(opusFile, recordingFile, ConvertOptions{CrashSafe: true})
+	require.NoError(t, err)
+	_, err = os.Stat(indexFile)
+	require.True(t, os.IsNotExist(err))
+
+	outFile, err = os.OpenFile(recordingFile, os.O_RDWR|os.O_TRUNC, 0)
+	require.NoError(t, err)
+	cw, err := NewCAFWriter(outFile, opusAudioFormat(header))
+	require.NoError(t, err)
+	require.NoError(t, cw.WritePacket(packet(10), 960))
+	// The index catches up with the packets already written
+	indexBuffer := &bytes.Buffer{}
+	require.NoError(t, cw.SetPacketIndex(indexBuffer))
+	require.NoError(t, cw.WritePacket(packet(20), 480))
+	cw.SetTrim(312, 100)
+	require.NoError(t, cw.Close())
+	require.NoError(t, outFile.Close())
+	require.NoError(t, os.WriteFile(indexFile, indexBuffer.Bytes(), 0o644))
+	report, err = RecoverCaf(recordingFile, "", recoveredFile)
+	require.NoError(t, err)
+	require.Equal(t, &RecoveryReport{Packets: 2, Frames: 960 + 480 - 312 - 100}, report)
+	recovered, err := os.ReadFile(recoveredFile)
+	require.NoError(t, err)
+	written, err := os.ReadFile(recordingFile)
+	require.NoError(t, err)
+	require.Equal(t, written, recovered)
+
+	// Constant formats need no index
+	require.NoError(t, os.Remove(indexFile))
+	outFile, err = os.OpenFile(recordingFile, os.O_RDWR|os.O_TRUNC, 0)
+	require.NoError(t, err)
+	desc := CAFAudioFormat{SampleRate: 44100, FormatID: NewFourByteStr("lpcm"), BytesPerPacket: 4, FramesPerPacket: 1, BitsPerChannel: 16, ChannelsPerPacket: 2}
+	cw, err = NewCAFWriter(outFile, desc)
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		require.NoError(t, cw.WritePacket([]byte{byte(i), 0, byte(i), 0}, 1))
+	}
+	require.NoError(t, cw.Flush())
+	require.NoError(t, cw.WritePacket([]byte{1, 2, 3, 4}, 1))
+	require.NoError(t, cw.Flush())
+	require.NoError(t, outFile.Close())
+	report, err = RecoverCaf(recordingFile, "", recoveredFile)
+	require.NoError(t, err)
+	require.Equal(t, &RecoveryReport{Packets: 11, Frames: 11}, report)
+
+	// A conversion that fails part way leaves an index to recover with,
+	// which trims the pre-skip although the end was never reached
+	contents, err = os.ReadFile("samples/sample_mono_48000.opus")
+	require.NoError(t, err)
+	pages := splitOggPages(contents)
+	damagedAt := len(contents) - len(pages[len(pages)-1]) - len(pages[len(pages)-2])
+	contents[damagedAt+100] ^= 0xff
+	require.NoError(t, os.WriteFile(opusFile, contents, 0o644))
+	_, err = ConvertOpusToCafWithOptions(opusFile, recordingFile, ConvertOptions{CrashSafe: true})
+	var crcErr *OggCRCError
+	require.ErrorAs(t, err, &crcErr)
+	report, err = RecoverCaf(recordingFile, "", recoveredFile)
+	require.NoError(t, err)
+	require.Greater(t, report.Packets, 0)
+
+	expected := &bytes.Buffer{}
+	_, err = ConvertOpusToCafStreamWithOptions(bytes.NewReader(contents), expected, ConvertOptions{Lenient: true})
+	require.NoError(t, err)
+	expectedCaf := decodeCafBytes(t, expected.Bytes())
+	expectedPakt := expectedCaf.findChunk(ChunkPacketTable).Contents.(*CAFPacketTable)
+	cf = decodeCafFile(t, recoveredFile)
+	pakt = cf.findChunk(ChunkPacketTable).Contents.(*CAFPacketTable)
+	require.Equal(t, expectedPakt.Header.PrimingFrames, pakt.Header.PrimingFrames)
+	require.Equal(t, int32(0), pakt.Header.RemainderFrames)
+	require.Equal(t, expectedPakt.Entry[:report.Packets], pakt.Entry)
+	recoveredData := cf.findChunk(ChunkAudioData).Contents.(*DataX).Bytes
+	require.Equal(t, expectedCaf.findChunk(ChunkAudioData).Contents.(*DataX).Bytes[:len(recoveredData)], recoveredData)
+}
+
+func TestProgressiveConversion(t *testing.T) {
+	header := OggHeader{Version: 1, Channels: 2, PreSkip: 312, SampleRate: 48000}
+	sizes := make([]int, 40)
+	for i := range sizes {
+		sizes[i] = 200 + 10*i
+	}
+	opus := encodeTestOpus(t, 1, header, sizes, 1, 100)
+	expected := &bytes.Buffer{}
+	require.NoError(t, ConvertOpusToCafStream(bytes.NewReader(opus), expected))
+
+	// Bytes arrive a few at a time, the CAF so far is a prefix of the audio
+	p, err := NewProgressiveConverter(ConvertOptions{})
+	require.NoError(t, err)
+	require.Equal(t, errProgressiveNotReady, p.WriteCaf(&bytes.Buffer{}))
+	prefixes := 0
+	for offset := 0; offset < len(opus); offset += 7 {
+		end := offset + 7
+		if end > len(opus) {
+			end = len(opus)
+		}
+		_, err := p.Write(opus[offset:end])
+		require.NoError(t, err)
+		if offset%2100 != 0 || p.WriteCaf(&bytes.Buffer{}) == errProgressiveNotReady {
+			continue
+		}
+		prefix := &bytes.Buffer{}
+		require.NoError(t, p.WriteCaf(prefix))
+		pakt := decodeCafBytes(t, prefix.Bytes()).findChunk(ChunkPacketTable).Contents.(*CAFPacketTable)
+		packets := len(pakt.Entry)
+		require.Equal(t, sizes[:packets], toInts(pakt.Entry))
+		require.Zero(t, pakt.Header.RemainderFrames)
+		require.Equal(t, int64(packets*960), int64(pakt.Header.PrimingFrames)+pakt.Header.NumberValidFrames)
+		prefixes++
+	}
+	require.Greater(t, prefixes, 3)
+	require.True(t, p.Ended())
+	require.NoError(t, p.Close())
+	converted := &bytes.Buffer{}
+	require.NoError(t, p.WriteCaf(converted))
+	require.Equal(t, expected.Bytes(), converted.Bytes())
+	_, err = p.Write([]byte{0})
+	require.Equal(t, errProgressiveInputClosed, err)
+
+	// A download cut in the middle of a page keeps the pages before it
+	p, err = NewProgressiveConverter(ConvertOptions{})
+	require.NoError(t, err)
+	_, err = p.Write(opus[:len(opus)/2])
+	require.NoError(t, err)
+	require.Equal(t, io.ErrUnexpectedEOF, p.Close())
+	require.NoError(t, p.WriteCaf(converted))
+
+	_, err = NewProgressiveConverter(ConvertOptions{Start: time.Second})
+	require.Equal(t, errProgressiveOptions, err)
+
+	// Following a file that is still being written
+	inputFile := "output_follow.opus"
+	outputFile := "output_follow.caf"
+	defer os.Remove(inputFile)
+	defer os.Remove(outputFile)
+	require.NoError(t, os.WriteFile(inputFile, opus[:len(opus)/3], 0o644))
+	done := make(chan error)
+	go func() {
+		_, err := FollowOpusToCaf(inputFile, outputFile, ConvertOptions{}, FollowOptions{Poll: 5 * time.Millisecond})
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	pakt := decodeCafFile(t, outputFile).findChunk(ChunkPacketTable).Contents.(*CAFPacketTable)
+	require.NotEmpty(t, pakt.Entry)
+	require.Less(t, len(pakt.Entry), len(sizes))
+	f, err := os.OpenFile(inputFile, os.O_APPEND|os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = f.Write(opus[len(opus)/3:])
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.NoError(t, <-done)
+	followed := decodeCafFile(t, outputFile)
+	cf := decodeCafBytes(t, expected.Bytes())
+	require.Equal(t, cf.findChunk(ChunkPacketTable).Contents, followed.findChunk(ChunkPacketTable).Contents)
+	require.Equal(t, cf.findChunk(ChunkAudioData).Contents, followed.findChunk(ChunkAudioData).Contents)
+
+	// Without the end of the stream, following stops once the file is idle
+	pages := splitOggPages(opus)
+	require.NoError(t, os.WriteFile(inputFile, bytes.Join(pages[:len(pages)-1], nil), 0o644))
+	_, err = FollowOpusToCaf(inputFile, outputFile, ConvertOptions{}, FollowOptions{Poll: 5 * time.Millisecond, Idle: 20 * time.Millisecond})
+	require.NoError(t, err)
+	pakt = decodeCafFile(t, outputFile).findChunk(ChunkPacketTable).Contents.(*CAFPacketTable)
+	require.Less(t, len(pakt.Entry), len(sizes))
+	require.Zero(t, pakt.Header.RemainderFrames)
+}
+
+func toInts(values []uint64) []int {
+	ints := make([]int, len(values))
+	for i, value := range values {
+		ints[i] = int(value)
+	}
+	return ints
+}
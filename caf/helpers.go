@@ -1,7 +1,6 @@
 package caf
 
 import (
-	"bufio"
 	"errors"
 	"io"
 )
@@ -35,7 +34,7 @@ func encodeInt(w io.Writer, i uint64) error {
 	return nil
 }
 
-func decodeInt(r *bufio.Reader) (uint64, error) {
+func decodeInt(r io.ByteReader) (uint64, error) {
 	var res uint64 = 0
 	var bytesRead = 0
 	for {
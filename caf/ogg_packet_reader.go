@@ -0,0 +1,93 @@
+package caf
+
+import "io"
+
+// OggPacket is a packet reassembled from the segments of one or more Ogg pages
+type OggPacket struct {
+	Data []byte
+	// Index is the position of the packet in the logical stream, starting at
+	// 0 for the OpusHead packet
+	Index int
+	// PageHeader is the header of the page the packet ends on
+	PageHeader *OggPageHeader
+	// LastOnPage is set for the last packet that ends on its page, the
+	// granule position of the page is the one of this packet
+	LastOnPage bool
+}
+
+// ReadPacket returns the next packet of the selected stream, joining packets
+// that are continued across pages. Pages of other streams are passed over. At
+// the end of the stream, or where the next link of a chained file starts, it
+// returns io.EOF. Packets that lie within a single page point into the page
+// buffer and are only valid until the next call.
+func (o *OggReader) ReadPacket() (*OggPacket, error) {
+	for len(o.packets) == 0 {
+		if o.ended {
+			return nil, io.EOF
+		}
+		segments, pageHeader, err := o.ParseNextPage()
+		if err != nil {
+			return nil, err
+		}
+		if pageHeader.Serial != o.serial {
+			if pageHeader.HeaderType&pageHeaderTypeBeginningOfStream != 0 {
+				// A new link started without the end of this stream
+				o.unreadPage()
+				o.ended = true
+			}
+			continue
+		}
+		o.queuePackets(segments, pageHeader)
+		if pageHeader.HeaderType&pageHeaderTypeEndOfStream != 0 {
+			o.ended = true
+		}
+	}
+
+	packet := o.packets[0]
+	o.packets = o.packets[1:]
+	return packet, nil
+}
+
+// queuePackets turns the segments of a page into packets, holding back the
+// start of a packet that continues on the next page
+func (o *OggReader) queuePackets(segments [][]byte, pageHeader *OggPageHeader) {
+	continued := pageHeader.HeaderType&pageHeaderTypeContinuedPacket != 0
+	if !continued && o.partialOpen {
+		// The packet never got finished, the page holding its end is missing
+		o.partial = o.partial[:0]
+		o.partialOpen = false
+	}
+
+	for i, segment := range segments {
+		open := i == len(segments)-1 && pageHeader.lastPacketContinues
+
+		if i == 0 && continued {
+			if !o.partialOpen {
+				// Continuation of a packet whose start we never saw
+				continue
+			}
+			o.partial = append(o.partial, segment...)
+			if open {
+				return
+			}
+			segment = append([]byte(nil), o.partial...)
+			o.partial = o.partial[:0]
+			o.partialOpen = false
+		} else if open {
+			o.partial = append(o.partial[:0], segment...)
+			o.partialOpen = true
+			break
+		}
+
+		o.packets = append(o.packets, &OggPacket{
+			Data:       segment,
+			Index:      o.packetsRead,
+			PageHeader: pageHeader,
+		})
+		o.packetsRead++
+	}
+
+	if len(o.packets) > 0 && o.packets[len(o.packets)-1].PageHeader == pageHeader {
+		o.packets[len(o.packets)-1].LastOnPage = true
+	}
+}
@@ -0,0 +1,223 @@
+package caf
+
+import (
+	"errors"
+	"io"
+)
+
+const (
+	// opusPreRoll is the 80 ms RFC 7845 recommends decoding ahead of a seek target
+	opusPreRoll = 3840
+	// seekLinearScanSize is the range below which bisection stops and the
+	// pages are read one by one
+	seekLinearScanSize = 2 * maxPageSize
+	// durationScanSize is how far back from the end Duration looks for the
+	// last page at a time
+	durationScanSize = 64 * 1024
+)
+
+var (
+	errNotSeekable       = errors.New("ogg input is not an io.ReadSeeker")
+	errNoGranulePosition = errors.New("stream has no page with a granule position")
+)
+
+// oggPosition is the reading position of an OggReader, saved around the
+// page reads of a seek so that those do not count as skipped bytes
+type oggPosition struct {
+	offset   int64
+	unread   []byte
+	badPages int
+	skipped  int
+}
+
+// Duration returns the number of samples of the current link after the
+// pre-skip, from the granule position of its last page. The input must be
+// an io.ReadSeeker. The reading position is left unchanged.
+func (o *OggReader) Duration() (int64, error) {
+	seeker, ok := o.source.(io.ReadSeeker)
+	if !ok {
+		return 0, errNotSeekable
+	}
+	end, err := seeker.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	end -= o.origin
+
+	position := o.savePosition()
+	defer o.restorePosition(position)
+
+	// Read a window at the end of the file, and further windows back until
+	// one holds a page of the stream
+	for limit := end; limit > o.linkStart; {
+		start := limit - durationScanSize
+		if start < o.linkStart {
+			start = o.linkStart
+		}
+		if err := o.jump(start); err != nil {
+			return 0, err
+		}
+		last, found := unknownGranulePosition, false
+		for {
+			pageStart, granule, ok, err := o.nextGranulePage(end)
+			if err != nil {
+				return 0, err
+			}
+			if !ok || pageStart >= limit {
+				break
+			}
+			last, found = granule, true
+		}
+		if found {
+			return int64(last) - int64(o.header.PreSkip), nil
+		}
+		limit = start
+	}
+	return 0, errNoGranulePosition
+}
+
+// SeekToSample moves the reader so that the next ReadPacket returns the
+// packet to start decoding from to play from sample, a sample count after
+// the pre-skip. The 80 ms pre-roll RFC 7845 recommends is allowed for. It
+// returns the time of the first sample of that packet, samples up to the
+// requested one are to be dropped after decoding. The input must be an
+// io.ReadSeeker.
+//
+// The page is found by bisection over granule positions: the last page of
+// the stream whose granule position is at or before the target ends a
+// packet, and the packets after it start from there.
+func (o *OggReader) SeekToSample(sample int64) (start int64, err error) {
+	seeker, ok := o.source.(io.ReadSeeker)
+	if !ok {
+		return 0, errNotSeekable
+	}
+	if sample < 0 {
+		return 0, errSeekOutOfRange
+	}
+	end, err := seeker.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	end -= o.origin
+
+	target := uint64(0)
+	if granule := sample + int64(o.header.PreSkip) - opusPreRoll; granule > 0 {
+		target = uint64(granule)
+	}
+
+	// A failed seek leaves the reader where it was
+	position := o.savePosition()
+	defer func() {
+		if err != nil {
+			o.restorePosition(position)
+		}
+	}()
+
+	low, high := o.linkStart, end
+	for high-low > seekLinearScanSize {
+		middle := low + (high-low)/2
+		if err := o.jump(middle); err != nil {
+			return 0, err
+		}
+		pageStart, granule, ok, err := o.nextGranulePage(high)
+		if err != nil {
+			return 0, err
+		}
+		if ok && granule <= target {
+			low = pageStart
+		} else {
+			high = middle
+		}
+	}
+
+	// The header pages have a granule position of 0, so there is always a
+	// page at or before the target
+	if err := o.jump(low); err != nil {
+		return 0, err
+	}
+	best, bestGranule, found := int64(0), uint64(0), false
+	for {
+		pageStart, granule, ok, err := o.nextGranulePage(end)
+		if err != nil {
+			return 0, err
+		}
+		if !ok || granule > target {
+			break
+		}
+		best, bestGranule, found = pageStart, granule, true
+	}
+	if !found {
+		return 0, errNoGranulePosition
+	}
+
+	// Read the page again, keeping only a packet that continues past it
+	if err := o.jump(best); err != nil {
+		return 0, err
+	}
+	segments, pageHeader, err := o.readPage()
+	if err != nil {
+		return 0, err
+	}
+	o.packets = nil
+	o.partial = o.partial[:0]
+	o.partialOpen = false
+	o.ended = pageHeader.HeaderType&pageHeaderTypeEndOfStream != 0
+	if o.packetsRead < opusHeaderPackets {
+		o.packetsRead = opusHeaderPackets
+	}
+	o.queuePackets(segments, pageHeader)
+	o.packets = nil
+	o.badPages = o.badPages[:position.badPages]
+	o.skipped = o.skipped[:position.skipped]
+
+	return int64(bestGranule) - int64(o.header.PreSkip), nil
+}
+
+// nextGranulePage reads pages up to the first one of the selected stream
+// that has a granule position and starts before limit
+func (o *OggReader) nextGranulePage(limit int64) (int64, uint64, bool, error) {
+	for {
+		_, pageHeader, err := o.readPage()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return 0, 0, false, nil
+		}
+		if err != nil {
+			return 0, 0, false, err
+		}
+		pageStart := o.offset - int64(o.pageLen)
+		if pageStart >= limit {
+			return 0, 0, false, nil
+		}
+		if pageHeader.Serial == o.serial && pageHeader.GranulePosition != unknownGranulePosition {
+			return pageStart, pageHeader.GranulePosition, true, nil
+		}
+	}
+}
+
+// jump moves the reader to offset, the next page is searched for from there
+func (o *OggReader) jump(offset int64) error {
+	seeker := o.source.(io.ReadSeeker)
+	if _, err := seeker.Seek(o.origin+offset, io.SeekStart); err != nil {
+		return err
+	}
+	o.stream.Reset(seeker)
+	o.offset = offset
+	o.unread = nil
+	o.resync = true
+	return nil
+}
+
+func (o *OggReader) savePosition() oggPosition {
+	return oggPosition{offset: o.offset, unread: o.unread, badPages: len(o.badPages), skipped: len(o.skipped)}
+}
+
+// restorePosition goes back to a saved position, forgetting what was
+// skipped on the way
+func (o *OggReader) restorePosition(position oggPosition) {
+	if err := o.jump(position.offset); err == nil {
+		o.unread = position.unread
+		o.resync = false
+	}
+	o.badPages = o.badPages[:position.badPages]
+	o.skipped = o.skipped[:position.skipped]
+}
@@ -0,0 +1,82 @@
+package caf
+
+import "io"
+
+// OggStream is a logical stream of a link, identified by its serial number.
+// A multiplexed file has several streams per link, a chained file has one or
+// more links one after another.
+type OggStream struct {
+	Serial uint32
+	// IDHeader is the first packet of the stream, such as OpusHead
+	IDHeader []byte
+}
+
+// IsOpus reports whether the stream carries Opus audio
+func (s OggStream) IsOpus() bool {
+	return len(s.IDHeader) >= len(idPageSignature) && string(s.IDHeader[:len(idPageSignature)]) == idPageSignature
+}
+
+// Streams returns the logical streams of the current link
+func (o *OggReader) Streams() []OggStream {
+	return o.streams
+}
+
+// Serial returns the serial number of the stream being read
+func (o *OggReader) Serial() uint32 {
+	return o.serial
+}
+
+// NextLink skips what is left of the current link of a chained file and
+// returns the header of the next one, or io.EOF when there are no more links
+func (o *OggReader) NextLink() (*OggHeader, error) {
+	for {
+		_, pageHeader, err := o.ParseNextPage()
+		if err == io.ErrUnexpectedEOF {
+			return nil, io.EOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		if pageHeader.HeaderType&pageHeaderTypeBeginningOfStream != 0 {
+			o.unreadPage()
+			return o.readHeaders()
+		}
+	}
+}
+
+// selectStream picks the stream to read from the streams of the link
+func (o *OggReader) selectStream() (OggStream, error) {
+	if o.options.Serial != nil && o.links == 0 {
+		for _, stream := range o.streams {
+			if stream.Serial == *o.options.Serial {
+				if !stream.IsOpus() {
+					return stream, errBadIDPagePayloadSignature
+				}
+				return stream, nil
+			}
+		}
+		return OggStream{}, errStreamNotFound
+	}
+
+	for _, stream := range o.streams {
+		if stream.IsOpus() {
+			return stream, nil
+		}
+	}
+	return OggStream{}, errBadIDPagePayloadSignature
+}
+
+// unreadPage pushes the last page back so that the next ParseNextPage
+// returns it again
+func (o *OggReader) unreadPage() {
+	o.unread = append([]byte(nil), o.pageBuffer[:o.pageLen]...)
+}
+
+// resetPackets starts reading packets of a new stream after its OpusHead
+func (o *OggReader) resetPackets() {
+	o.packets = nil
+	o.partial = o.partial[:0]
+	o.partialOpen = false
+	o.packetsRead = 1
+	o.ended = false
+}
@@ -0,0 +1,149 @@
+package caf
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+const (
+	pageHeaderTypeContinuedPacket = 0x01
+	pageHeaderTypeEndOfStream     = 0x04
+	maxPageSegments               = 255
+	targetPageBodySize            = 4096 // Same flush threshold libogg uses
+	unknownGranulePosition        = ^uint64(0)
+)
+
+// oggCRCTable is the lookup table for the Ogg CRC32 (polynomial 0x04c11db7,
+// no reflection, zero initial value).
+var oggCRCTable = func() [256]uint32 {
+	var table [256]uint32
+	for i := range table {
+		crc := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+func oggCRC32(crc uint32, data []byte) uint32 {
+	for _, b := range data {
+		crc = crc<<8 ^ oggCRCTable[byte(crc>>24)^b]
+	}
+	return crc
+}
+
+// OggWriter packs packets of a single logical stream into Ogg pages
+type OggWriter struct {
+	stream   io.Writer
+	serial   uint32
+	sequence uint32
+
+	segments    []byte
+	body        []byte
+	granule     uint64
+	lastGranule uint64
+	continued   bool
+	started     bool
+}
+
+// NewOggWriter returns a new Ogg writer for the logical stream with the given serial
+func NewOggWriter(out io.Writer, serial uint32) *OggWriter {
+	return &OggWriter{
+		stream:   out,
+		serial:   serial,
+		segments: make([]byte, 0, maxPageSegments),
+		body:     make([]byte, 0, targetPageBodySize),
+		granule:  unknownGranulePosition,
+	}
+}
+
+// WritePacket queues a packet whose last sample ends at granule. Pages are
+// emitted once they are full, packets larger than a page continue on the next one.
+func (o *OggWriter) WritePacket(packet []byte, granule uint64) error {
+	if len(o.body) >= targetPageBodySize {
+		if err := o.writePage(0); err != nil {
+			return err
+		}
+	}
+
+	remaining := packet
+	for first := true; ; first = false {
+		if len(o.segments) == maxPageSegments {
+			if err := o.writePage(0); err != nil {
+				return err
+			}
+			// A page filled right at the start of the packet ends on a
+			// packet boundary, the next one only continues a packet whose
+			// lacing was cut
+			o.continued = !first
+		}
+		size := len(remaining)
+		if size > 255 {
+			size = 255
+		}
+		o.segments = append(o.segments, byte(size))
+		o.body = append(o.body, remaining[:size]...)
+		remaining = remaining[size:]
+		if size < 255 {
+			break
+		}
+	}
+	o.granule = granule
+	o.lastGranule = granule
+	return nil
+}
+
+// Flush emits the pending page so that the next packet starts on a new page
+func (o *OggWriter) Flush() error {
+	if len(o.segments) == 0 {
+		return nil
+	}
+	return o.writePage(0)
+}
+
+// Close emits the last page with the end of stream flag set
+func (o *OggWriter) Close() error {
+	if len(o.segments) == 0 {
+		o.granule = o.lastGranule
+	}
+	return o.writePage(pageHeaderTypeEndOfStream)
+}
+
+func (o *OggWriter) writePage(headerType uint8) error {
+	if !o.started {
+		headerType |= pageHeaderTypeBeginningOfStream
+	}
+	if o.continued {
+		headerType |= pageHeaderTypeContinuedPacket
+	}
+
+	page := make([]byte, pageHeaderLen, pageHeaderLen+len(o.segments)+len(o.body))
+	copy(page, pageHeaderSignature)
+	page[4] = 0 // version
+	page[5] = headerType
+	binary.LittleEndian.PutUint64(page[6:14], o.granule)
+	binary.LittleEndian.PutUint32(page[14:18], o.serial)
+	binary.LittleEndian.PutUint32(page[18:22], o.sequence)
+	page[26] = uint8(len(o.segments))
+	page = append(page, o.segments...)
+	page = append(page, o.body...)
+	binary.LittleEndian.PutUint32(page[22:26], oggCRC32(0, page))
+
+	if _, err := o.stream.Write(page); err != nil {
+		return err
+	}
+
+	o.started = true
+	o.continued = false
+	o.sequence++
+	o.segments = o.segments[:0]
+	o.body = o.body[:0]
+	o.granule = unknownGranulePosition
+	return nil
+}
@@ -1,8 +1,11 @@
 package caf
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 )
 
@@ -11,9 +14,12 @@ const (
 	pageHeaderTypeBeginningOfStream = 0x02
 	pageHeaderSignature             = "OggS"
 	idPageSignature                 = "OpusHead"
+	commentPageSignature            = "OpusTags"
 	pageHeaderLen                   = 27
 	idPagePayloadLength             = 19
 	maxPageSize                     = 65307 // Maximum Ogg page size
+	maxPacketDuration               = 5760  // 120 ms at 48 kHz
+	opusHeaderPackets               = 2     // OpusHead and OpusTags
 )
 
 // Errors
@@ -21,14 +27,79 @@ var (
 	errNilStream                 = errors.New("stream is nil")
 	errBadIDPageSignature        = errors.New("bad header signature")
 	errBadIDPageType             = errors.New("wrong header, expected beginning of stream")
-	errBadIDPageLength           = errors.New("payload for id page must be 19 bytes")
+	errBadIDPageLength           = errors.New("payload for id page is too short for its channel mapping")
+	errBadChannelMapping         = errors.New("bad channel mapping in id page")
 	errBadIDPagePayloadSignature = errors.New("bad payload signature")
+	errBadPageVersion            = errors.New("unsupported ogg page version")
+	errStreamNotFound            = errors.New("no logical stream with the requested serial")
+	errEmptyPacket               = errors.New("opus packet is empty")
+	errMissingFrameCount         = errors.New("opus packet is missing the frame count byte")
+	errZeroFrameCount            = errors.New("opus packet has a frame count of 0")
+	errPacketTooLong             = errors.New("opus packet is longer than 120 ms")
 )
 
-// OggReader is used to read Ogg files and return page payloads
+// OggReaderOptions configures how an OggReader deals with damaged input
+type OggReaderOptions struct {
+	// Lenient skips pages whose CRC does not match instead of failing, the
+	// skipped pages are available from BadPages
+	Lenient bool
+	// Serial selects the logical stream to read from the first link of a
+	// multiplexed file. When nil, or for later links of a chained file, the
+	// first Opus stream is read.
+	Serial *uint32
+}
+
+// OggCRCError is returned for a page whose checksum does not match its contents
+type OggCRCError struct {
+	Serial       uint32
+	PageSequence uint32
+	Offset       int64 // Byte offset of the page in the stream
+	Expected     uint32
+	Actual       uint32
+}
+
+func (e *OggCRCError) Error() string {
+	return fmt.Sprintf("ogg page %d at offset %d has CRC %08x, expected %08x", e.PageSequence, e.Offset, e.Actual, e.Expected)
+}
+
+// SkippedBytes is a run of bytes that was not part of a valid Ogg page, such
+// as an ID3 tag in front of the first page or the remains of a damaged page
+type SkippedBytes struct {
+	Offset int64
+	Length int64
+}
+
+// OggReader is used to read Ogg files and return page payloads or packets
 type OggReader struct {
-	stream     io.Reader
+	stream     *bufio.Reader
 	pageBuffer []byte
+	options    OggReaderOptions
+	offset     int64
+	badPages   []*OggCRCError
+	skipped    []SkippedBytes
+	pageLen    int
+	unread     []byte
+
+	// source is the input, which can be seeked when it is an io.ReadSeeker.
+	// origin is its position when the reader was created, offsets count
+	// from there.
+	source io.Reader
+	origin int64
+	// resync makes the next page read treat a capture pattern with a bad
+	// CRC as a false match, as after a seek into the middle of a page
+	resync bool
+
+	streams   []OggStream
+	serial    uint32
+	header    *OggHeader
+	links     int
+	linkStart int64
+	ended     bool
+
+	packets     []*OggPacket
+	partial     []byte
+	partialOpen bool
+	packetsRead int
 }
 
 // OggHeader is the metadata from the first two pages in the file (ID and Comment)
@@ -38,7 +109,32 @@ type OggHeader struct {
 	PreSkip    uint16
 	SampleRate uint32
 	OutputGain uint16
-	ChannelMap uint8
+	ChannelMap uint8 // Channel mapping family
+
+	// Channel mapping table, only present when ChannelMap is not 0
+	StreamCount    uint8
+	CoupledCount   uint8
+	ChannelMapping []uint8
+	// DemixingMatrix replaces ChannelMapping for mapping family 3. It has a
+	// row per output channel and a column per decoded channel, stored column
+	// by column, with 32767 standing for a gain of 1.
+	DemixingMatrix []int16
+}
+
+// sameChannels reports whether audio decoded with either header has the
+// same channels in the same order, so that packets of both can share a CAF
+func (h *OggHeader) sameChannels(other *OggHeader) bool {
+	if h.Channels != other.Channels || h.ChannelMap != other.ChannelMap ||
+		h.StreamCount != other.StreamCount || h.CoupledCount != other.CoupledCount ||
+		!bytes.Equal(h.ChannelMapping, other.ChannelMapping) || len(h.DemixingMatrix) != len(other.DemixingMatrix) {
+		return false
+	}
+	for i := range h.DemixingMatrix {
+		if h.DemixingMatrix[i] != other.DemixingMatrix[i] {
+			return false
+		}
+	}
+	return true
 }
 
 // OggPageHeader is the metadata for a Page
@@ -50,89 +146,414 @@ type OggPageHeader struct {
 	Serial          uint32
 	Index           uint32
 	SegmentsCount   uint8
+
+	lastPacketContinues bool
 }
 
+// readHeaders reads the beginning of stream pages of a link, one per logical
+// stream, and returns the header of the selected Opus stream
 func (o *OggReader) readHeaders() (*OggHeader, error) {
-	segments, pageHeader, err := o.ParseNextPage()
+	o.streams = o.streams[:0]
+	o.linkStart = o.offset - int64(len(o.unread))
+	for {
+		segments, pageHeader, err := o.ParseNextPage()
+		if err != nil {
+			return nil, err
+		}
+
+		if string(pageHeader.Signature[:]) != pageHeaderSignature {
+			return nil, errBadIDPageSignature
+		}
+
+		if pageHeader.HeaderType&pageHeaderTypeBeginningOfStream == 0 {
+			if len(o.streams) == 0 {
+				return nil, errBadIDPageType
+			}
+			o.unreadPage()
+			break
+		}
+
+		if len(segments) == 0 {
+			return nil, errBadIDPageLength
+		}
+		o.streams = append(o.streams, OggStream{
+			Serial:   pageHeader.Serial,
+			IDHeader: append([]byte(nil), segments[0]...),
+		})
+	}
+
+	stream, err := o.selectStream()
+	if err != nil {
+		return nil, err
+	}
+	header, err := parseOpusHead(stream.IDHeader)
 	if err != nil {
 		return nil, err
 	}
 
-	if string(pageHeader.Signature[:]) != pageHeaderSignature {
-		return nil, errBadIDPageSignature
+	o.serial = stream.Serial
+	o.header = header
+	o.links++
+	o.resetPackets()
+
+	return header, nil
+}
+
+// parseOpusHead parses an OpusHead packet, including the channel mapping
+// table that follows the fixed fields for mapping families other than 0
+func parseOpusHead(idHeader []byte) (*OggHeader, error) {
+	if len(idHeader) < idPagePayloadLength {
+		return nil, errBadIDPageLength
+	}
+
+	if string(idHeader[:8]) != idPageSignature {
+		return nil, errBadIDPagePayloadSignature
 	}
 
-	if pageHeader.HeaderType != pageHeaderTypeBeginningOfStream {
-		return nil, errBadIDPageType
+	header := &OggHeader{
+		Version:    idHeader[8],
+		Channels:   idHeader[9],
+		PreSkip:    binary.LittleEndian.Uint16(idHeader[10:12]),
+		SampleRate: binary.LittleEndian.Uint32(idHeader[12:16]),
+		OutputGain: binary.LittleEndian.Uint16(idHeader[16:18]),
+		ChannelMap: idHeader[18],
+	}
+	if header.Channels == 0 {
+		return nil, errBadChannelMapping
 	}
 
-	if len(segments[0]) != idPagePayloadLength {
+	if header.ChannelMap == 0 {
+		if header.Channels > 2 {
+			return nil, errBadChannelMapping
+		}
+		return header, nil
+	}
+
+	if len(idHeader) < idPagePayloadLength+2 {
 		return nil, errBadIDPageLength
 	}
+	header.StreamCount = idHeader[19]
+	header.CoupledCount = idHeader[20]
+	decodedChannels := int(header.StreamCount) + int(header.CoupledCount)
+	if header.StreamCount == 0 || header.CoupledCount > header.StreamCount || decodedChannels > 255 {
+		return nil, errBadChannelMapping
+	}
 
-	if string(segments[0][:8]) != idPageSignature {
-		return nil, errBadIDPagePayloadSignature
+	switch header.ChannelMap {
+	case 1:
+		if header.Channels > 8 {
+			return nil, errBadChannelMapping
+		}
+	case 2, 3:
+		if _, _, ok := AmbisonicOrder(header.Channels); !ok {
+			return nil, errBadChannelMapping
+		}
 	}
 
-	return &OggHeader{
-		Version:    segments[0][8],
-		Channels:   segments[0][9],
-		PreSkip:    binary.LittleEndian.Uint16(segments[0][10:12]),
-		SampleRate: binary.LittleEndian.Uint32(segments[0][12:16]),
-		OutputGain: binary.LittleEndian.Uint16(segments[0][16:18]),
-		ChannelMap: segments[0][18],
-	}, nil
+	if header.ChannelMap == 3 {
+		matrix := idHeader[21:]
+		if len(matrix) < 2*int(header.Channels)*decodedChannels {
+			return nil, errBadIDPageLength
+		}
+		header.DemixingMatrix = make([]int16, int(header.Channels)*decodedChannels)
+		for i := range header.DemixingMatrix {
+			header.DemixingMatrix[i] = int16(binary.LittleEndian.Uint16(matrix[2*i:]))
+		}
+		return header, nil
+	}
+
+	if len(idHeader) < idPagePayloadLength+2+int(header.Channels) {
+		return nil, errBadIDPageLength
+	}
+	header.ChannelMapping = append([]uint8(nil), idHeader[21:21+int(header.Channels)]...)
+	for _, index := range header.ChannelMapping {
+		if index != 255 && int(index) >= decodedChannels {
+			return nil, errBadChannelMapping
+		}
+	}
+	return header, nil
+}
+
+// AmbisonicOrder returns the ambisonic order of a stream with mapping family
+// 2 or 3 from its channel count, which is (order + 1)^2 optionally followed
+// by 2 channels of non-diegetic stereo
+func AmbisonicOrder(channels uint8) (order int, nonDiegetic bool, ok bool) {
+	for order = 0; order <= 14; order++ {
+		ambisonicChannels := (order + 1) * (order + 1)
+		switch int(channels) {
+		case ambisonicChannels:
+			return order, false, true
+		case ambisonicChannels + 2:
+			return order, true, true
+		}
+	}
+	return 0, false, false
+}
+
+// demixingPermutation returns the channel mapping equivalent to a demixing
+// matrix that only routes decoded channels to output channels at unity gain,
+// and false for a matrix that mixes channels
+func (h *OggHeader) demixingPermutation() ([]uint8, bool) {
+	channels := int(h.Channels)
+	decodedChannels := int(h.StreamCount) + int(h.CoupledCount)
+	mapping := make([]uint8, channels)
+	for row := 0; row < channels; row++ {
+		mapping[row] = 255
+		for column := 0; column < decodedChannels; column++ {
+			switch h.DemixingMatrix[column*channels+row] {
+			case 0:
+			case 32767:
+				if mapping[row] != 255 {
+					return nil, false
+				}
+				mapping[row] = uint8(column)
+			default:
+				return nil, false
+			}
+		}
+	}
+	return mapping, true
+}
+
+// bytes returns the OpusHead packet for the header
+func (h *OggHeader) bytes() []byte {
+	payload := make([]byte, idPagePayloadLength, idPagePayloadLength+2+len(h.ChannelMapping)+2*len(h.DemixingMatrix))
+	copy(payload, idPageSignature)
+	payload[8] = h.Version
+	payload[9] = h.Channels
+	binary.LittleEndian.PutUint16(payload[10:12], h.PreSkip)
+	binary.LittleEndian.PutUint32(payload[12:16], h.SampleRate)
+	binary.LittleEndian.PutUint16(payload[16:18], h.OutputGain)
+	payload[18] = h.ChannelMap
+	if h.ChannelMap != 0 {
+		payload = append(payload, h.StreamCount, h.CoupledCount)
+		payload = append(payload, h.ChannelMapping...)
+		for _, coefficient := range h.DemixingMatrix {
+			payload = binary.LittleEndian.AppendUint16(payload, uint16(coefficient))
+		}
+	}
+	return payload
+}
+
+// encodeOpusTags returns an OpusTags packet with the vendor string and user comments
+func encodeOpusTags(vendor string, comments []string) []byte {
+	size := len(commentPageSignature) + 4 + len(vendor) + 4
+	for _, comment := range comments {
+		size += 4 + len(comment)
+	}
+	payload := make([]byte, 0, size)
+	payload = append(payload, commentPageSignature...)
+	payload = binary.LittleEndian.AppendUint32(payload, uint32(len(vendor)))
+	payload = append(payload, vendor...)
+	payload = binary.LittleEndian.AppendUint32(payload, uint32(len(comments)))
+	for _, comment := range comments {
+		payload = binary.LittleEndian.AppendUint32(payload, uint32(len(comment)))
+		payload = append(payload, comment...)
+	}
+	return payload
 }
 
 // ParseNextPage reads from stream and returns Ogg page segments, header,
-// and an error if there is incomplete page data.
+// and an error if there is incomplete page data or the page CRC does not
+// match. In lenient mode pages with a bad CRC are skipped. Each segment is a
+// packet or the part of a packet held by the page: the first segment
+// continues the previous page's packet when the continued packet flag is set,
+// and the last segment continues on the next page when its lacing ends in 255.
 func (o *OggReader) ParseNextPage() ([][]byte, *OggPageHeader, error) {
-	if _, err := io.ReadFull(o.stream, o.pageBuffer[:pageHeaderLen]); err != nil {
-		return nil, nil, err
+	if o.unread != nil {
+		o.pageLen = copy(o.pageBuffer, o.unread)
+		o.unread = nil
+		return o.splitPage(o.pageBuffer[:o.pageLen])
 	}
+	return o.readPage()
+}
 
-	pageHeader := &OggPageHeader{
-		Signature:       [4]byte{o.pageBuffer[0], o.pageBuffer[1], o.pageBuffer[2], o.pageBuffer[3]},
-		Version:         o.pageBuffer[4],
-		HeaderType:      o.pageBuffer[5],
-		GranulePosition: binary.LittleEndian.Uint64(o.pageBuffer[6:14]),
-		Serial:          binary.LittleEndian.Uint32(o.pageBuffer[14:18]),
-		Index:           binary.LittleEndian.Uint32(o.pageBuffer[18:22]),
-		SegmentsCount:   o.pageBuffer[26],
+// BadPages returns the pages skipped in lenient mode because of a bad CRC
+func (o *OggReader) BadPages() []*OggCRCError {
+	return o.badPages
+}
+
+// Skipped returns the byte ranges that were passed over to find the next
+// valid page
+func (o *OggReader) Skipped() []SkippedBytes {
+	return o.skipped
+}
+
+// readPage reads the next page whose CRC checks out. Bytes that do not start
+// a page are skipped until the next capture pattern. A page with a bad CRC
+// right where the previous page ended is reported as damaged, while one found
+// after skipping bytes is taken to be a false capture pattern and skipped.
+func (o *OggReader) readPage() ([][]byte, *OggPageHeader, error) {
+	resyncing := o.resync
+	o.resync = false
+	for {
+		if err := o.skipToCapturePattern(&resyncing); err != nil {
+			return nil, nil, err
+		}
+
+		page, err := o.peekPage()
+		if err != nil {
+			if err != io.EOF && err != errBadPageVersion {
+				return nil, nil, err
+			}
+			if !resyncing && err == io.EOF {
+				return nil, nil, io.ErrUnexpectedEOF
+			}
+			// Not a complete page, carry on scanning past its capture pattern
+			o.skip(1)
+			resyncing = true
+			continue
+		}
+
+		pageOffset := o.offset
+		expected := binary.LittleEndian.Uint32(page[22:26])
+		if actual := pageCRC(page); actual != expected {
+			if resyncing {
+				o.skip(1)
+				continue
+			}
+			crcErr := &OggCRCError{
+				Serial:       binary.LittleEndian.Uint32(page[14:18]),
+				PageSequence: binary.LittleEndian.Uint32(page[18:22]),
+				Offset:       pageOffset,
+				Expected:     expected,
+				Actual:       actual,
+			}
+			if !o.options.Lenient {
+				o.discard(len(page))
+				return nil, nil, crcErr
+			}
+			// The page length itself may be damaged, so look for the next
+			// page from the byte after this capture pattern
+			o.badPages = append(o.badPages, crcErr)
+			o.skip(1)
+			resyncing = true
+			continue
+		}
+
+		o.pageLen = copy(o.pageBuffer, page)
+		o.discard(len(page))
+		return o.splitPage(o.pageBuffer[:o.pageLen])
 	}
+}
 
-	sizeBuffer := o.pageBuffer[pageHeaderLen : pageHeaderLen+int(pageHeader.SegmentsCount)]
-	if _, err := io.ReadFull(o.stream, sizeBuffer); err != nil {
-		return nil, nil, err
+// skipToCapturePattern skips bytes until the stream is at an "OggS" capture
+// pattern, the skipped bytes are recorded
+func (o *OggReader) skipToCapturePattern(resyncing *bool) error {
+	for {
+		window, err := o.stream.Peek(len(pageHeaderSignature))
+		if err != nil {
+			// Fewer bytes left than a capture pattern. An input that is
+			// still growing may yet complete it.
+			if len(window) > 0 && err == io.EOF {
+				o.skip(len(window))
+			}
+			return err
+		}
+		if string(window) == pageHeaderSignature {
+			return nil
+		}
+
+		*resyncing = true
+		window, _ = o.stream.Peek(o.stream.Buffered())
+		if i := bytes.Index(window[1:], []byte(pageHeaderSignature)); i >= 0 {
+			o.skip(i + 1)
+		} else {
+			// Keep the tail in case the pattern straddles the buffer end
+			o.skip(len(window) - len(pageHeaderSignature) + 1)
+		}
+	}
+}
+
+// peekPage returns the complete page at the current position without
+// consuming it
+func (o *OggReader) peekPage() ([]byte, error) {
+	header, err := o.stream.Peek(pageHeaderLen)
+	if err != nil {
+		return nil, err
+	}
+	if header[4] != 0 {
+		return nil, errBadPageVersion
+	}
+
+	segmentsCount := int(header[26])
+	header, err = o.stream.Peek(pageHeaderLen + segmentsCount)
+	if err != nil {
+		return nil, err
+	}
+	pageSize := pageHeaderLen + segmentsCount
+	for _, size := range header[pageHeaderLen:] {
+		pageSize += int(size)
+	}
+
+	return o.stream.Peek(pageSize)
+}
+
+// skip discards n bytes that are not part of a page
+func (o *OggReader) skip(n int) {
+	if last := len(o.skipped) - 1; last >= 0 && o.skipped[last].Offset+o.skipped[last].Length == o.offset {
+		o.skipped[last].Length += int64(n)
+	} else {
+		o.skipped = append(o.skipped, SkippedBytes{Offset: o.offset, Length: int64(n)})
+	}
+	o.discard(n)
+}
+
+func (o *OggReader) discard(n int) {
+	discarded, _ := o.stream.Discard(n)
+	o.offset += int64(discarded)
+}
+
+// splitPage returns the header and segments of a complete page
+func (o *OggReader) splitPage(page []byte) ([][]byte, *OggPageHeader, error) {
+	pageHeader := &OggPageHeader{
+		Signature:       [4]byte{page[0], page[1], page[2], page[3]},
+		Version:         page[4],
+		HeaderType:      page[5],
+		GranulePosition: binary.LittleEndian.Uint64(page[6:14]),
+		Serial:          binary.LittleEndian.Uint32(page[14:18]),
+		Index:           binary.LittleEndian.Uint32(page[18:22]),
+		SegmentsCount:   page[26],
 	}
 
+	sizeBuffer := page[pageHeaderLen : pageHeaderLen+int(pageHeader.SegmentsCount)]
+	body := page[pageHeaderLen+int(pageHeader.SegmentsCount):]
+
 	segments := make([][]byte, 0, pageHeader.SegmentsCount)
-	offset := pageHeaderLen + int(pageHeader.SegmentsCount)
+	segmentStart := 0
 	segmentSize := 0
 
 	for _, size := range sizeBuffer {
 		segmentSize += int(size)
 		if size < 255 {
-			if offset+segmentSize > len(o.pageBuffer) {
-				return nil, nil, errors.New("segment size exceeds buffer capacity")
-			}
-			if _, err := io.ReadFull(o.stream, o.pageBuffer[offset:offset+segmentSize]); err != nil {
-				return nil, nil, err
-			}
-			segments = append(segments, o.pageBuffer[offset:offset+segmentSize])
-			offset += segmentSize
+			segments = append(segments, body[segmentStart:segmentStart+segmentSize])
+			segmentStart += segmentSize
 			segmentSize = 0
 		}
 	}
+	if len(sizeBuffer) > 0 && sizeBuffer[len(sizeBuffer)-1] == 255 {
+		segments = append(segments, body[segmentStart:])
+		pageHeader.lastPacketContinues = true
+	}
 
 	return segments, pageHeader, nil
 }
 
+// pageCRC computes the checksum of a page with its CRC field taken as zero
+func pageCRC(page []byte) uint32 {
+	crc := oggCRC32(0, page[:22])
+	crc = oggCRC32(crc, []byte{0, 0, 0, 0})
+	return oggCRC32(crc, page[26:])
+}
+
+// silkFrameSizes are the 10, 20, 40 and 60 ms SILK-only frame sizes at 48 kHz
+var silkFrameSizes = [4]uint32{480, 960, 1920, 2880}
+
 func CalculateFrameSize(tocByte int) uint32 {
 	tocConfig := tocByte >> 3
 	switch {
 	case tocConfig < 12:
-		return 960 * (uint32(tocConfig)&3 + 1)
+		return silkFrameSizes[tocConfig&3]
 	case tocConfig < 16:
 		return 480 << (tocConfig & 1)
 	default:
@@ -140,15 +561,59 @@ func CalculateFrameSize(tocByte int) uint32 {
 	}
 }
 
+// PacketDuration returns the number of 48 kHz samples in an Opus packet from
+// the frame size in its TOC byte and the number of frames the packet holds
+func PacketDuration(packet []byte) (uint32, error) {
+	if len(packet) == 0 {
+		return 0, errEmptyPacket
+	}
+
+	frames := uint32(1)
+	switch packet[0] & 0x03 {
+	case 1, 2:
+		frames = 2
+	case 3:
+		if len(packet) < 2 {
+			return 0, errMissingFrameCount
+		}
+		frames = uint32(packet[1] & 0x3f)
+		if frames == 0 {
+			// RFC 6716 section 3.2.5 rules out code 3 packets without frames
+			return 0, errZeroFrameCount
+		}
+	}
+
+	duration := frames * CalculateFrameSize(int(packet[0]))
+	if duration > maxPacketDuration {
+		return 0, errPacketTooLong
+	}
+	return duration, nil
+}
+
 // NewWith returns a new Ogg reader and Ogg header with an io.Reader input
 func NewWith(in io.Reader) (*OggReader, *OggHeader, error) {
+	return NewWithOptions(in, OggReaderOptions{})
+}
+
+// NewWithOptions returns a new Ogg reader and Ogg header with an io.Reader
+// input, handling damaged pages as set in options
+func NewWithOptions(in io.Reader, options OggReaderOptions) (*OggReader, *OggHeader, error) {
 	if in == nil {
 		return nil, nil, errNilStream
 	}
 
 	reader := &OggReader{
-		stream:     in,
+		stream:     bufio.NewReaderSize(in, maxPageSize),
 		pageBuffer: make([]byte, maxPageSize),
+		options:    options,
+		source:     in,
+	}
+	if seeker, ok := in.(io.Seeker); ok {
+		origin, err := seeker.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, nil, err
+		}
+		reader.origin = origin
 	}
 	header, err := reader.readHeaders()
 	if err != nil {
@@ -156,4 +621,4 @@ func NewWith(in io.Reader) (*OggReader, *OggHeader, error) {
 	}
 
 	return reader, header, nil
-}
\ No newline at end of file
+}
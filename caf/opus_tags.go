@@ -0,0 +1,258 @@
+package caf
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errBadOpusTagsSignature = errors.New("bad comment header signature")
+	errBadOpusTagsLength    = errors.New("comment header is too short for its lengths")
+	errMissingOpusTags      = errors.New("stream ends before the comment header")
+)
+
+// MetadataMode sets which OpusTags comments end up in the CAF info chunk
+type MetadataMode int
+
+const (
+	// MetadataPassThrough maps the standard comments to their CAF keys and
+	// copies the others with lower case keys
+	MetadataPassThrough MetadataMode = iota
+	// MetadataStandardOnly keeps only the comments that have a CAF key
+	MetadataStandardOnly
+	// MetadataStrip writes no info chunk at all
+	MetadataStrip
+)
+
+// cafInfoKeys maps Vorbis comment fields to the keys of the CAF info chunk
+var cafInfoKeys = map[string]string{
+	"TITLE":       "title",
+	"ARTIST":      "artist",
+	"ALBUM":       "album",
+	"TRACKNUMBER": "track number",
+	"DATE":        "recorded date",
+	"GENRE":       "genre",
+	"COMMENT":     "comments",
+	"COPYRIGHT":   "copyright",
+	"ENCODER":     "encoding application",
+}
+
+// cafInfoSourceEncoder holds the OpusTags vendor string in the info chunk
+const cafInfoSourceEncoder = "source encoder"
+
+// OpusComment is a user comment of the OpusTags header
+type OpusComment struct {
+	Key   string
+	Value string
+}
+
+// OpusTags is the comment header of an Ogg Opus stream
+type OpusTags struct {
+	Vendor   string
+	Comments []OpusComment
+}
+
+// Get returns the values of the comments with the given key, which is
+// matched regardless of case
+func (t *OpusTags) Get(key string) []string {
+	var values []string
+	for _, comment := range t.Comments {
+		if strings.EqualFold(comment.Key, key) {
+			values = append(values, comment.Value)
+		}
+	}
+	return values
+}
+
+// Chapter is a chapter mark of the Vorbis comment chapter extension
+type Chapter struct {
+	Start time.Duration
+	Name  string
+}
+
+// Chapters returns the chapters of the CHAPTERxxx=HH:MM:SS.sss comments with
+// the names of their CHAPTERxxxNAME comments, ordered by start time.
+// Chapters whose time does not parse are left out.
+func (t *OpusTags) Chapters() []Chapter {
+	type numberedChapter struct {
+		number string
+		Chapter
+	}
+	var chapters []numberedChapter
+	names := map[string]string{}
+	for _, comment := range t.Comments {
+		key := strings.ToUpper(comment.Key)
+		if !strings.HasPrefix(key, "CHAPTER") {
+			continue
+		}
+		number := strings.TrimPrefix(key, "CHAPTER")
+		if strings.HasSuffix(number, "NAME") {
+			names[strings.TrimSuffix(number, "NAME")] = comment.Value
+			continue
+		}
+		if number == "" || strings.Trim(number, "0123456789") != "" {
+			continue
+		}
+		if start, ok := parseChapterTime(comment.Value); ok {
+			chapters = append(chapters, numberedChapter{number: number, Chapter: Chapter{Start: start}})
+		}
+	}
+
+	sort.SliceStable(chapters, func(i, j int) bool { return chapters[i].Start < chapters[j].Start })
+	result := make([]Chapter, 0, len(chapters))
+	for _, chapter := range chapters {
+		chapter.Name = names[chapter.number]
+		result = append(result, chapter.Chapter)
+	}
+	return result
+}
+
+// parseChapterTime parses a HH:MM:SS.sss chapter time
+func parseChapterTime(value string) (time.Duration, bool) {
+	parts := strings.Split(value, ":")
+	if len(parts) != 3 {
+		return 0, false
+	}
+	hours, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	minutes, err := strconv.ParseUint(parts[1], 10, 32)
+	if err != nil || minutes >= 60 {
+		return 0, false
+	}
+	seconds, err := strconv.ParseFloat(parts[2], 64)
+	if err != nil || !(seconds >= 0 && seconds < 60) {
+		return 0, false
+	}
+	return time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute +
+		time.Duration(math.Round(seconds*float64(time.Second))), true
+}
+
+// ParseOpusTags parses an OpusTags packet. Comments without a '=' are kept
+// with an empty value.
+func ParseOpusTags(packet []byte) (*OpusTags, error) {
+	if len(packet) < len(commentPageSignature) || string(packet[:len(commentPageSignature)]) != commentPageSignature {
+		return nil, errBadOpusTagsSignature
+	}
+	payload := packet[len(commentPageSignature):]
+
+	readString := func() (string, bool) {
+		if len(payload) < 4 {
+			return "", false
+		}
+		length := binary.LittleEndian.Uint32(payload)
+		if uint64(length) > uint64(len(payload)-4) {
+			return "", false
+		}
+		value := string(payload[4 : 4+length])
+		payload = payload[4+length:]
+		return value, true
+	}
+
+	tags := &OpusTags{}
+	vendor, ok := readString()
+	if !ok || len(payload) < 4 {
+		return nil, errBadOpusTagsLength
+	}
+	tags.Vendor = vendor
+
+	count := binary.LittleEndian.Uint32(payload)
+	payload = payload[4:]
+	for i := uint32(0); i < count; i++ {
+		comment, ok := readString()
+		if !ok {
+			return nil, errBadOpusTagsLength
+		}
+		key, value, _ := strings.Cut(comment, "=")
+		tags.Comments = append(tags.Comments, OpusComment{Key: key, Value: value})
+	}
+	return tags, nil
+}
+
+// bytes returns the OpusTags packet for the tags
+func (t *OpusTags) bytes() []byte {
+	comments := make([]string, 0, len(t.Comments))
+	for _, comment := range t.Comments {
+		comments = append(comments, comment.Key+"="+comment.Value)
+	}
+	return encodeOpusTags(t.Vendor, comments)
+}
+
+// ReadTags reads the OpusTags header of the current link. It must be called
+// before the first audio packet is read.
+func (o *OggReader) ReadTags() (*OpusTags, error) {
+	for {
+		packet, err := o.ReadPacket()
+		if err == io.EOF {
+			return nil, errMissingOpusTags
+		}
+		if err != nil {
+			return nil, err
+		}
+		if packet.Index == 1 {
+			return ParseOpusTags(packet.Data)
+		}
+	}
+}
+
+// cafInformation returns the info chunk entries for the tags, nil when there is nothing to write
+func cafInformation(tags *OpusTags, mode MetadataMode) []Information {
+	if tags == nil || mode == MetadataStrip {
+		return nil
+	}
+
+	var entries []Information
+	if tags.Vendor != "" {
+		entries = append(entries, Information{Key: cafInfoSourceEncoder + "\x00", Value: tags.Vendor + "\x00"})
+	}
+	for _, comment := range tags.Comments {
+		key, ok := cafInfoKeys[strings.ToUpper(comment.Key)]
+		if !ok {
+			if mode == MetadataStandardOnly {
+				continue
+			}
+			key = strings.ToLower(comment.Key)
+		}
+		entries = append(entries, Information{Key: key + "\x00", Value: comment.Value + "\x00"})
+	}
+	return entries
+}
+
+// opusTagsFromInformation is the reverse of cafInformation. The "encoder"
+// key ffmpeg writes is taken as the vendor string.
+func opusTagsFromInformation(entries []Information) *OpusTags {
+	tags := &OpusTags{Vendor: defaultOpusVendor}
+	for _, info := range entries {
+		key := strings.TrimRight(info.Key, "\x00")
+		value := strings.TrimRight(info.Value, "\x00")
+		if key == cafInfoSourceEncoder || key == "encoder" {
+			tags.Vendor = value
+			continue
+		}
+		comment := OpusComment{Key: strings.ToUpper(key), Value: value}
+		for vorbisKey, cafKey := range cafInfoKeys {
+			if cafKey == key {
+				comment.Key = vorbisKey
+				break
+			}
+		}
+		tags.Comments = append(tags.Comments, comment)
+	}
+	return tags
+}
+
+// informationChunkSize returns the size of an info chunk holding the entries
+func informationChunkSize(entries []Information) int64 {
+	size := int64(4) // NumEntries
+	for _, info := range entries {
+		size += int64(len(info.Key) + len(info.Value))
+	}
+	return size
+}
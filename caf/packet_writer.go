@@ -0,0 +1,167 @@
+package caf
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+var errBadStreamConfig = errors.New("opus stream configuration has a bad channel count or mapping")
+
+// PacketWriterOptions configures a PacketWriter
+type PacketWriterOptions struct {
+	// FlushInterval is how much audio is collected before the CAF is brought
+	// up to date, 0 only flushes on Flush and Close
+	FlushInterval time.Duration
+	// Tags are written to the info chunk, as the comments of an Ogg file are
+	Tags *OpusTags
+	// CrashSafe keeps a packet index next to a CAF written to a file, as
+	// ConvertOptions.CrashSafe does, so that RecoverCaf can repair a
+	// recording that was never closed
+	CrashSafe bool
+}
+
+// PacketWriter writes Opus packets to a CAF as they arrive, such as frames
+// captured from WebRTC, without an Ogg file in between. The stream is
+// described by an OggHeader: its channel count, pre-skip and channel mapping.
+//
+// Packets are collected in memory and handed to the CAF every FlushInterval
+// of audio, when the CAF is brought up to date so that a file being
+// recorded plays up to the last flush. A writer that cannot seek gets the
+// whole CAF on Close.
+type PacketWriter struct {
+	cw            *CAFWriter
+	index         *os.File // Crash-safe packet index, nil when not kept
+	preSkip       int64
+	flushFrames   int64
+	pending       bytes.Buffer
+	pendingSizes  []int
+	pendingFrames []uint32
+	pendingTotal  int64
+	totalFrames   int64
+}
+
+// NewPacketWriter starts a CAF for the Opus stream that header describes.
+// Family 3 ambisonics is stored with its mapping when the demixing matrix
+// only routes channels and refused otherwise.
+func NewPacketWriter(w io.Writer, header *OggHeader, options PacketWriterOptions) (*PacketWriter, error) {
+	// Parsing the OpusHead checks the channel count and mapping table
+	parsed, err := parseOpusHead(header.bytes())
+	if err != nil {
+		return nil, errBadStreamConfig
+	}
+	cafHeader, _, err := cafOpusHeader(parsed, ConvertOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	info := cafInformation(options.Tags, MetadataPassThrough)
+	cw, err := NewCAFWriter(w, opusAudioFormat(cafHeader), opusHeaderChunks(cafHeader, info)...)
+	if err != nil {
+		return nil, err
+	}
+	pw := &PacketWriter{
+		cw:          cw,
+		preSkip:     int64(header.PreSkip),
+		flushFrames: durationSamples(options.FlushInterval),
+	}
+	if options.CrashSafe {
+		if pw.index, err = crashSafeIndex(w); err != nil {
+			return nil, err
+		}
+	}
+	if pw.index != nil {
+		if err := cw.SetPacketIndex(pw.index); err != nil {
+			pw.index.Close()
+			return nil, err
+		}
+	}
+	return pw, nil
+}
+
+// WritePacket adds an Opus packet holding the given number of samples. A
+// frames of 0 takes the duration from the packet's TOC byte.
+func (pw *PacketWriter) WritePacket(packet []byte, frames uint32) error {
+	if pw.cw.closed {
+		return errWriterClosed
+	}
+	if frames == 0 {
+		var err error
+		if frames, err = PacketDuration(packet); err != nil {
+			return err
+		}
+	}
+	pw.pending.Write(packet)
+	pw.pendingSizes = append(pw.pendingSizes, len(packet))
+	pw.pendingFrames = append(pw.pendingFrames, frames)
+	pw.pendingTotal += int64(frames)
+
+	if pw.flushFrames > 0 && pw.pendingTotal >= pw.flushFrames {
+		return pw.Flush()
+	}
+	return nil
+}
+
+// WriteFrom writes the packets next returns until it returns io.EOF, so that
+// packets from memory, a channel or a network connection go through the same
+// loop. The CAF is left open for more packets.
+func (pw *PacketWriter) WriteFrom(next func() (packet []byte, frames uint32, err error)) error {
+	for {
+		packet, frames, err := next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := pw.WritePacket(packet, frames); err != nil {
+			return err
+		}
+	}
+}
+
+// Flush hands the collected packets to the CAF and brings it up to date
+func (pw *PacketWriter) Flush() error {
+	if err := pw.writePending(); err != nil {
+		return err
+	}
+	return pw.cw.Flush()
+}
+
+// Close writes the remaining packets and finishes the CAF, and deletes the
+// crash-safe packet index. It does not close the underlying writer.
+func (pw *PacketWriter) Close() error {
+	if err := pw.writePending(); err != nil {
+		return err
+	}
+	if err := pw.cw.Close(); err != nil {
+		return err
+	}
+	return removeCrashSafeIndex(pw.index)
+}
+
+// writePending passes the collected packets on and sets the priming frames,
+// which cannot be more than the audio written
+func (pw *PacketWriter) writePending() error {
+	data := pw.pending.Bytes()
+	for i, size := range pw.pendingSizes {
+		if err := pw.cw.WritePacket(data[:size], pw.pendingFrames[i]); err != nil {
+			return err
+		}
+		data = data[size:]
+	}
+	pw.totalFrames += pw.pendingTotal
+	pw.pending.Reset()
+	pw.pendingSizes = pw.pendingSizes[:0]
+	pw.pendingFrames = pw.pendingFrames[:0]
+	pw.pendingTotal = 0
+
+	priming := pw.preSkip
+	if priming > pw.totalFrames {
+		priming = pw.totalFrames
+	}
+	pw.cw.SetTrim(int32(priming), 0)
+	return nil
+}
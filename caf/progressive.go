@@ -0,0 +1,324 @@
+package caf
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+var (
+	errNeedMoreData             = errors.New("ogg input has not arrived yet")
+	errProgressiveOptions       = errors.New("progressive conversion supports neither time ranges nor joined links")
+	errProgressiveNotReady      = errors.New("too little of the ogg input has arrived for a caf")
+	errProgressiveInputClosed   = errors.New("progressive input is closed")
+	errProgressiveIncompleteCaf = errors.New("caf cannot be written once its packets were handed on")
+)
+
+// ProgressiveConverter converts Ogg Opus that arrives a piece at a time, such
+// as a download in progress. Write takes the bytes as they come and parses
+// every complete page right away, keeping its place so that nothing is read
+// twice. WriteCaf writes a playable CAF of the audio received so far at any
+// time. The first link of the input is converted.
+type ProgressiveConverter struct {
+	options  ConvertOptions
+	input    progressiveInput
+	ogg      *OggReader
+	header   *OggHeader // Header described in the CAF
+	warnings []string
+	info     []Information
+	tagsRead bool
+	ended    bool
+	err      error
+
+	stats  audioStats
+	data   bytes.Buffer
+	sizes  []uint64
+	frames []uint64
+	// drained is set once packets were handed on instead of kept
+	drained bool
+}
+
+// NewProgressiveConverter returns a converter waiting for its first bytes.
+// Time ranges and joined links are not supported.
+func NewProgressiveConverter(options ConvertOptions) (*ProgressiveConverter, error) {
+	if options.Start != 0 || options.End != 0 || options.Chain != ChainFirstLink {
+		return nil, errProgressiveOptions
+	}
+	return &ProgressiveConverter{options: options, stats: newAudioStats()}, nil
+}
+
+// Write adds bytes of the Ogg input and converts the pages they complete. An
+// error in the input stops the conversion, the audio up to it can still be
+// written.
+func (p *ProgressiveConverter) Write(b []byte) (int, error) {
+	if p.input.closed {
+		return 0, errProgressiveInputClosed
+	}
+	if !p.ended {
+		p.input.buffer = append(p.input.buffer, b...)
+	}
+	return len(b), p.convert()
+}
+
+// Close marks the end of the input. It fails when the input stops in the
+// middle of a page or before the Opus headers.
+func (p *ProgressiveConverter) Close() error {
+	if p.input.closed {
+		return errProgressiveInputClosed
+	}
+	p.input.closed = true
+	if err := p.convert(); err != nil {
+		return err
+	}
+	if !p.tagsRead {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+// Ended reports whether the Ogg stream ended, after which further bytes
+// are ignored
+func (p *ProgressiveConverter) Ended() bool {
+	return p.ended
+}
+
+// Report describes the damage to the input that was worked around so far
+func (p *ProgressiveConverter) Report() *ConversionReport {
+	if p.ogg == nil {
+		return &ConversionReport{}
+	}
+	return newConversionReport(p.ogg, p.warnings)
+}
+
+// WriteCaf writes a CAF of the audio converted so far. Until the stream ends
+// only the pre-skip is trimmed, so the CAF plays every packet received.
+func (p *ProgressiveConverter) WriteCaf(w io.Writer) error {
+	if !p.tagsRead {
+		return errProgressiveNotReady
+	}
+	if p.drained {
+		return errProgressiveIncompleteCaf
+	}
+	cw, err := NewCAFWriter(w, opusAudioFormat(p.header), opusHeaderChunks(p.header, p.info)...)
+	if err != nil {
+		return err
+	}
+	data := p.data.Bytes()
+	for i, size := range p.sizes {
+		if err := cw.WritePacket(data[:size], uint32(p.frames[i])); err != nil {
+			return err
+		}
+		data = data[size:]
+	}
+	packetTable := p.packetTable()
+	cw.SetTrim(packetTable.PrimingFrames, packetTable.RemainderFrames)
+	return cw.Close()
+}
+
+// packetTable returns the packet table header of the audio so far. The end
+// trimming only counts once the stream has ended.
+func (p *ProgressiveConverter) packetTable() CAFPacketTableHeader {
+	stats := p.stats
+	if !p.ended {
+		stats.lastGranule = unknownGranulePosition
+	}
+	return packetTableHeader(p.ogg.header, stats)
+}
+
+// drain hands the packets kept so far to handle and forgets them, for
+// callers that write the CAF as they go
+func (p *ProgressiveConverter) drain(handle func(packet []byte, frames uint32) error) error {
+	p.drained = true
+	data := p.data.Bytes()
+	for i, size := range p.sizes {
+		if err := handle(data[:size], uint32(p.frames[i])); err != nil {
+			return err
+		}
+		data = data[size:]
+	}
+	p.data.Reset()
+	p.sizes = p.sizes[:0]
+	p.frames = p.frames[:0]
+	return nil
+}
+
+// convert parses as much of the input as has arrived. Running out of input
+// leaves the reader where it was, to carry on with the next bytes.
+func (p *ProgressiveConverter) convert() error {
+	if p.err != nil || p.ended {
+		return p.err
+	}
+	p.err = p.parse()
+	if errors.Is(p.err, errNeedMoreData) {
+		p.err = nil
+	}
+	return p.err
+}
+
+func (p *ProgressiveConverter) parse() error {
+	if p.ogg == nil {
+		// The headers are read again from the start until they are all
+		// there, they span a few pages at most
+		p.input.position = 0
+		ogg, header, err := NewWithOptions(&p.input, p.options.readerOptions())
+		if err != nil {
+			return err
+		}
+		cafHeader, warnings, err := cafOpusHeader(header, p.options)
+		if err != nil {
+			return err
+		}
+		p.ogg, p.header, p.warnings = ogg, cafHeader, warnings
+	}
+
+	if !p.tagsRead {
+		info, err := readCafInformation(p.ogg, p.options)
+		if err != nil {
+			return err
+		}
+		p.info = info
+		p.tagsRead = true
+	}
+
+	for {
+		packet, err := p.ogg.ReadPacket()
+		if err == io.EOF {
+			p.ended = true
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if packet.Index < opusHeaderPackets {
+			continue
+		}
+
+		frames, err := PacketDuration(packet.Data)
+		if err != nil {
+			return err
+		}
+		p.data.Write(packet.Data)
+		p.sizes = append(p.sizes, uint64(len(packet.Data)))
+		p.frames = append(p.frames, uint64(frames))
+		p.stats.add(packet, frames)
+		p.input.compact()
+	}
+}
+
+// progressiveInput is the input of a ProgressiveConverter. It reports
+// errNeedMoreData rather than io.EOF when it runs out before it is closed.
+type progressiveInput struct {
+	buffer   []byte
+	position int
+	closed   bool
+}
+
+func (in *progressiveInput) Read(b []byte) (int, error) {
+	if in.position == len(in.buffer) {
+		if in.closed {
+			return 0, io.EOF
+		}
+		return 0, errNeedMoreData
+	}
+	n := copy(b, in.buffer[in.position:])
+	in.position += n
+	return n, nil
+}
+
+// compact drops the bytes that were read, once they make up most of the buffer
+func (in *progressiveInput) compact() {
+	if in.position > 64*1024 && in.position > len(in.buffer)/2 {
+		in.buffer = append(in.buffer[:0], in.buffer[in.position:]...)
+		in.position = 0
+	}
+}
+
+// FollowOptions sets how FollowOpusToCaf waits for a growing input
+type FollowOptions struct {
+	// Poll is how often the input is checked for new bytes, every second
+	// when 0
+	Poll time.Duration
+	// Idle stops following once the input has not grown for this long, 0
+	// follows until the Ogg stream ends
+	Idle time.Duration
+}
+
+// FollowOpusToCaf converts an Ogg Opus file that is still being written, as
+// tail -f follows a log. New pages are converted as they appear and the CAF
+// is brought up to date after each, so it plays up to the audio read so far.
+// It returns once the Ogg stream ends, or once the input stops growing for
+// the idle time of follow.
+func FollowOpusToCaf(inputFile string, outputFile string, options ConvertOptions, follow FollowOptions) (*ConversionReport, error) {
+	if follow.Poll <= 0 {
+		follow.Poll = time.Second
+	}
+	p, err := NewProgressiveConverter(options)
+	if err != nil {
+		return nil, err
+	}
+
+	inFile, err := os.Open(inputFile)
+	if err != nil {
+		return nil, err
+	}
+	defer inFile.Close()
+	outFile, err := os.Create(outputFile)
+	if err != nil {
+		return nil, err
+	}
+	defer outFile.Close()
+
+	var cw *CAFWriter
+	buffer := make([]byte, 32*1024)
+	lastGrowth := time.Now()
+	for {
+		grew := false
+		for !p.Ended() {
+			n, err := inFile.Read(buffer)
+			if n > 0 {
+				grew = true
+				if _, err := p.Write(buffer[:n]); err != nil {
+					return p.Report(), err
+				}
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return p.Report(), err
+			}
+		}
+
+		if cw == nil && p.tagsRead {
+			cw, err = NewCAFWriter(outFile, opusAudioFormat(p.header), opusHeaderChunks(p.header, p.info)...)
+			if err != nil {
+				return p.Report(), err
+			}
+		}
+		if cw != nil && (grew || p.Ended()) {
+			if err := p.drain(cw.WritePacket); err != nil {
+				return p.Report(), err
+			}
+			packetTable := p.packetTable()
+			cw.SetTrim(packetTable.PrimingFrames, packetTable.RemainderFrames)
+			if p.Ended() {
+				return p.Report(), cw.Close()
+			}
+			if err := cw.Flush(); err != nil {
+				return p.Report(), err
+			}
+		}
+
+		if grew {
+			lastGrowth = time.Now()
+		} else if follow.Idle > 0 && time.Since(lastGrowth) >= follow.Idle {
+			if cw == nil {
+				return p.Report(), errProgressiveNotReady
+			}
+			return p.Report(), cw.Close()
+		}
+		time.Sleep(follow.Poll)
+	}
+}
@@ -0,0 +1,361 @@
+package caf
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errNoSplitRule         = errors.New("split options set no rule to cut the input by")
+	errSplitTimeRange      = errors.New("a time range cannot be combined with splitting")
+	errSplitPacketTooLarge = errors.New("a packet does not fit in a piece of the maximum size")
+)
+
+// cafInfoPartNumber numbers the pieces of a split in their info chunks
+const cafInfoPartNumber = "part number"
+
+// SplitOptions sets where SplitToCaf cuts its input. A new piece starts
+// wherever any of the rules asks for one.
+type SplitOptions struct {
+	// Chapters starts a piece at every chapter of the CHAPTERxxx comments
+	Chapters bool
+	// Duration is the longest a piece plays for
+	Duration time.Duration
+	// MaxSize is the largest a piece file may be, in bytes
+	MaxSize int64
+}
+
+// SplitToCaf cuts an Ogg Opus file or an Opus CAF into CAF pieces, named
+// after outputFile with the part number added as SplitOpusLinksToCaf does.
+// The cuts are made on packet boundaries, at the packet holding the time
+// of a cut. The first piece keeps the priming frames of the input and the
+// last one its remainder frames. Every later piece starts with the packets
+// of the Opus pre-roll ahead of its cut as priming frames, so that its
+// decoder has settled by the cut, and these packets end the piece before it
+// as well. Every piece gets the info entries of the input, without the
+// chapters, and its part number.
+//
+// Ogg input is read with the options, which cannot set a time range. CAF
+// input is recognised by its file header.
+func SplitToCaf(inputFile string, outputFile string, split SplitOptions, options ConvertOptions) ([]string, *ConversionReport, error) {
+	if !split.Chapters && split.Duration <= 0 && split.MaxSize <= 0 {
+		return nil, nil, errNoSplitRule
+	}
+	if options.Start != 0 || options.End != 0 {
+		return nil, nil, errSplitTimeRange
+	}
+
+	inFile, err := os.Open(inputFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer inFile.Close()
+
+	fileType := make([]byte, 4)
+	if _, err := io.ReadFull(inFile, fileType); err != nil && err != io.ErrUnexpectedEOF {
+		return nil, nil, err
+	}
+	if _, err := inFile.Seek(0, io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+
+	var input *splitInput
+	if string(fileType) == "caff" {
+		input, err = cafSplitInput(inFile, options)
+	} else {
+		input, err = opusSplitInput(inFile, options)
+	}
+	if err != nil {
+		return nil, input.conversionReport(), err
+	}
+
+	splitter := newCAFSplitter(input, split, outputFile, options.Metadata != MetadataStrip)
+	audio, err := input.source(splitter.add)
+	if err == nil {
+		err = splitter.finish(audio)
+	}
+	report := input.conversionReport()
+	report.Warnings = append(report.Warnings, audio.warnings...)
+	return splitter.outputFiles, report, err
+}
+
+// splitInput is the audio and metadata of the file being split
+type splitInput struct {
+	header   *OggHeader
+	info     []Information
+	chapters []Chapter
+	source   audioSource
+	report   func() *ConversionReport
+}
+
+func (in *splitInput) conversionReport() *ConversionReport {
+	if in == nil || in.report == nil {
+		return &ConversionReport{}
+	}
+	return in.report()
+}
+
+// opusSplitInput reads the first link of an Ogg Opus file, or all of them
+// when the options join the links
+func opusSplitInput(r io.Reader, options ConvertOptions) (*splitInput, error) {
+	ogg, header, err := NewWithOptions(bufio.NewReaderSize(r, 32*1024), options.readerOptions())
+	if err != nil {
+		return nil, err
+	}
+	input := &splitInput{}
+	var warnings []string
+	input.report = func() *ConversionReport { return newConversionReport(ogg, warnings) }
+
+	input.header, warnings, err = cafOpusHeader(header, options)
+	if err != nil {
+		return input, err
+	}
+	tags, err := readOpusTags(ogg, options)
+	if err != nil {
+		return input, err
+	}
+	if tags != nil {
+		input.chapters = tags.Chapters()
+	}
+	input.info = cafInformation(tags, options.Metadata)
+
+	input.source = linkAudio(ogg, header)
+	if options.Chain == ChainJoin {
+		input.source = joinedLinkAudio(ogg, header, func() (*OggReader, *OggHeader, error) {
+			next, err := ogg.NextLink()
+			return ogg, next, err
+		})
+	}
+	return input, nil
+}
+
+// cafSplitInput reads the packets of an Opus CAF
+func cafSplitInput(file *os.File, options ConvertOptions) (*splitInput, error) {
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	cf, err := NewCAFReader(file, stat.Size())
+	if err != nil {
+		return nil, err
+	}
+
+	input := &splitInput{}
+	if input.header, input.source, err = cf.opusAudio(); err != nil {
+		return nil, err
+	}
+	infoChunk, err := cf.Information()
+	if err == nil {
+		input.chapters = opusTagsFromInformation(infoChunk.Strings).Chapters()
+		if options.Metadata != MetadataStrip {
+			input.info = infoChunk.Strings
+		}
+	} else if err != errChunkNotFound {
+		return nil, err
+	}
+	return input, nil
+}
+
+// cafSplitter collects the packets of a piece and writes the piece out when
+// the next one starts
+type cafSplitter struct {
+	header      *OggHeader
+	info        []Information
+	withInfo    bool
+	split       SplitOptions
+	cuts        []int64 // Chapter starts in samples
+	outputFile  string
+	outputFiles []string
+
+	position    int64 // Start of the next packet, counted after the priming frames
+	pieceStart  int64
+	priming     int64
+	data        bytes.Buffer
+	sizes       []uint64
+	frames      []uint64
+	pieceFrames int64
+	sizesSize   int64 // Bytes the packet sizes take in the packet table
+	framesSize  int64 // Bytes the frame counts take, when they vary
+	variable    bool  // Frame counts vary between the packets
+	headerSize  int64
+	// The latest packets, which cover the pre-roll ahead of the next packet
+	recent       [][]byte
+	recentFrames []uint32
+	recentTotal  int64
+}
+
+func newCAFSplitter(input *splitInput, split SplitOptions, outputFile string, withInfo bool) *cafSplitter {
+	s := &cafSplitter{
+		header:     input.header,
+		withInfo:   withInfo,
+		split:      split,
+		outputFile: outputFile,
+		position:   -int64(input.header.PreSkip),
+		priming:    int64(input.header.PreSkip),
+	}
+	// The chapter marks only hold for the whole input
+	for _, info := range input.info {
+		if !strings.HasPrefix(strings.ToLower(info.Key), "chapter") {
+			s.info = append(s.info, info)
+		}
+	}
+	if split.Chapters {
+		for _, chapter := range input.chapters {
+			s.cuts = append(s.cuts, durationSamples(chapter.Start))
+		}
+	}
+	return s
+}
+
+// add is the audioSource handler that sorts the packets into pieces
+func (s *cafSplitter) add(packet []byte, frames uint32) error {
+	packetStart := s.position
+	s.position += int64(frames)
+
+	// A piece holds more than the priming frames, so that it plays
+	if s.pieceFrames > s.priming && s.cutBefore(packetStart, len(packet), frames) {
+		header := CAFPacketTableHeader{PrimingFrames: int32(s.priming)}
+		if err := s.writePiece(header); err != nil {
+			return err
+		}
+	}
+	if len(s.sizes) == 0 {
+		s.startPiece(packetStart)
+		if s.split.MaxSize > 0 && s.pieceSize(len(packet), frames) > s.split.MaxSize {
+			return errSplitPacketTooLarge
+		}
+	}
+	s.addToPiece(packet, frames)
+
+	s.recent = append(s.recent, append([]byte(nil), packet...))
+	s.recentFrames = append(s.recentFrames, frames)
+	s.recentTotal += int64(frames)
+	for s.recentTotal-int64(s.recentFrames[0]) >= opusPreRoll {
+		s.recentTotal -= int64(s.recentFrames[0])
+		s.recent = s.recent[1:]
+		s.recentFrames = s.recentFrames[1:]
+	}
+	return nil
+}
+
+// addToPiece adds a packet to the piece being collected
+func (s *cafSplitter) addToPiece(packet []byte, frames uint32) {
+	s.data.Write(packet)
+	s.sizes = append(s.sizes, uint64(len(packet)))
+	s.variable = s.variable || (len(s.frames) > 0 && uint64(frames) != s.frames[0])
+	s.frames = append(s.frames, uint64(frames))
+	s.pieceFrames += int64(frames)
+	s.sizesSize += int64(encodedIntLength(uint64(len(packet))))
+	s.framesSize += int64(encodedIntLength(uint64(frames)))
+}
+
+// cutBefore reports whether a packet starts a new piece
+func (s *cafSplitter) cutBefore(packetStart int64, size int, frames uint32) bool {
+	packetEnd := packetStart + int64(frames)
+	if s.split.Duration > 0 && packetEnd > s.pieceStart+durationSamples(s.split.Duration) {
+		return true
+	}
+	if len(s.cuts) > 0 && packetEnd > s.cuts[0] {
+		return true
+	}
+	return s.split.MaxSize > 0 && s.pieceSize(size, frames) > s.split.MaxSize
+}
+
+// startPiece starts a piece with the packet at packetStart. Chapters that
+// start within the packet are passed over. A piece after the first one gets
+// the pre-roll packets as its priming frames.
+func (s *cafSplitter) startPiece(packetStart int64) {
+	s.pieceStart = packetStart
+	if s.pieceStart < 0 {
+		s.pieceStart = 0
+	}
+	for len(s.cuts) > 0 && s.cuts[0] < s.position {
+		s.cuts = s.cuts[1:]
+	}
+
+	s.headerSize, _ = writeCafPreamble(io.Discard, opusAudioFormat(s.header), opusHeaderChunks(s.header, s.pieceInfo()))
+	if len(s.outputFiles) > 0 {
+		for i, packet := range s.recent {
+			s.addToPiece(packet, s.recentFrames[i])
+		}
+		s.priming = s.recentTotal
+	}
+}
+
+// pieceSize returns the size of the piece file with another packet added
+func (s *cafSplitter) pieceSize(size int, frames uint32) int64 {
+	const dataChunkOverhead = cafChunkHeaderSize + dataEditCountSize
+	const packetTableOverhead = cafChunkHeaderSize + 24
+	pieceSize := s.headerSize + dataChunkOverhead + int64(s.data.Len()+size) +
+		packetTableOverhead + s.sizesSize + int64(encodedIntLength(uint64(size)))
+	// The frame counts are only stored when they vary
+	if len(s.frames) > 0 && (s.variable || uint64(frames) != s.frames[0]) {
+		pieceSize += s.framesSize + int64(encodedIntLength(uint64(frames)))
+	}
+	return pieceSize
+}
+
+// pieceInfo returns the info entries of the next piece
+func (s *cafSplitter) pieceInfo() []Information {
+	if !s.withInfo {
+		return nil
+	}
+	part := strconv.Itoa(len(s.outputFiles) + 1)
+	info := append([]Information(nil), s.info...)
+	return append(info, Information{Key: cafInfoPartNumber + "\x00", Value: part + "\x00"})
+}
+
+// writePiece writes the collected packets as the next piece. The packet
+// table header gets its packet and valid frame counts filled in.
+func (s *cafSplitter) writePiece(header CAFPacketTableHeader) error {
+	header.NumberPackets = int64(len(s.sizes))
+	header.NumberValidFrames = s.pieceFrames - int64(header.PrimingFrames) - int64(header.RemainderFrames)
+
+	data := s.data.Bytes()
+	source := func(handle func(packet []byte, frames uint32) error) (cafAudio, error) {
+		offset := uint64(0)
+		for i, size := range s.sizes {
+			if err := handle(data[offset:offset+size], uint32(s.frames[i])); err != nil {
+				return cafAudio{}, err
+			}
+			offset += size
+		}
+		return cafAudio{packetTable: header}, nil
+	}
+
+	pieceFile := numberedFileName(s.outputFile, len(s.outputFiles)+1)
+	if _, err := writeCafFile(pieceFile, s.header, s.pieceInfo(), source, false); err != nil {
+		return err
+	}
+	s.outputFiles = append(s.outputFiles, pieceFile)
+
+	s.data.Reset()
+	s.sizes = s.sizes[:0]
+	s.frames = s.frames[:0]
+	s.pieceFrames = 0
+	s.sizesSize = 0
+	s.framesSize = 0
+	s.variable = false
+	return nil
+}
+
+// finish writes the last piece, which takes the remainder frames of the input
+func (s *cafSplitter) finish(audio cafAudio) error {
+	if len(s.sizes) == 0 {
+		return nil
+	}
+	header := CAFPacketTableHeader{PrimingFrames: int32(s.priming), RemainderFrames: audio.packetTable.RemainderFrames}
+	if len(s.outputFiles) == 0 {
+		header.PrimingFrames = audio.packetTable.PrimingFrames
+	}
+	if int64(header.PrimingFrames)+int64(header.RemainderFrames) > s.pieceFrames {
+		header.RemainderFrames = int32(s.pieceFrames - int64(header.PrimingFrames))
+	}
+	return s.writePiece(header)
+}
@@ -0,0 +1,77 @@
+package caf
+
+import (
+	"errors"
+	"time"
+)
+
+// opusSampleRate is the rate Opus granule positions and durations count at
+const opusSampleRate = 48000
+
+var (
+	errBadTimeRange   = errors.New("time range end is not after its start")
+	errEmptyTimeRange = errors.New("time range is outside the audio")
+)
+
+// durationSamples converts a duration to a number of 48 kHz samples
+func durationSamples(d time.Duration) int64 {
+	return int64(d) * opusSampleRate / int64(time.Second)
+}
+
+// timeRangeAudio restricts source to the time range of the options, when one is set
+func (o ConvertOptions) timeRangeAudio(source audioSource, header *OggHeader) (audioSource, error) {
+	if o.Start == 0 && o.End == 0 {
+		return source, nil
+	}
+	if o.Start < 0 || o.End < 0 || (o.End > 0 && o.End <= o.Start) {
+		return nil, errBadTimeRange
+	}
+	return trimmedAudio(source, header, durationSamples(o.Start), durationSamples(o.End)), nil
+}
+
+// trimmedAudio is the part of source that covers the samples from start to
+// end, counted after the pre-skip. An end of 0 runs to the end of the audio.
+// The packets holding the range and the 80 ms pre-roll ahead of it are
+// copied unchanged, and the priming and remainder frames of the packet table
+// cut the output down to exactly the range.
+func trimmedAudio(source audioSource, header *OggHeader, start int64, end int64) audioSource {
+	return func(handle func(packet []byte, frames uint32) error) (cafAudio, error) {
+		var trimmed cafAudio
+		firstFrame := int64(0)
+		totalFrames := int64(0)
+
+		position := -int64(header.PreSkip)
+		audio, err := source(func(packet []byte, frames uint32) error {
+			packetStart := position
+			position += int64(frames)
+			if position <= start-opusPreRoll || (end > 0 && packetStart >= end) {
+				return nil
+			}
+
+			if trimmed.packetTable.NumberPackets == 0 {
+				firstFrame = packetStart
+			}
+			trimmed.packetTable.NumberPackets++
+			totalFrames += int64(frames)
+			return handle(packet, frames)
+		})
+		trimmed.warnings = audio.warnings
+		if err != nil {
+			return trimmed, err
+		}
+
+		// The source may end before the range does, or trim its last samples
+		validEnd := int64(audio.packetTable.PrimingFrames) - int64(header.PreSkip) + audio.packetTable.NumberValidFrames
+		if end == 0 || end > validEnd {
+			end = validEnd
+		}
+		if trimmed.packetTable.NumberPackets == 0 || start >= end {
+			return trimmed, errEmptyTimeRange
+		}
+
+		trimmed.packetTable.PrimingFrames = int32(start - firstFrame)
+		trimmed.packetTable.NumberValidFrames = end - start
+		trimmed.packetTable.RemainderFrames = int32(totalFrames - (start - firstFrame) - (end - start))
+		return trimmed, nil
+	}
+}
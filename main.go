@@ -2,16 +2,57 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 
 	"github.com/nabil6391/opus_caf_converter/caf"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "concat" {
+		concat(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "split" {
+		split(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "recover" {
+		recoverCaf(os.Args[2:])
+		return
+	}
+
 	inputFile := ""
 	outputFile := ""
+	options := caf.ConvertOptions{}
+	links := "first"
+	metadata := "passthrough"
+	follow := false
+	followOptions := caf.FollowOptions{}
 
 	flag.StringVar(&inputFile, "i", "", "input file")
 	flag.StringVar(&outputFile, "o", "", "output file")
+	flag.BoolVar(&options.Lenient, "lenient", false, "skip Ogg pages with a bad CRC instead of failing")
+	flag.BoolVar(&options.KeepDemixingMatrix, "keep-demixing-matrix", false, "keep ambisonics whose demixing matrix mixes channels instead of failing")
+	flag.StringVar(&metadata, "metadata", metadata, "comments to keep in the info chunk: passthrough, standard or strip")
+	flag.DurationVar(&options.Start, "start", 0, "time to start converting from, such as 30s or 1m30s")
+	flag.DurationVar(&options.End, "end", 0, "time to stop converting at, the end of the audio when 0")
+	flag.StringVar(&links, "links", links, "links of a chained Ogg file to convert: first, join or split into numbered files")
+	flag.BoolVar(&options.CrashSafe, "crash-safe", false, "keep a packet index next to the output until it is complete, for the recover command")
+	flag.BoolVar(&follow, "follow", false, "keep converting an input that is still being written until its Ogg stream ends, like tail -f")
+	flag.DurationVar(&followOptions.Idle, "idle", 0, "with -follow, stop once the input has not grown for this long")
+	flag.Func("serial", "serial number of the logical stream to convert in a multiplexed Ogg file", func(value string) error {
+		serial, err := strconv.ParseUint(value, 0, 32)
+		if err != nil {
+			return err
+		}
+		options.Serial = new(uint32)
+		*options.Serial = uint32(serial)
+		return nil
+	})
 
 	flag.Parse()
 
@@ -20,7 +61,187 @@ func main() {
 		return
 	}
 
-	if err := caf.ConvertOpusToCaf(inputFile, outputFile); err != nil {
+	if isCafToOpus(inputFile, outputFile) {
+		if err := caf.ConvertCafToOpus(inputFile, outputFile); err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	var ok bool
+	if options.Metadata, ok = metadataMode(metadata); !ok {
+		flag.Usage()
+		return
+	}
+
+	switch links {
+	case "first":
+		options.Chain = caf.ChainFirstLink
+	case "join":
+		options.Chain = caf.ChainJoin
+	case "split":
+		outputFiles, report, err := caf.SplitOpusLinksToCaf(inputFile, outputFile, options)
+		if err != nil {
+			panic(err)
+		}
+		for _, file := range outputFiles {
+			fmt.Println(file)
+		}
+		printReport(report)
+		return
+	default:
+		flag.Usage()
+		return
+	}
+
+	if follow {
+		report, err := caf.FollowOpusToCaf(inputFile, outputFile, options, followOptions)
+		if err != nil {
+			panic(err)
+		}
+		printReport(report)
+		return
+	}
+
+	report, err := caf.ConvertOpusToCafWithOptions(inputFile, outputFile, options)
+	if err != nil {
 		panic(err)
 	}
+	printReport(report)
+}
+
+// concat joins the Ogg Opus files given as arguments into one CAF:
+// opus_caf_converter concat -o episode.caf intro.opus body.opus outro.opus
+func concat(args []string) {
+	flags := flag.NewFlagSet("concat", flag.ExitOnError)
+	outputFile := ""
+	options := caf.ConvertOptions{}
+	metadata := "passthrough"
+	links := false
+
+	flags.StringVar(&outputFile, "o", "", "output file")
+	flags.BoolVar(&options.Lenient, "lenient", false, "skip Ogg pages with a bad CRC instead of failing")
+	flags.StringVar(&metadata, "metadata", metadata, "comments of the first input to keep in the info chunk: passthrough, standard or strip")
+	flags.BoolVar(&links, "all-links", false, "add every link of chained inputs instead of the first one")
+	flags.BoolVar(&options.CrashSafe, "crash-safe", false, "keep a packet index next to the output until it is complete, for the recover command")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: opus_caf_converter concat -o output.caf input.opus...")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	var ok bool
+	if options.Metadata, ok = metadataMode(metadata); !ok || outputFile == "" || flags.NArg() == 0 {
+		flags.Usage()
+		return
+	}
+	if links {
+		options.Chain = caf.ChainJoin
+	}
+
+	report, err := caf.ConcatOpusToCaf(flags.Args(), outputFile, options)
+	if err != nil {
+		panic(err)
+	}
+	printReport(report)
+}
+
+// split cuts an Ogg Opus file or an Opus CAF into numbered CAF pieces:
+// opus_caf_converter split -every 10m -o part.caf recording.opus
+func split(args []string) {
+	flags := flag.NewFlagSet("split", flag.ExitOnError)
+	outputFile := ""
+	options := caf.ConvertOptions{}
+	splitOptions := caf.SplitOptions{}
+	metadata := "passthrough"
+
+	flags.StringVar(&outputFile, "o", "", "output file, the pieces get its name with the part number added")
+	flags.BoolVar(&options.Lenient, "lenient", false, "skip Ogg pages with a bad CRC instead of failing")
+	flags.StringVar(&metadata, "metadata", metadata, "comments to keep in the info chunks: passthrough, standard or strip")
+	flags.BoolVar(&splitOptions.Chapters, "chapters", false, "start a piece at every chapter")
+	flags.DurationVar(&splitOptions.Duration, "every", 0, "longest duration of a piece, such as 10m")
+	flags.Int64Var(&splitOptions.MaxSize, "max-size", 0, "largest size of a piece file in bytes")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: opus_caf_converter split [-chapters] [-every duration] [-max-size bytes] -o output.caf input")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	var ok bool
+	if options.Metadata, ok = metadataMode(metadata); !ok || outputFile == "" || flags.NArg() != 1 {
+		flags.Usage()
+		return
+	}
+
+	outputFiles, report, err := caf.SplitToCaf(flags.Arg(0), outputFile, splitOptions, options)
+	if err != nil {
+		panic(err)
+	}
+	for _, file := range outputFiles {
+		fmt.Println(file)
+	}
+	printReport(report)
+}
+
+// recoverCaf rebuilds a CAF whose writing was cut short from its packet index:
+// opus_caf_converter recover -o fixed.caf recording.caf
+func recoverCaf(args []string) {
+	flags := flag.NewFlagSet("recover", flag.ExitOnError)
+	outputFile := ""
+	indexFile := ""
+
+	flags.StringVar(&outputFile, "o", "", "output file")
+	flags.StringVar(&indexFile, "index", "", "packet index, the input file name with "+caf.PacketIndexSuffix+" added when not given")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: opus_caf_converter recover [-index file] -o output.caf input.caf")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if outputFile == "" || flags.NArg() != 1 {
+		flags.Usage()
+		return
+	}
+
+	report, err := caf.RecoverCaf(flags.Arg(0), indexFile, outputFile)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("recovered %d packets, %d frames\n", report.Packets, report.Frames)
+	if report.LostBytes > 0 {
+		fmt.Fprintf(os.Stderr, "lost %d bytes of audio after the last whole packet\n", report.LostBytes)
+	}
+}
+
+func metadataMode(metadata string) (caf.MetadataMode, bool) {
+	switch metadata {
+	case "passthrough":
+		return caf.MetadataPassThrough, true
+	case "standard":
+		return caf.MetadataStandardOnly, true
+	case "strip":
+		return caf.MetadataStrip, true
+	}
+	return 0, false
+}
+
+// isCafToOpus picks the conversion direction from the file extensions,
+// anything that is not a CAF input is treated as Ogg Opus
+func isCafToOpus(inputFile string, outputFile string) bool {
+	inputExt := strings.ToLower(filepath.Ext(inputFile))
+	outputExt := strings.ToLower(filepath.Ext(outputFile))
+
+	return inputExt == ".caf" && outputExt != ".caf"
+}
+
+func printReport(report *caf.ConversionReport) {
+	for _, page := range report.BadPages {
+		fmt.Fprintf(os.Stderr, "skipped damaged page: %v\n", page)
+	}
+	for _, skipped := range report.Skipped {
+		fmt.Fprintf(os.Stderr, "skipped %d bytes at offset %d\n", skipped.Length, skipped.Offset)
+	}
+	for _, warning := range report.Warnings {
+		fmt.Fprintf(os.Stderr, "warning: %s\n", warning)
+	}
 }